@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageMeta records which age recipients a file was encrypted to.
+// The age header of the file itself carries everything needed to decrypt it.
+//
+// Fields:
+// - Recipients: The public keys of the recipients able to decrypt the file.
+type ageMeta struct {
+	Recipients []string `json:"recipients"`
+}
+
+// ageRecipientsFromEnv reads the age recipients from BACKUP_AGE_RECIPIENTS (comma separated)
+// and BACKUP_AGE_RECIPIENTS_FILE (one recipient per line, "#" starts a comment).
+//
+// Returns:
+// - []age.Recipient: The parsed recipients, empty when none are configured.
+// - []string: The public keys of the recipients, as configured.
+// - error: An error if a recipient cannot be parsed.
+func ageRecipientsFromEnv() ([]age.Recipient, []string, error) {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("BACKUP_AGE_RECIPIENTS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if recipientsFile := os.Getenv("BACKUP_AGE_RECIPIENTS_FILE"); recipientsFile != "" {
+		data, err := os.ReadFile(recipientsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read age recipients file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+	}
+
+	recipients := make([]age.Recipient, 0, len(names))
+	for _, name := range names {
+		recipient, err := age.ParseX25519Recipient(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid age recipient %q: %w", name, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, names, nil
+}
+
+// loadAgeIdentities reads age identities (private keys) from identity files.
+//
+// Parameters:
+// - paths: The paths of the identity files, as produced by age-keygen.
+//
+// Returns:
+// - []age.Identity: The identities found in every file.
+// - error: An error if a file cannot be read or parsed.
+func loadAgeIdentities(paths []string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, p := range paths {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open age identity file: %w", err)
+		}
+		parsed, err := age.ParseIdentities(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age identity file %s: %w", p, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	return identities, nil
+}
+
+// isAgeName reports whether a stored file name carries the age extension.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - bool: True if the file is age encrypted, otherwise false.
+func isAgeName(name string) bool {
+	return strings.HasSuffix(name, ".age")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// artifactMetaSuffix is appended to the key of a backup file to name the metadata stored next to it.
+const artifactMetaSuffix = ".meta.json"
+
+// artifactMeta is the metadata stored next to a backup file.
+//
+// Fields:
+// - Encryption: The information needed to decrypt the file, if it is encrypted with the master key.
+// - Age: The recipients the file is encrypted to, if it is age encrypted.
+// - GTIDSet: The GTIDs of the transactions held by a binlog chunk, if GTIDs are enabled.
+type artifactMeta struct {
+	Encryption *encryptionMeta `json:"encryption,omitempty"`
+	Age        *ageMeta        `json:"age,omitempty"`
+	GTIDSet    string          `json:"gtid_set,omitempty"`
+}
+
+// artifactName returns the name a backup file is stored under once the configured codecs are applied.
+//
+// Parameters:
+// - fileName: The name of the backup file as produced (e.g., "20240101_000000_all_databases_full_backup.sql").
+//
+// Returns:
+// - string: The stored name, carrying one extension per applied codec.
+func (db *DB) artifactName(fileName string) string {
+	name := fileName + db.Compression.Extension()
+	if db.Encryption.AgeEnabled() {
+		name += ".age"
+	} else if db.Encryption.Enabled() {
+		name += ".enc"
+	}
+	return name
+}
+
+// newArtifactWriter wraps dest so that everything written is compressed and then encrypted with the configured codecs.
+// Closing the returned writer flushes the encoded stream but does not close dest.
+//
+// Parameters:
+// - dest: The writer receiving the stored representation of the backup file.
+//
+// Returns:
+// - io.WriteCloser: The encoding writer.
+// - *artifactMeta: The metadata to store next to the file, nil if there is none.
+// - error: An error if an encoder cannot be created.
+func (db *DB) newArtifactWriter(dest io.Writer) (io.WriteCloser, *artifactMeta, error) {
+	var meta *artifactMeta
+	var closers []io.Closer
+	target := dest
+
+	if db.Encryption.AgeEnabled() {
+		ageWriter, err := age.Encrypt(dest, db.Encryption.AgeRecipients...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create age writer: %w", err)
+		}
+		meta = &artifactMeta{Age: &ageMeta{Recipients: db.Encryption.AgeRecipientNames}}
+		closers = append(closers, ageWriter)
+		target = ageWriter
+	} else if db.Encryption.Enabled() {
+		encWriter, encMeta, err := db.Encryption.NewWriter(dest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create encryption writer: %w", err)
+		}
+		meta = &artifactMeta{Encryption: encMeta}
+		closers = append(closers, encWriter)
+		target = encWriter
+	}
+
+	compWriter, err := db.Compression.NewWriter(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create compression writer: %w", err)
+	}
+	// The compressor must flush into the encryptor before the encryptor seals its final segment.
+	closers = append([]io.Closer{compWriter}, closers...)
+
+	return chainWriter{Writer: compWriter, closers: closers}, meta, nil
+}
+
+// chainWriter is an io.WriteCloser that closes a chain of encoders in order.
+//
+// Fields:
+// - Writer: The outermost encoder data is written to.
+// - closers: The encoders closed, in order, by Close.
+type chainWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// Close closes every encoder of the chain and returns the first error.
+func (c chainWriter) Close() error {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimArtifactExt removes the codec extensions from a stored backup file name.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - string: The name of the backup file as it was produced.
+func trimArtifactExt(name string) string {
+	return trimCompressionExt(strings.TrimSuffix(strings.TrimSuffix(name, ".enc"), ".age"))
+}
+
+// isArtifactMeta reports whether a stored file is the metadata of another backup file.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - bool: True if the file holds artifact metadata, otherwise false.
+func isArtifactMeta(name string) bool {
+	return strings.HasSuffix(name, artifactMetaSuffix)
+}
+
+// writeArtifactMeta stores meta next to the backup file stored under key.
+//
+// Parameters:
+// - ctx: The context for managing the upload.
+// - st: The storage holding the backup file.
+// - key: The storage key of the backup file.
+// - meta: The metadata to store, nothing is written when nil.
+//
+// Returns:
+// - error: An error if the metadata cannot be stored, otherwise nil.
+func writeArtifactMeta(ctx context.Context, st Storage, key string, meta *artifactMeta) error {
+	if meta == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata of %s: %w", key, err)
+	}
+	return st.Put(ctx, key+artifactMetaSuffix, bytes.NewReader(data))
+}
+
+// readArtifactMeta loads the metadata stored next to the backup file stored under key.
+//
+// Parameters:
+// - ctx: The context for managing the download.
+// - st: The storage holding the backup file.
+// - key: The storage key of the backup file.
+//
+// Returns:
+// - *artifactMeta: The metadata of the backup file.
+// - error: An error if the metadata cannot be read or decoded.
+func readArtifactMeta(ctx context.Context, st Storage, key string) (*artifactMeta, error) {
+	reader, err := st.Get(ctx, key+artifactMetaSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", key, err)
+	}
+	defer reader.Close()
+
+	var meta artifactMeta
+	if err := json.NewDecoder(reader).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata of %s: %w", key, err)
+	}
+	return &meta, nil
+}
+
+// newArtifactReader wraps r so that the stored backup file called name is transparently decrypted and decompressed.
+// The codecs are detected from the extensions of name.
+//
+// Parameters:
+// - r: The reader over the stored backup file.
+// - name: The stored file name or storage key.
+// - meta: The metadata stored next to the file (required for files encrypted with the master key).
+// - enc: The encryption settings holding the master key and age identities.
+//
+// Returns:
+// - io.ReadCloser: The decoding reader. Closing it does not close r.
+// - error: An error if the stored stream cannot be decoded.
+func newArtifactReader(r io.Reader, name string, meta *artifactMeta, enc Encryption) (io.ReadCloser, error) {
+	if isAgeName(name) {
+		if len(enc.AgeIdentities) == 0 {
+			return nil, fmt.Errorf("%s is age encrypted but no age identity is configured", name)
+		}
+		decrypted, err := age.Decrypt(r, enc.AgeIdentities...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		r = decrypted
+		name = strings.TrimSuffix(name, ".age")
+	} else if isEncryptedName(name) {
+		if meta == nil || meta.Encryption == nil {
+			return nil, fmt.Errorf("missing encryption metadata for %s", name)
+		}
+		decrypted, err := enc.NewReader(r, meta.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		r = decrypted
+		name = strings.TrimSuffix(name, ".enc")
+	}
+	return newDecompressReader(r, name)
+}
+
+// decryptFile decrypts a local backup file encrypted with the master key or to age recipients.
+// The output keeps the compression of the input. Files encrypted with the master key need their
+// metadata file next to them.
+//
+// Parameters:
+// - enc: The encryption settings holding the master key and age identities.
+// - input: The path of the encrypted file.
+// - output: The path of the decrypted file.
+//
+// Returns:
+// - error: An error if the file cannot be decrypted, otherwise nil.
+func decryptFile(enc Encryption, input, output string) error {
+	name := filepath.Base(input)
+	if !isAgeName(name) && !isEncryptedName(name) {
+		return fmt.Errorf("%s is not encrypted (expected a .age or .enc extension)", input)
+	}
+
+	local := &fsStorage{root: filepath.Dir(input)}
+	var meta *artifactMeta
+	if isEncryptedName(name) {
+		var err error
+		meta, err = readArtifactMeta(context.Background(), local, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", input, err)
+	}
+	defer file.Close()
+
+	var decrypted io.Reader
+	if isAgeName(name) {
+		if len(enc.AgeIdentities) == 0 {
+			return fmt.Errorf("%s is age encrypted but no age identity is configured", input)
+		}
+		decrypted, err = age.Decrypt(file, enc.AgeIdentities...)
+	} else {
+		decrypted, err = enc.NewReader(file, meta.Encryption)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", input, err)
+	}
+
+	if err := writeFileAtomic(output, decrypted); err != nil {
+		return fmt.Errorf("failed to write %s: %w", output, err)
+	}
+	return nil
+}
@@ -1,133 +1,312 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 )
 
 // MysqlBackup performs a MySQL backup operation.
 // It supports both full backups of all databases and backups of specific databases.
+// The dump is streamed straight into the storage backend; a local copy is only kept when backupDir is set.
+// Every run stores a manifest describing the backup set next to the dumps, even when some dumps fail.
+// Once ctx is cancelled, no further dump is started and a running dump is given the shutdown timeout to finish
+// before mysqldump is killed; the manifest of an interrupted run is stored with the status aborted.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - dbConn: The database connection object.
 // - allDBFull: A boolean indicating whether to back up all databases.
 // - database: The name of a single database to back up (if specified).
 // - databases: A list of database names to back up (if specified).
-// - backupDir: The directory where the backup files will be stored.
+// - backupDir: The directory where a local copy of the backup files and the binlog position are kept (optional).
 //
 // Returns:
 // - error: An error if the backup or upload process fails, otherwise nil.
-func (db *DB) MysqlBackup(dbConn *sql.DB, allDBFull bool, database string, databases []string, backupDir string) error {
-	log.Print("mysql full backup function started..!")
+func (db *DB) MysqlBackup(ctx context.Context, dbConn *sql.DB, allDBFull bool, database string, databases []string, backupDir string) error {
+	db.logf("mysql full backup function started..!")
 
-	binlogMetadataFile := fmt.Sprintf("%s/binlog_position.txt", backupDir)
+	if !allDBFull && databases == nil {
+		if database == "" {
+			return fmt.Errorf("no database specified for backup")
+		}
+		databases = []string{database}
+	}
+	if !allDBFull {
+		if err := validateDatabaseNames(databases); err != nil {
+			return err
+		}
+	}
+
+	// In the daemon, the number of dumps running at once across all targets is capped.
+	release, err := db.dumps.acquire(ctx, db.Name)
+	if err != nil {
+		return fmt.Errorf("full backup not started: %w", err)
+	}
+	defer release()
+
+	dumpCtx, cancel := graceContext(ctx, db.shutdownTimeout())
+	defer cancel()
+
+	// mysqldump writes the binlog coordinates of its snapshot to the dump, coordinates read once the dumps are
+	// taken would skip the transactions committed while they ran.
+	var sourceData []string
+	if enabled, err := binlogEnabled(dbConn); err != nil {
+		db.logf("error checking binary logging, the backup records no binlog position: %v", err)
+	} else if enabled {
+		sourceData = []string{sourceDataOption(ctx)}
+	}
 
+	manifest := newBackupManifest(db, time.Now(), allDBFull, databases)
+	var backupErr error
 	if allDBFull {
-		backupFileName := fmt.Sprintf("%s_all_databases_full_backup.sql", time.Now().Format("20060102_150405"))
-		backupFile := fmt.Sprintf("%s/%s", backupDir, backupFileName)
-		if err := backupAllDatabases(db, backupFile); err != nil {
-			return fmt.Errorf("failed to backup all databases: %w", err)
-		}
-		saveCurrentBinlogPosition(dbConn, binlogMetadataFile)
-		if err := uploadBackupToS3(backupFile, backupFileName); err != nil {
-			return fmt.Errorf("failed to upload backup to S3: %w", err)
+		backupFileName := fmt.Sprintf("%s_all_databases_full_backup.sql", manifest.ID)
+		file, err := backupAllDatabases(dumpCtx, db, backupDir, backupFileName, sourceData)
+		manifest.Files = append(manifest.Files, file)
+		if err != nil {
+			backupErr = fmt.Errorf("failed to backup all databases: %w", err)
+		} else {
+			db.logf("backup all databases completed..!")
 		}
-		log.Print("backup all databases completed..!")
 	} else {
-		if databases != nil {
-			for _, database := range databases {
-				backupFileName := fmt.Sprintf("%s_%s_full_backup.sql", time.Now().Format("20060102_150405"), database)
-				backupFile := fmt.Sprintf("%s/%s", backupDir, backupFileName)
-				if err := singleDbBackup(db, database, backupFile, dbConn, backupFileName); err != nil {
-					log.Printf("Failed to backup database %s: %v", database, err)
-				}
+		for _, database := range databases {
+			backupFileName := fmt.Sprintf("%s_%s_full_backup.sql", manifest.ID, database)
+			if ctx.Err() != nil {
+				manifest.Files = append(manifest.Files, ManifestFile{Database: database, Name: db.artifactName(backupFileName), Error: "not started, backup aborted"})
+				continue
 			}
-		} else if database != "" {
-			backupFileName := fmt.Sprintf("%s_%s_full_backup.sql", time.Now().Format("20060102_150405"), database)
-			backupFile := fmt.Sprintf("%s/%s", backupDir, backupFileName)
-			if err := singleDbBackup(db, database, backupFile, dbConn, backupFileName); err != nil {
-				log.Printf("Failed to backup database %s: %v", database, err)
+			file, err := singleDbBackup(dumpCtx, db, database, dbConn, backupDir, backupFileName, sourceData)
+			manifest.Files = append(manifest.Files, file)
+			if err != nil {
+				db.logf("Failed to backup database %s: %v", database, err)
 			}
-		} else {
-			return fmt.Errorf("no database specified for backup")
 		}
 	}
-	log.Print("mysql full backup function finished..!")
+
+	manifest.finish(dbConn)
+	if sourceData != nil && manifest.Binlog == nil && manifest.Status != manifestStatusFailed {
+		db.logf("no binlog position found in the dumps, backup set %s cannot be used for point-in-time recovery", manifest.ID)
+	}
+	if ctx.Err() != nil && manifest.Status != manifestStatusCompleted {
+		manifest.Status = manifestStatusAborted
+		if backupErr == nil {
+			backupErr = fmt.Errorf("backup aborted by shutdown")
+		}
+	}
+	if err := db.saveManifest(manifest, backupDir); err != nil {
+		if backupErr == nil {
+			backupErr = err
+		}
+		db.logf("failed to store backup manifest: %v", err)
+	}
+	if backupErr != nil {
+		return backupErr
+	}
+
+	if allDBFull && backupDir != "" {
+		saveCurrentBinlogPosition(manifest.Binlog, fmt.Sprintf("%s/binlog_position.txt", backupDir))
+	}
+	db.logf("mysql full backup function finished..!")
+	return nil
+}
+
+// saveManifest stores the manifest of a backup set in the storage backend and, when backupDir is set, in the local directory.
+//
+// Parameters:
+// - manifest: The completed manifest of the backup set.
+// - backupDir: The directory where a local copy of the backup files is kept (optional).
+//
+// Returns:
+// - error: An error if the manifest cannot be uploaded, otherwise nil.
+func (db *DB) saveManifest(manifest *BackupManifest, backupDir string) error {
+	key, err := getS3Key(manifest.fileName())
+	if err != nil {
+		return fmt.Errorf("failed to get storage key for manifest: %w", err)
+	}
+	if err := manifest.save(context.Background(), db.Storage, key); err != nil {
+		return err
+	}
+	if backupDir != "" {
+		if err := manifest.save(context.Background(), &fsStorage{root: backupDir}, manifest.fileName()); err != nil {
+			db.logf("failed to write local backup manifest: %v", err)
+		}
+	}
+	db.logf("backup manifest stored: %s (status: %s)", key, manifest.Status)
 	return nil
 }
 
 // backupAllDatabases performs a full backup of all databases.
 //
 // Parameters:
+// - ctx: The context for the dump, mysqldump is killed once it is cancelled.
 // - db: The database configuration object.
-// - backupFile: The path to the file where the backup will be stored.
+// - backupDir: The directory where a local copy of the backup is kept (optional).
+// - backupFileName: The name of the backup file.
+// - sourceData: The option recording the binlog coordinates of the snapshot, empty without binary logging.
 //
 // Returns:
+// - ManifestFile: The manifest entry describing the stored backup file.
 // - error: An error if the backup process fails, otherwise nil.
-func backupAllDatabases(db *DB, backupFile string) error {
-	commandStr := fmt.Sprintf("mysqldump --host %s --port %d --user %s --password=%s --all-databases --flush-logs --single-transaction > %s", db.Host, db.Port, db.User, db.Password, backupFile)
-	command := exec.Command("sh", "-c", commandStr)
-	output, err := command.CombinedOutput()
+func backupAllDatabases(ctx context.Context, db *DB, backupDir string, backupFileName string, sourceData []string) (ManifestFile, error) {
+	args := append([]string{"--all-databases", "--flush-logs", "--single-transaction"}, sourceData...)
+	file, err := streamDump(ctx, db, args, "all databases", backupDir, backupFileName)
 	if err != nil {
-		backupError(err, "all databases", output)
-		return err
+		return file, err
 	}
-	log.Print("backup all databases completed..!")
-	return nil
+	db.logf("backup all databases completed..!")
+	return file, nil
 }
 
-// singleDbBackup performs a backup of a single database.
+// singleDbBackup performs a backup of a single database, from a consistent snapshot like the backup of all databases.
 //
 // Parameters:
+// - ctx: The context for the dump, mysqldump is killed once it is cancelled.
 // - db: The database configuration object.
 // - database: The name of the database to back up.
-// - backupFile: The path to the file where the backup will be stored.
 // - dbConn: The database connection object.
+// - backupDir: The directory where a local copy of the backup is kept (optional).
 // - backupFileName: The name of the backup file.
+// - sourceData: The option recording the binlog coordinates of the snapshot, empty without binary logging.
 //
 // Returns:
+// - ManifestFile: The manifest entry describing the stored backup file.
 // - error: An error if the backup or upload process fails, otherwise nil.
-func singleDbBackup(db *DB, database string, backupFile string, dbConn *sql.DB, backupFileName string) error {
+func singleDbBackup(ctx context.Context, db *DB, database string, dbConn *sql.DB, backupDir string, backupFileName string, sourceData []string) (ManifestFile, error) {
 	ok, err := databaseExists(dbConn, database)
 	if !ok {
-		return fmt.Errorf("database %s does not exist: %v", database, err)
+		err = fmt.Errorf("database %s does not exist: %v", database, err)
+		return ManifestFile{Database: database, Name: db.artifactName(backupFileName), Error: err.Error()}, err
 	}
 
-	commandStr := fmt.Sprintf("mysqldump --host %s --port %d --user %s --password=%s --databases %s > %s", db.Host, db.Port, db.User, db.Password, database, backupFile)
-	command := exec.Command("sh", "-c", commandStr)
-	output, err := command.CombinedOutput()
+	args := append(append([]string{"--single-transaction"}, sourceData...), "--databases", database)
+	file, err := streamDump(ctx, db, args, database, backupDir, backupFileName)
+	file.Database = database
 	if err != nil {
-		backupError(err, database, output)
-		return err
+		return file, err
 	}
 
-	if err := uploadBackupToS3(backupFile, backupFileName); err != nil {
-		return fmt.Errorf("failed to upload backup to S3: %w", err)
-	}
-
-	log.Printf("backup %s completed..!", database)
-	return nil
+	db.logf("backup %s completed..!", database)
+	return file, nil
 }
 
-// uploadBackupToS3 uploads a backup file to an S3 bucket.
+// streamDump runs mysqldump and streams its output into the storage backend.
+// The output is compressed and encrypted on the fly with the configured codecs. Memory use is bounded by the storage backend's upload buffers, not by the size of the dump.
+// When backupDir is set, the dump is also written to a local file as it streams.
+// The binlog coordinates written by mysqldump to the dump header are recorded with the file.
 //
 // Parameters:
-// - backupFile: The path to the backup file.
-// - backupFileName: The name of the backup file to be used as the S3 key.
+// - ctx: The context for the dump, mysqldump is killed and the upload aborted once it is cancelled.
+// - db: The database configuration object.
+// - dumpArgs: The mysqldump arguments selecting what to dump.
+// - label: A description of what is being dumped, used in log messages.
+// - backupDir: The directory where a local copy of the backup is kept (optional).
+// - backupFileName: The name of the backup file.
 //
 // Returns:
-// - error: An error if the upload process fails, otherwise nil.
-func uploadBackupToS3(backupFile, backupFileName string) error {
-	data, err := os.ReadFile(backupFile)
+// - ManifestFile: The manifest entry describing the stored backup file, with Error set on failure.
+// - error: An error if mysqldump or the upload fails, otherwise nil.
+func streamDump(ctx context.Context, db *DB, dumpArgs []string, label string, backupDir string, backupFileName string) (file ManifestFile, err error) {
+	storedName := db.artifactName(backupFileName)
+	file = ManifestFile{Name: storedName, DumpOptions: dumpArgs}
+	defer func() {
+		if err != nil {
+			// The manifest is stored with the backups, it must not carry a secret echoed by mysqldump.
+			err = redactError(err)
+			file.Error = err.Error()
+		}
+	}()
+
+	key, err := getS3Key(storedName)
 	if err != nil {
-		return fmt.Errorf("error reading backup file: %w", err)
+		return file, fmt.Errorf("failed to get storage key for file %s: %w", storedName, err)
 	}
-	UploadBufferToS3(data, backupFileName)
-	return nil
+	file.Key = key
+
+	command, cleanup, err := db.mysqlCommand(ctx, "mysqldump", dumpArgs...)
+	if err != nil {
+		return file, err
+	}
+	defer cleanup()
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return file, fmt.Errorf("failed to open mysqldump output: %w", err)
+	}
+
+	upload := newStorageWriter(ctx, db.Storage, key)
+	checksum := newChecksumWriter()
+	dest := io.MultiWriter(upload, checksum)
+	var localFile *os.File
+	if backupDir != "" {
+		localFile, err = os.Create(filepath.Join(backupDir, storedName))
+		if err != nil {
+			upload.Abort(err)
+			return file, fmt.Errorf("failed to create local backup file: %w", err)
+		}
+		defer localFile.Close()
+		dest = io.MultiWriter(upload, checksum, localFile)
+	}
+
+	encoder, meta, err := db.newArtifactWriter(dest)
+	if err != nil {
+		upload.Abort(err)
+		return file, fmt.Errorf("failed to create backup encoder: %w", err)
+	}
+
+	if err := command.Start(); err != nil {
+		upload.Abort(err)
+		return file, fmt.Errorf("failed to start mysqldump: %w", err)
+	}
+
+	coords := &dumpCoordinatesScanner{}
+	_, copyErr := io.Copy(encoder, io.TeeReader(stdout, coords))
+	if copyErr != nil {
+		// Drain the rest of the output so mysqldump is not blocked on a full pipe.
+		io.Copy(io.Discard, stdout)
+	}
+	if err := command.Wait(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("mysqldump of %s killed at shutdown: %w", label, ctx.Err())
+			db.logf("%v", err)
+		} else {
+			backupError(err, label, stderr.Bytes())
+		}
+		upload.Abort(err)
+		return file, err
+	}
+	if copyErr == nil {
+		copyErr = encoder.Close()
+	}
+	if copyErr != nil {
+		upload.Abort(copyErr)
+		return file, fmt.Errorf("failed to stream backup: %w", copyErr)
+	}
+	if err := upload.Close(); err != nil {
+		return file, fmt.Errorf("failed to upload backup: %w", err)
+	}
+	file.Size = checksum.size
+	file.SHA256 = checksum.Sum()
+	file.Binlog = coords.coordinates()
+
+	if err := writeArtifactMeta(context.Background(), db.Storage, key, meta); err != nil {
+		return file, fmt.Errorf("failed to upload backup metadata: %w", err)
+	}
+	if localFile != nil {
+		if err := writeArtifactMeta(context.Background(), &fsStorage{root: backupDir}, storedName, meta); err != nil {
+			db.logf("failed to write local backup metadata: %v", err)
+		}
+	}
+
+	db.logf("upload successful: %s", key)
+	return file, nil
 }
 
 // databaseExists checks if a database exists in the MySQL server.
@@ -146,21 +325,14 @@ func databaseExists(db *sql.DB, dbName string) (bool, error) {
 	return exists, err
 }
 
-// saveCurrentBinlogPosition saves the current binary log position to a metadata file.
+// saveCurrentBinlogPosition saves the binary log position and executed GTID set to a metadata file.
 //
 // Parameters:
-// - db: The database connection object.
+// - coords: The binary log coordinates recorded in the backup manifest (nothing is saved when nil).
 // - metadataFile: The path to the metadata file where the binlog position will be saved.
-func saveCurrentBinlogPosition(db *sql.DB, metadataFile string) {
-	var binlogFile string
-	var binlogPos uint32
-	var dummy1, dummy2, dummy3 interface{}
-
-	query := "SHOW MASTER STATUS"
-	row := db.QueryRow(query)
-	err := row.Scan(&binlogFile, &binlogPos, &dummy1, &dummy2, &dummy3)
-	if err != nil {
-		log.Printf("error fetching binlog position: %v", err)
+func saveCurrentBinlogPosition(coords *binlogCoordinates, metadataFile string) {
+	if coords == nil {
+		log.Printf("no binlog position to save to %s", metadataFile)
 		return
 	}
 
@@ -171,13 +343,14 @@ func saveCurrentBinlogPosition(db *sql.DB, metadataFile string) {
 	}
 	defer file.Close()
 
-	_, err = file.WriteString(fmt.Sprintf("%s %d\n", binlogFile, binlogPos))
+	// The executed GTID set, when GTIDs are enabled, follows on a second line for GTID mode incremental backups.
+	_, err = file.WriteString(fmt.Sprintf("%s %d\n%s\n", coords.File, coords.Position, coords.GTIDSet))
 	if err != nil {
 		log.Printf("Error writing to metadata file: %v", err)
 		return
 	}
 
-	log.Printf("saved binlog position: %s at %d", binlogFile, binlogPos)
+	log.Printf("saved binlog position: %s at %d (GTID set: %s)", coords.File, coords.Position, coords.GTIDSet)
 }
 
 // backupError logs detailed information about a backup error.
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+const binlogGapSuffix = "_binlog_gap.json" // Suffix of the gap markers stored when the chain of binlog chunks breaks.
+
+// errChainBroken marks a binlog stream that cannot be resumed because the server no longer has the binlogs following
+// the last archived event.
+var errChainBroken = errors.New("binlog chain broken")
+
+// binlogGap records a break in the chain of binlog chunks: the events written between the last archived event and
+// the full backup taken to start a new chain are not in any backup.
+// It is stored as "<timestamp>_binlog_gap.json" next to the full backups of the same week.
+//
+// Fields:
+// - DetectedAt: The time the break was detected.
+// - Reason: Why the chain could not be continued.
+// - LastFile: The binary log file of the last archived event.
+// - LastPosition: The position following the last archived event.
+// - LastGTIDSet: The GTID set executed up to the last archived event, empty if unknown.
+// - LastEventTime: The time of the last archived event, zero if unknown.
+// - LastChunk: The name of the last stored binlog chunk, empty if none.
+// - NewFile: The binary log file the new chain starts from.
+// - NewPosition: The position the new chain starts from.
+// - NewGTIDSet: The GTID set executed at the start of the new chain, empty if unknown.
+type binlogGap struct {
+	DetectedAt    time.Time `json:"detected_at"`
+	Reason        string    `json:"reason"`
+	LastFile      string    `json:"last_file"`
+	LastPosition  uint32    `json:"last_position"`
+	LastGTIDSet   string    `json:"last_gtid_set,omitempty"`
+	LastEventTime time.Time `json:"last_event_time"`
+	LastChunk     string    `json:"last_chunk,omitempty"`
+	NewFile       string    `json:"new_file,omitempty"`
+	NewPosition   uint32    `json:"new_position,omitempty"`
+	NewGTIDSet    string    `json:"new_gtid_set,omitempty"`
+}
+
+// checkChain verifies that the server still has the binlogs following the last rotated backup file: in GTID mode
+// no purged transaction may be missing from the archived GTID set, otherwise the binlog to resume from must still
+// be listed by SHOW BINARY LOGS. MariaDB keeps no purged GTID set; it refuses a GTID it no longer has when the
+// stream starts, which streamFatalError reports as a broken chain.
+//
+// Returns:
+// - error: An error wrapping errChainBroken if the chain cannot be continued, an error wrapping errConnectionLost
+// if the server cannot be queried, otherwise nil.
+func (a *BinlogArchiver) checkChain() error {
+	if a.db.GTIDMode {
+		if a.db.flavor() == mysql.MariaDBFlavor {
+			return nil
+		}
+		purged, err := queryGTIDPurged(a.dbConn)
+		if err != nil {
+			return fmt.Errorf("%w: failed to read purged GTIDs: %v", errConnectionLost, err)
+		}
+		if purged == "" {
+			return nil
+		}
+		purgedSet, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, purged)
+		if err != nil {
+			return fmt.Errorf("failed to parse purged GTID set %q: %w", purged, err)
+		}
+		if !a.archivedGTIDs.Contain(purgedSet) {
+			return fmt.Errorf("%w: the server purged transactions missing from the archived GTID set %s (gtid_purged %s)", errChainBroken, a.archivedGTIDs.String(), purged)
+		}
+		return nil
+	}
+
+	if a.resumePos.Name == "" {
+		return nil
+	}
+	logs, err := queryBinaryLogs(a.dbConn)
+	if err != nil {
+		return fmt.Errorf("%w: failed to list binary logs: %v", errConnectionLost, err)
+	}
+	if len(logs) == 0 || containsString(logs, a.resumePos.Name) {
+		return nil
+	}
+	return fmt.Errorf("%w: binlog %s to resume from is no longer on the server (oldest is %s)", errChainBroken, a.resumePos.Name, logs[0])
+}
+
+// restartChain starts a new chain of binlog chunks after the old one broke. The rotated backup files are stored,
+// a full backup of all databases is taken, the checkpoint of the old chain is removed and a gap marker is stored
+// so the catalog and point-in-time recovery know which events are missing.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - cause: The error that broke the chain.
+//
+// Returns:
+// - error: An error if the full backup fails or the stream cannot be repositioned.
+func (a *BinlogArchiver) restartChain(ctx context.Context, cause error) error {
+	a.db.logf("BINLOG CHAIN BROKEN: %v; taking a full backup of all databases to start a new chain", cause)
+	// The gap starts after the last stored backup file, so every queued file is stored first.
+	if err := a.uploader.close(); err != nil {
+		return err
+	}
+	a.uploader = newBinlogUploader(a.db, a.checkpointFile, a.db.UploadQueueSize)
+
+	gap := binlogGap{
+		DetectedAt:   time.Now().UTC(),
+		Reason:       cause.Error(),
+		LastFile:     a.resumePos.Name,
+		LastPosition: a.resumePos.Pos,
+	}
+	if a.archivedGTIDs != nil {
+		gap.LastGTIDSet = a.archivedGTIDs.String()
+	}
+	if checkpoint, err := loadCheckpoint(a.checkpointFile); err != nil {
+		a.db.logf("error reading checkpoint: %v", err)
+	} else if checkpoint != nil {
+		gap.LastEventTime = checkpoint.LastEventTime
+		gap.LastChunk = checkpoint.LastChunk
+	}
+
+	if err := a.db.MysqlBackup(ctx, a.dbConn, true, "", nil, a.backupDir); err != nil {
+		return fmt.Errorf("full backup to start a new binlog chain failed: %w", err)
+	}
+	if err := os.Remove(a.checkpointFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint of the broken chain: %w", err)
+	}
+
+	pos, gtidSet := getLastBinlogPosition(fmt.Sprintf("%s/binlog_position.txt", a.backupDir))
+	gap.NewFile, gap.NewPosition, gap.NewGTIDSet = pos.Name, pos.Pos, gtidSet
+	if err := a.resetPosition(pos, gtidSet); err != nil {
+		return err
+	}
+	if err := saveBinlogGap(ctx, a.db.Storage, gap); err != nil {
+		a.db.logf("failed to store binlog gap marker: %v", err)
+	}
+
+	a.mu.Lock()
+	a.status.ChainBreaks++
+	a.mu.Unlock()
+	a.db.logf("new binlog chain starts at %s:%d, events from %s:%d up to it are not archived", pos.Name, pos.Pos, gap.LastFile, gap.LastPosition)
+	return nil
+}
+
+// resetPosition moves the stream to a new start position, dropping the state of the current binlog.
+//
+// Parameters:
+// - pos: The binlog position to resume from.
+// - gtidSet: The executed GTID set to resume from, empty if unknown.
+//
+// Returns:
+// - error: An error if the GTID set cannot be parsed.
+func (a *BinlogArchiver) resetPosition(pos mysql.Position, gtidSet string) error {
+	a.archivedGTIDs = nil
+	if gtidSet != "" {
+		var err error
+		a.archivedGTIDs, err = mysql.ParseGTIDSet(a.db.flavor(), gtidSet)
+		if err != nil {
+			return fmt.Errorf("failed to parse executed GTID set %q: %w", gtidSet, err)
+		}
+	}
+	if a.db.GTIDMode && a.archivedGTIDs == nil {
+		return fmt.Errorf("GTID mode requires an executed GTID set, take a full backup of all databases first")
+	}
+	a.resumePos = pos
+	a.streamPos = pos
+	if pos.Name != "" {
+		a.currentBinlog = pos.Name
+	}
+	a.previousGTIDs = nil
+	return nil
+}
+
+// saveBinlogGap stores a gap marker.
+//
+// Parameters:
+// - ctx: The context for managing the upload.
+// - st: The storage receiving the marker.
+// - gap: The break in the chain of binlog chunks.
+//
+// Returns:
+// - error: An error if the marker cannot be encoded or stored.
+func saveBinlogGap(ctx context.Context, st Storage, gap binlogGap) error {
+	key, err := getS3Key(gap.DetectedAt.Local().Format("20060102_150405") + binlogGapSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to get storage key for gap marker: %w", err)
+	}
+	data, err := json.MarshalIndent(gap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode gap marker: %w", err)
+	}
+	if err := st.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to store gap marker %s: %w", key, err)
+	}
+	log.Printf("binlog gap marker stored: %s", key)
+	return nil
+}
+
+// readBinlogGap loads a gap marker from the storage.
+//
+// Parameters:
+// - ctx: The context for managing the download.
+// - st: The storage holding the marker.
+// - key: The storage key of the marker.
+//
+// Returns:
+// - binlogGap: The decoded marker.
+// - error: An error if the marker cannot be read or decoded.
+func readBinlogGap(ctx context.Context, st Storage, key string) (binlogGap, error) {
+	var gap binlogGap
+	reader, err := st.Get(ctx, key)
+	if err != nil {
+		return gap, fmt.Errorf("failed to read gap marker %s: %w", key, err)
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(&gap); err != nil {
+		return gap, fmt.Errorf("failed to decode gap marker %s: %w", key, err)
+	}
+	return gap, nil
+}
+
+// isBinlogGapName reports whether a stored file is a binlog gap marker.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - bool: True if the file is a gap marker, otherwise false.
+func isBinlogGapName(name string) bool {
+	return strings.HasSuffix(name, binlogGapSuffix)
+}
+
+// queryBinaryLogs lists the binary log files still present on the server.
+// Only the first column is read, as the other columns differ between server versions.
+//
+// Parameters:
+// - dbConn: The database connection object.
+//
+// Returns:
+// - []string: The binary log file names, oldest first.
+// - error: An error if the query fails.
+func queryBinaryLogs(dbConn *sql.DB) ([]string, error) {
+	rows, err := dbConn.Query("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var logs []string
+	for rows.Next() {
+		values := make([]any, len(columns))
+		var name string
+		values[0] = &name
+		for i := 1; i < len(values); i++ {
+			values[i] = new(sql.RawBytes)
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		logs = append(logs, name)
+	}
+	return logs, rows.Err()
+}
+
+// queryGTIDPurged reads the GTIDs of the transactions purged from the binary logs of the server.
+//
+// Parameters:
+// - dbConn: The database connection object.
+//
+// Returns:
+// - string: The purged GTID set, empty if none.
+// - error: An error if the query fails.
+func queryGTIDPurged(dbConn *sql.DB) (string, error) {
+	var purged sql.NullString
+	if err := dbConn.QueryRow("SELECT @@GLOBAL.gtid_purged").Scan(&purged); err != nil {
+		return "", err
+	}
+	// Sets of several server UUIDs are returned with a newline after each comma.
+	return strings.ReplaceAll(purged.String, "\n", ""), nil
+}
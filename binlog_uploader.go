@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUploadQueueSize = 4               // Default number of finished binlog chunks waiting to be stored.
+	uploadAttempts         = 3               // Number of attempts to store a binlog chunk before the incremental backup fails.
+	uploadRetryDelay       = 5 * time.Second // Delay before the first retry, doubled after each failed attempt.
+)
+
+// chunkUpload is a finished binlog chunk waiting to be stored.
+//
+// Fields:
+// - path: The path of the local backup file.
+// - name: The name of the backup file.
+// - gtidSet: The GTIDs of the transactions held by the chunk, empty if unknown.
+// - checkpoint: The checkpoint written once the chunk is stored.
+// - live: The upload of the chunk started while it was written, nil to upload the local file.
+type chunkUpload struct {
+	path       string
+	name       string
+	gtidSet    string
+	checkpoint *binlogCheckpoint
+	live       *liveChunk
+}
+
+// binlogUploader stores finished binlog chunks in order, in the background, and advances the checkpoint
+// after each stored chunk. Its queue is bounded, so a slow storage backend holds up the binlog stream
+// instead of letting unstored chunks pile up.
+//
+// Fields:
+// - db: The database configuration object holding the storage backend and codecs.
+// - checkpointFile: The path of the checkpoint file.
+// - queue: The finished chunks waiting to be stored.
+// - done: Closed once every queued chunk was handled.
+// - mu: Guards err.
+// - err: The first error, after which no further chunk is stored.
+type binlogUploader struct {
+	db             *DB
+	checkpointFile string
+	queue          chan chunkUpload
+	done           chan struct{}
+	mu             sync.Mutex
+	err            error
+}
+
+// newBinlogUploader creates a binlogUploader and starts its worker.
+//
+// Parameters:
+// - db: The database configuration object holding the storage backend and codecs.
+// - checkpointFile: The path of the checkpoint file.
+// - queueSize: The number of finished chunks that may wait to be stored.
+//
+// Returns:
+// - *binlogUploader: The running uploader.
+func newBinlogUploader(db *DB, checkpointFile string, queueSize int) *binlogUploader {
+	if queueSize <= 0 {
+		queueSize = defaultUploadQueueSize
+	}
+	u := &binlogUploader{
+		db:             db,
+		checkpointFile: checkpointFile,
+		queue:          make(chan chunkUpload, queueSize),
+		done:           make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+// enqueue hands a finished chunk to the uploader, waiting while the queue is full.
+//
+// Parameters:
+// - job: The chunk to store.
+//
+// Returns:
+// - error: The error that stopped the uploader, if a previous chunk could not be stored.
+func (u *binlogUploader) enqueue(job chunkUpload) error {
+	if err := u.failed(); err != nil {
+		job.discard(err)
+		return err
+	}
+	select {
+	case u.queue <- job:
+	default:
+		u.db.logf("upload queue full, waiting for storage before continuing the binlog stream")
+		u.queue <- job
+	}
+	return nil
+}
+
+// close waits until every queued chunk was handled.
+//
+// Returns:
+// - error: The error that stopped the uploader, if a chunk could not be stored.
+func (u *binlogUploader) close() error {
+	close(u.queue)
+	<-u.done
+	return u.failed()
+}
+
+// run stores the queued chunks one at a time, so checkpoints are written in stream order.
+// The local file of a chunk is removed once it is stored.
+func (u *binlogUploader) run() {
+	defer close(u.done)
+	for job := range u.queue {
+		if err := u.failed(); err != nil {
+			job.discard(err)
+			continue
+		}
+		if err := u.store(job); err != nil {
+			u.fail(fmt.Errorf("failed to store binlog chunk %s: %w", job.name, err))
+			continue
+		}
+		if err := os.Remove(job.path); err != nil {
+			u.db.logf("failed to remove stored binlog chunk %s: %v", job.path, err)
+		}
+		if err := job.checkpoint.save(u.checkpointFile); err != nil {
+			u.fail(err)
+			continue
+		}
+		u.db.logf("checkpoint saved after %s: %s at %d", job.name, job.checkpoint.BinlogFile, job.checkpoint.Position)
+	}
+}
+
+// store stores a chunk, retrying uploads of the local file with an increasing delay.
+// A live upload that cannot be completed is replaced by uploads of the local file, which holds the whole chunk.
+//
+// Parameters:
+// - job: The chunk to store.
+//
+// Returns:
+// - error: An error if the chunk could not be stored.
+func (u *binlogUploader) store(job chunkUpload) error {
+	if job.live != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := job.live.finish(ctx, u.db.Storage, job.gtidSet)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		u.db.logf("live upload of %s failed, storing the local file instead: %v", job.name, err)
+	}
+
+	delay := uploadRetryDelay
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		if err = uploadChunkFile(u.db, job.path, job.name, job.gtidSet); err == nil {
+			return nil
+		}
+		if attempt < uploadAttempts {
+			u.db.logf("storing %s failed (attempt %d of %d), retrying in %s: %v", job.name, attempt, uploadAttempts, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// failed returns the error that stopped the uploader, nil while it is running.
+func (u *binlogUploader) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// fail records the error that stops the uploader, keeping the first one.
+func (u *binlogUploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.db.logf("binlog uploader stopped: %v", err)
+		u.err = err
+	}
+}
+
+// discard drops a chunk that will not be stored, aborting its live upload.
+// The events of the chunk are streamed again from the checkpoint on restart.
+//
+// Parameters:
+// - err: The reason the chunk is dropped.
+func (job chunkUpload) discard(err error) {
+	if job.live != nil {
+		job.live.abort(err)
+	}
+}
+
+// uploadChunkFile stores a local binlog chunk, encoded with the configured codecs.
+//
+// Parameters:
+// - db: The database configuration object holding the storage backend and codecs.
+// - filePath: The path of the local backup file.
+// - fileName: The name of the backup file, used to generate the storage key.
+// - gtidSet: The GTIDs of the transactions held by the chunk, recorded in its metadata (empty if unknown).
+//
+// Returns:
+// - error: An error if the file cannot be read or the upload fails, otherwise nil.
+func uploadChunkFile(db *DB, filePath, fileName, gtidSet string) error {
+	storedName := db.artifactName(fileName)
+	key, err := getS3Key(storedName)
+	if err != nil {
+		return fmt.Errorf("failed to get storage key for file %s: %w", storedName, err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if err := putArtifact(ctx, db, key, file, gtidSet); err != nil {
+		return err
+	}
+	db.logf("Upload successful: %s", key)
+	return nil
+}
+
+// liveChunk uploads a binlog chunk while it is being written, instead of reading its local file once it is rotated.
+//
+// Fields:
+// - key: The storage key of the chunk.
+// - upload: The upload receiving the encoded chunk.
+// - encoder: The writer compressing and encrypting the chunk into the upload.
+// - meta: The metadata of the encoded chunk.
+type liveChunk struct {
+	key     string
+	upload  *storageWriter
+	encoder io.WriteCloser
+	meta    *artifactMeta
+}
+
+// startLiveChunk starts the upload of a new binlog chunk.
+//
+// Parameters:
+// - db: The database configuration object holding the storage backend and codecs.
+// - fileName: The name of the backup file, used to generate the storage key.
+//
+// Returns:
+// - *liveChunk: The running upload.
+// - error: An error if the upload cannot be started.
+func startLiveChunk(db *DB, fileName string) (*liveChunk, error) {
+	storedName := db.artifactName(fileName)
+	key, err := getS3Key(storedName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage key for file %s: %w", storedName, err)
+	}
+
+	upload := newStorageWriter(context.Background(), db.Storage, key)
+	encoder, meta, err := db.newArtifactWriter(upload)
+	if err != nil {
+		upload.Abort(err)
+		return nil, err
+	}
+	return &liveChunk{key: key, upload: upload, encoder: encoder, meta: meta}, nil
+}
+
+// Write sends p to the upload. It blocks while the storage backend catches up.
+func (l *liveChunk) Write(p []byte) (int, error) {
+	return l.encoder.Write(p)
+}
+
+// finish completes the upload and stores the metadata of the chunk.
+// On failure the upload is aborted, or has already ended, so the chunk can be stored from the local file instead.
+//
+// Parameters:
+// - ctx: The context for managing the metadata upload.
+// - st: The storage receiving the chunk.
+// - gtidSet: The GTIDs of the transactions held by the chunk, recorded in its metadata (empty if unknown).
+//
+// Returns:
+// - error: An error if the upload cannot be completed.
+func (l *liveChunk) finish(ctx context.Context, st Storage, gtidSet string) error {
+	if err := l.encoder.Close(); err != nil {
+		l.upload.Abort(err)
+		return err
+	}
+	if err := l.upload.Close(); err != nil {
+		return err
+	}
+	if err := writeArtifactMeta(ctx, st, l.key, withGTIDSet(l.meta, gtidSet)); err != nil {
+		return err
+	}
+	log.Printf("Upload successful: %s", l.key)
+	return nil
+}
+
+// abort cancels the upload so that no partial chunk is left behind.
+//
+// Parameters:
+// - err: The reason the upload is aborted.
+func (l *liveChunk) abort(err error) {
+	l.upload.Abort(err)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	backupTypeAll    = "all-databases" // The set holds a dump of all databases.
+	backupTypeSingle = "single"        // The set holds a dump of a single database.
+	backupTypeMulti  = "multi"         // The set holds one dump per database of a list.
+)
+
+// BackupSet is an entry of the backup catalog, built from the manifest of a backup set.
+//
+// Fields:
+// - ID: The timestamp shared by the names of every file of the set.
+// - Type: The kind of backup, one of all-databases, single or multi.
+// - Databases: The databases included in the set (empty for all databases).
+// - Status: The outcome of the backup run, one of completed, partial, failed or aborted.
+// - StartTime: The time the backup run started.
+// - EndTime: The time the backup run finished.
+// - Size: The total size of the stored files in bytes.
+// - Files: The number of backup files in the set.
+// - ServerVersion: The version reported by the MySQL server.
+// - Binlog: The binary log coordinates of the server once the dumps were taken.
+// - Coverage: The binlog chunks stored after the set, nil when there are none.
+// - Gaps: The breaks in the chain of binlog chunks following the set, after which its coverage is incomplete.
+// - Dir: The storage directory holding the set, to be used as backup-s3-dir when restoring.
+// - ManifestKey: The storage key of the manifest.
+type BackupSet struct {
+	ID            string             `json:"id"`
+	Type          string             `json:"type"`
+	Databases     []string           `json:"databases,omitempty"`
+	Status        string             `json:"status"`
+	StartTime     time.Time          `json:"start_time"`
+	EndTime       time.Time          `json:"end_time"`
+	Size          int64              `json:"size"`
+	Files         int                `json:"files"`
+	ServerVersion string             `json:"server_version,omitempty"`
+	Binlog        *binlogCoordinates `json:"binlog,omitempty"`
+	Coverage      *binlogCoverage    `json:"binlog_coverage,omitempty"`
+	Gaps          []binlogGap        `json:"binlog_gaps,omitempty"`
+	Dir           string             `json:"dir"`
+	ManifestKey   string             `json:"manifest_key"`
+}
+
+// binlogCoverage describes the window of binary log events stored as incremental backup chunks.
+//
+// Fields:
+// - FirstFile: The binary log file of the first chunk.
+// - LastFile: The binary log file of the last chunk.
+// - From: The time the first chunk was started.
+// - To: The time the last chunk was stored.
+// - Chunks: The number of chunks in the window.
+type binlogCoverage struct {
+	FirstFile string    `json:"first_file"`
+	LastFile  string    `json:"last_file"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Chunks    int       `json:"chunks"`
+}
+
+// binlogChunk is an incremental backup chunk found in the storage.
+//
+// Fields:
+// - Key: The storage key of the chunk.
+// - BinlogFile: The binary log file the chunk was cut from.
+// - Index: The sequence number of the chunk within the incremental backup run.
+// - Started: The time the chunk was started, taken from its name.
+// - Stored: The time the chunk was stored.
+type binlogChunk struct {
+	Key        string
+	BinlogFile string
+	Index      int
+	Started    time.Time
+	Stored     time.Time
+}
+
+// catalogFilter selects the backup sets listed by the catalog.
+//
+// Fields:
+// - Database: Only list sets including this database (sets of all databases always match).
+// - Since: Only list sets started at or after this time (zero for no bound).
+// - Until: Only list sets started at or before this time (zero for no bound).
+type catalogFilter struct {
+	Database string
+	Since    time.Time
+	Until    time.Time
+}
+
+// loadBackupCatalog enumerates the backup sets held by the storage from their manifests.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - st: The storage holding the backups.
+// - prefix: The storage directory (prefix) to search, empty for the whole storage.
+//
+// Returns:
+// - []BackupSet: The backup sets, oldest first.
+// - error: An error if the storage cannot be listed or a manifest cannot be read.
+func loadBackupCatalog(ctx context.Context, st Storage, prefix string) ([]BackupSet, error) {
+	sets, _, err := scanCatalog(ctx, st, prefix)
+	return sets, err
+}
+
+// scanCatalog enumerates the backup sets and binlog chunks held by the storage.
+// Binlog gap markers are attached to the set whose chain of chunks they break.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - st: The storage holding the backups.
+// - prefix: The storage directory (prefix) to search, empty for the whole storage.
+//
+// Returns:
+// - []BackupSet: The backup sets, oldest first.
+// - []binlogChunk: The binlog chunks, ordered by start time and index.
+// - error: An error if the storage cannot be listed or a manifest cannot be read.
+func scanCatalog(ctx context.Context, st Storage, prefix string) ([]BackupSet, []binlogChunk, error) {
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var sets []BackupSet
+	var chunks []binlogChunk
+	var gaps []binlogGap
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if isTempFile(name) || isArtifactMeta(name) {
+			continue
+		}
+		if chunk, ok := parseChunkName(name); ok {
+			chunk.Key = object.Key
+			chunk.Stored = object.LastModified
+			chunks = append(chunks, chunk)
+			continue
+		}
+		if isBinlogGapName(name) {
+			gap, err := readBinlogGap(ctx, st, object.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			gaps = append(gaps, gap)
+			continue
+		}
+		if !isManifestName(name) {
+			continue
+		}
+		manifest, err := readManifest(ctx, st, object.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		sets = append(sets, newBackupSet(manifest, object.Key))
+	}
+
+	sort.Slice(sets, func(i, j int) bool { return sets[i].StartTime.Before(sets[j].StartTime) })
+	sortChunks(chunks)
+
+	// The incremental backup restarts with every full backup of all databases, so a set is
+	// covered by the chunks following its binlog coordinates and started before the next full backup of all databases.
+	for i := range sets {
+		var next time.Time
+		for _, later := range sets[i+1:] {
+			if later.Type == backupTypeAll && later.Status != manifestStatusFailed && later.Status != manifestStatusAborted {
+				next = later.StartTime
+				break
+			}
+		}
+		sets[i].Coverage = coverageBetween(chunksAfter(chunks, sets[i].Binlog, sets[i].StartTime), next)
+		for _, gap := range gaps {
+			if !gap.DetectedAt.Before(sets[i].StartTime) && (next.IsZero() || gap.DetectedAt.Before(next)) {
+				sets[i].Gaps = append(sets[i].Gaps, gap)
+			}
+		}
+	}
+	return sets, chunks, nil
+}
+
+// newBackupSet builds a catalog entry from a manifest.
+//
+// Parameters:
+// - manifest: The manifest of the backup set.
+// - key: The storage key of the manifest.
+//
+// Returns:
+// - BackupSet: The catalog entry.
+func newBackupSet(manifest *BackupManifest, key string) BackupSet {
+	set := BackupSet{
+		ID:            manifest.ID,
+		Databases:     manifest.Databases,
+		Status:        manifest.Status,
+		StartTime:     manifest.StartTime,
+		EndTime:       manifest.EndTime,
+		Files:         len(manifest.Files),
+		ServerVersion: manifest.ServerVersion,
+		Binlog:        manifest.Binlog,
+		Dir:           path.Dir(key),
+		ManifestKey:   key,
+	}
+	switch {
+	case manifest.AllDatabases:
+		set.Type = backupTypeAll
+	case len(manifest.Databases) == 1:
+		set.Type = backupTypeSingle
+	default:
+		set.Type = backupTypeMulti
+	}
+	for _, file := range manifest.Files {
+		set.Size += file.Size
+	}
+	return set
+}
+
+// chunksAfter selects the chunks holding the binlog events following a backup: the chunks of later binlog files
+// than its coordinates, and those of the same binlog file from the last one started before the backup, which spans
+// the snapshot. Events of the selected chunks already contained in the backup are skipped when replaying.
+// Without coordinates, the chunks started after the backup are selected. Chunk names only record the start time to
+// the second, so the time of the backup is compared at the same precision.
+//
+// Parameters:
+// - chunks: The chunks found in the storage, in order.
+// - coords: The binlog coordinates of the backup, nil if unknown.
+// - start: The time the backup started.
+//
+// Returns:
+// - []binlogChunk: The chunks following the backup, in order.
+func chunksAfter(chunks []binlogChunk, coords *binlogCoordinates, start time.Time) []binlogChunk {
+	start = start.Truncate(time.Second)
+	var after []binlogChunk
+	spanning := -1
+	for i, chunk := range chunks {
+		if coords == nil || coords.File == "" {
+			if !chunk.Started.Before(start) {
+				after = append(after, chunk)
+			}
+			continue
+		}
+		switch order := compareBinlogPosition(chunk.BinlogFile, 0, coords.File, 0); {
+		case order > 0 || (order == 0 && !chunk.Started.Before(start)):
+			after = append(after, chunk)
+		case order == 0:
+			spanning = i
+		}
+	}
+	if spanning >= 0 {
+		after = append([]binlogChunk{chunks[spanning]}, after...)
+	}
+	return after
+}
+
+// coverageBetween summarises the chunks of a backup chain started before its end.
+//
+// Parameters:
+// - chunks: The chunks following the backup, in order.
+// - to: The start of the next chain (zero for no bound), compared at the second precision of the chunk names.
+//
+// Returns:
+// - *binlogCoverage: The coverage of the chain, nil when no chunk belongs to it.
+func coverageBetween(chunks []binlogChunk, to time.Time) *binlogCoverage {
+	to = to.Truncate(time.Second)
+	var coverage *binlogCoverage
+	for _, chunk := range chunks {
+		if !to.IsZero() && !chunk.Started.Before(to) {
+			continue
+		}
+		if coverage == nil {
+			coverage = &binlogCoverage{FirstFile: chunk.BinlogFile, From: chunk.Started}
+		}
+		coverage.LastFile = chunk.BinlogFile
+		coverage.Chunks++
+		if chunk.Stored.After(coverage.To) {
+			coverage.To = chunk.Stored
+		}
+	}
+	return coverage
+}
+
+// parseChunkName extracts the binary log file, index and start time from the name of an incremental backup chunk.
+// Chunks are named "incr_backup_<binlog file>_<index>_<YYYYMMDD>_<HHMMSS>.log", followed by the codec extensions.
+//
+// Parameters:
+// - name: The stored file name of the chunk.
+//
+// Returns:
+// - binlogChunk: The chunk described by the name, without its key and storage time.
+// - bool: True if the name is the name of a chunk, otherwise false.
+func parseChunkName(name string) (binlogChunk, bool) {
+	base := trimArtifactExt(name)
+	if !strings.HasPrefix(base, "incr_backup_") || !strings.HasSuffix(base, ".log") {
+		return binlogChunk{}, false
+	}
+	tokens := strings.Split(strings.TrimSuffix(strings.TrimPrefix(base, "incr_backup_"), ".log"), "_")
+	if len(tokens) < 4 {
+		return binlogChunk{}, false
+	}
+	n := len(tokens)
+	started, err := time.ParseInLocation("20060102_150405", tokens[n-2]+"_"+tokens[n-1], time.Local)
+	if err != nil {
+		return binlogChunk{}, false
+	}
+	index, err := strconv.Atoi(tokens[n-3])
+	if err != nil {
+		return binlogChunk{}, false
+	}
+	return binlogChunk{BinlogFile: strings.Join(tokens[:n-3], "_"), Index: index, Started: started}, true
+}
+
+// sortChunks orders chunks by start time, then by index.
+//
+// Parameters:
+// - chunks: The chunks to sort in place.
+func sortChunks(chunks []binlogChunk) {
+	sort.Slice(chunks, func(i, j int) bool {
+		if !chunks[i].Started.Equal(chunks[j].Started) {
+			return chunks[i].Started.Before(chunks[j].Started)
+		}
+		return chunks[i].Index < chunks[j].Index
+	})
+}
+
+// isManifestName reports whether a stored file is a backup manifest.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - bool: True if the file is a backup manifest, otherwise false.
+func isManifestName(name string) bool {
+	return strings.HasSuffix(name, "_backup_manifest.json")
+}
+
+// filterBackupSets returns the backup sets matching filter.
+//
+// Parameters:
+// - sets: The backup sets of the catalog.
+// - filter: The criteria the listed sets must match.
+//
+// Returns:
+// - []BackupSet: The matching backup sets, in their original order.
+func filterBackupSets(sets []BackupSet, filter catalogFilter) []BackupSet {
+	matched := []BackupSet{}
+	for _, set := range sets {
+		if !filter.Since.IsZero() && set.StartTime.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && set.StartTime.After(filter.Until) {
+			continue
+		}
+		if filter.Database != "" && set.Type != backupTypeAll && !containsString(set.Databases, filter.Database) {
+			continue
+		}
+		matched = append(matched, set)
+	}
+	return matched
+}
+
+// containsString reports whether list contains s.
+//
+// Parameters:
+// - list: The list to search.
+// - s: The string to look for.
+//
+// Returns:
+// - bool: True if s is in list, otherwise false.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCatalogTable writes the backup sets as a human readable table.
+//
+// Parameters:
+// - w: The writer receiving the table.
+// - sets: The backup sets to list.
+//
+// Returns:
+// - error: An error if writing fails, otherwise nil.
+func writeCatalogTable(w io.Writer, sets []BackupSet) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tDATABASES\tSTARTED\tDURATION\tSIZE\tSTATUS\tBINLOG\tBINLOG COVERAGE\tDIR")
+	for _, set := range sets {
+		databases := strings.Join(set.Databases, ",")
+		if set.Type == backupTypeAll {
+			databases = "*"
+		}
+		binlog := "-"
+		if set.Binlog != nil {
+			binlog = fmt.Sprintf("%s:%d", set.Binlog.File, set.Binlog.Position)
+		}
+		coverage := "-"
+		if set.Coverage != nil {
+			coverage = fmt.Sprintf("%s .. %s (%d chunks)", set.Coverage.From.Local().Format("2006-01-02 15:04"), set.Coverage.To.Local().Format("2006-01-02 15:04"), set.Coverage.Chunks)
+		}
+		if len(set.Gaps) > 0 {
+			gap := fmt.Sprintf("GAP after %s:%d", set.Gaps[0].LastFile, set.Gaps[0].LastPosition)
+			if set.Coverage == nil {
+				coverage = gap
+			} else {
+				coverage += " " + gap
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			set.ID, set.Type, databases, set.StartTime.Local().Format("2006-01-02 15:04:05"),
+			set.EndTime.Sub(set.StartTime).Round(time.Second), formatSize(set.Size), set.Status, binlog, coverage, set.Dir)
+	}
+	return tw.Flush()
+}
+
+// writeCatalogJSON writes the backup sets as a JSON array.
+//
+// Parameters:
+// - w: The writer receiving the JSON document.
+// - sets: The backup sets to list.
+//
+// Returns:
+// - error: An error if encoding fails, otherwise nil.
+func writeCatalogJSON(w io.Writer, sets []BackupSet) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sets)
+}
+
+// formatSize formats a size in bytes with a binary unit.
+//
+// Parameters:
+// - size: The size in bytes.
+//
+// Returns:
+// - string: The formatted size (e.g., "1.5 GiB").
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// parseCatalogTime parses a time bound given on the command line.
+// Accepted layouts are RFC 3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05" and "2006-01-02", in local time unless a zone is given.
+//
+// Parameters:
+// - value: The time as given on the command line.
+//
+// Returns:
+// - time.Time: The parsed time.
+// - error: An error if the value matches none of the layouts.
+func parseCatalogTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2024-01-01 or 2024-01-01 15:04:05", value)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestParseChunkName parses the names of binlog chunks, with and without codec extensions.
+func TestParseChunkName(t *testing.T) {
+	started := time.Date(2024, 5, 6, 1, 5, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		want binlogChunk
+		ok   bool
+	}{
+		{"incr_backup_binlog.000042_0_20240506_010500.log", binlogChunk{BinlogFile: "binlog.000042", Index: 0, Started: started}, true},
+		{"incr_backup_binlog.000042_17_20240506_010500.log.zst", binlogChunk{BinlogFile: "binlog.000042", Index: 17, Started: started}, true},
+		{"incr_backup_binlog.000042_3_20240506_010500.log.gz.enc", binlogChunk{BinlogFile: "binlog.000042", Index: 3, Started: started}, true},
+		{"incr_backup_mysql_bin.000007_2_20240506_010500.log.age", binlogChunk{BinlogFile: "mysql_bin.000007", Index: 2, Started: started}, true},
+		{"incr_backup_binlog.000042_x_20240506_010500.log", binlogChunk{}, false},
+		{"incr_backup_binlog.000042_0_20240506.log", binlogChunk{}, false},
+		{"incr_backup_binlog.000042_0_20241306_010500.log", binlogChunk{}, false},
+		{"20240506_010000_all_databases_full_backup.sql", binlogChunk{}, false},
+		{"20240506_010000_backup_manifest.json", binlogChunk{}, false},
+	}
+	for _, tc := range tests {
+		got, ok := parseChunkName(tc.name)
+		if ok != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseChunkName(%q) = %+v, %v, want %+v, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// testChunk names the binlog file of a chunk and the minute past midnight it was started at.
+type testChunk struct {
+	file   string
+	minute int
+}
+
+// testChunks returns the chunks described, stored one minute after they were started.
+func testChunks(chunks ...testChunk) []binlogChunk {
+	var result []binlogChunk
+	for i, chunk := range chunks {
+		started := time.Date(2024, 5, 6, 0, chunk.minute, 0, 0, time.Local)
+		result = append(result, binlogChunk{
+			Key:        chunk.file + "@" + started.Format("1504"),
+			BinlogFile: chunk.file,
+			Index:      i,
+			Started:    started,
+			Stored:     started.Add(time.Minute),
+		})
+	}
+	return result
+}
+
+// chunkKeys returns the keys of chunks.
+func chunkKeys(chunks []binlogChunk) []string {
+	var keys []string
+	for _, chunk := range chunks {
+		keys = append(keys, chunk.Key)
+	}
+	return keys
+}
+
+// TestChunksAfter selects the chunks following a backup by its binlog coordinates, including the chunk spanning its
+// snapshot, and by time when the backup has no coordinates.
+func TestChunksAfter(t *testing.T) {
+	chunks := testChunks([]testChunk{
+		{"binlog.000041", 0},
+		{"binlog.000042", 10},
+		{"binlog.000042", 20},
+		{"binlog.000042", 30},
+		{"binlog.000043", 40},
+	}...)
+	at := func(minute, second, nanosecond int) time.Time {
+		return time.Date(2024, 5, 6, 0, minute, second, nanosecond, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		coords *binlogCoordinates
+		start  time.Time
+		want   []string
+	}{
+		{"snapshot inside a chunk", &binlogCoordinates{File: "binlog.000042", Position: 4711}, at(25, 0, 0),
+			[]string{"binlog.000042@0020", "binlog.000042@0030", "binlog.000043@0040"}},
+		{"chunk started in the same second as the backup", &binlogCoordinates{File: "binlog.000042", Position: 4711}, at(20, 0, 500),
+			[]string{"binlog.000042@0010", "binlog.000042@0020", "binlog.000042@0030", "binlog.000043@0040"}},
+		{"snapshot in a binlog without chunk before the backup", &binlogCoordinates{File: "binlog.000043", Position: 157}, at(35, 0, 0),
+			[]string{"binlog.000043@0040"}},
+		{"snapshot after every chunk", &binlogCoordinates{File: "binlog.000044", Position: 157}, at(50, 0, 0), nil},
+		{"no coordinates", nil, at(20, 0, 999), []string{"binlog.000042@0020", "binlog.000042@0030", "binlog.000043@0040"}},
+		{"coordinates without a file", &binlogCoordinates{}, at(25, 0, 0), []string{"binlog.000042@0030", "binlog.000043@0040"}},
+	}
+	for _, tc := range tests {
+		if got := chunkKeys(chunksAfter(chunks, tc.coords, tc.start)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: chunksAfter = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestCoverageBetween summarises the chunks of a chain started before the next chain.
+func TestCoverageBetween(t *testing.T) {
+	chunks := testChunks([]testChunk{
+		{"binlog.000042", 10},
+		{"binlog.000042", 20},
+		{"binlog.000043", 30},
+	}...)
+	at := func(minute, nanosecond int) time.Time {
+		return time.Date(2024, 5, 6, 0, minute, 0, nanosecond, time.Local)
+	}
+
+	tests := []struct {
+		name string
+		to   time.Time
+		want *binlogCoverage
+	}{
+		{"no next chain", time.Time{}, &binlogCoverage{FirstFile: "binlog.000042", LastFile: "binlog.000043", From: at(10, 0), To: at(31, 0), Chunks: 3}},
+		{"next chain after the second chunk", at(25, 0), &binlogCoverage{FirstFile: "binlog.000042", LastFile: "binlog.000042", From: at(10, 0), To: at(21, 0), Chunks: 2}},
+		{"next chain in the second a chunk started", at(20, 500), &binlogCoverage{FirstFile: "binlog.000042", LastFile: "binlog.000042", From: at(10, 0), To: at(11, 0), Chunks: 1}},
+		{"next chain before every chunk", at(5, 0), nil},
+	}
+	for _, tc := range tests {
+		if got := coverageBetween(chunks, tc.to); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: coverageBetween = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+	if got := coverageBetween(nil, time.Time{}); got != nil {
+		t.Errorf("coverageBetween without chunks = %+v, want nil", got)
+	}
+}
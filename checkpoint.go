@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const checkpointFileName = "checkpoint.json" // Name of the checkpoint file in the local backup directory.
+
+// binlogCheckpoint records how far the incremental backup has durably archived the binary log.
+// It is rewritten after every binlog chunk stored in the storage backend, so a restarted incremental
+// backup resumes with the first event that is not in a stored chunk.
+//
+// Fields:
+// - BinlogFile: The binary log file of the last archived event.
+// - Position: The position following the last archived event.
+// - GTIDSet: The GTID set executed up to the last archived event, empty when GTIDs are disabled.
+// - ServerUUID: The UUID of the server the binary log was read from.
+// - LastEventTime: The time of the last archived event.
+// - LastChunk: The name of the last stored binlog chunk.
+// - UpdatedAt: The time the checkpoint was written.
+type binlogCheckpoint struct {
+	BinlogFile    string    `json:"binlog_file"`
+	Position      uint32    `json:"position"`
+	GTIDSet       string    `json:"gtid_set,omitempty"`
+	ServerUUID    string    `json:"server_uuid,omitempty"`
+	LastEventTime time.Time `json:"last_event_time"`
+	LastChunk     string    `json:"last_chunk"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// checkpointPath returns the path of the checkpoint file in a local backup directory.
+//
+// Parameters:
+// - backupDir: The local backup directory.
+//
+// Returns:
+// - string: The path of the checkpoint file.
+func checkpointPath(backupDir string) string {
+	return filepath.Join(backupDir, checkpointFileName)
+}
+
+// loadCheckpoint reads a checkpoint file.
+//
+// Parameters:
+// - path: The path of the checkpoint file.
+//
+// Returns:
+// - *binlogCheckpoint: The checkpoint, nil if the file does not exist.
+// - error: An error if the file cannot be read or decoded.
+func loadCheckpoint(path string) (*binlogCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+
+	var checkpoint binlogCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %w", path, err)
+	}
+	return &checkpoint, nil
+}
+
+// save writes the checkpoint atomically with writeFileAtomic, so a crash leaves either the old or the new checkpoint.
+//
+// Parameters:
+// - path: The path of the checkpoint file.
+//
+// Returns:
+// - error: An error if the checkpoint cannot be written.
+func (c *binlogCheckpoint) save(path string) error {
+	c.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	if err := writeFileAtomic(path, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// queryServerUUID reads the UUID of the server.
+//
+// Parameters:
+// - dbConn: The database connection object.
+//
+// Returns:
+// - string: The server UUID, empty if the server does not report one (e.g., MariaDB).
+// - error: An error if the query fails.
+func queryServerUUID(dbConn *sql.DB) (string, error) {
+	var uuid sql.NullString
+	if err := dbConn.QueryRow("SELECT @@server_uuid").Scan(&uuid); err != nil {
+		return "", err
+	}
+	return uuid.String, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecNone = "none" // Backups are stored as they are produced.
+	codecGzip = "gzip" // Backups are gzip compressed and get the ".gz" extension.
+	codecZstd = "zstd" // Backups are zstd compressed and get the ".zst" extension.
+)
+
+// Compression holds the codec applied to full dumps and binlog chunks before they are stored.
+//
+// Fields:
+// - Codec: The compression codec, one of none, gzip or zstd.
+// - Level: The codec specific compression level (0 selects the codec default).
+type Compression struct {
+	Codec string
+	Level int
+}
+
+// compressionFromEnv reads the compression settings from BACKUP_COMPRESSION and BACKUP_COMPRESSION_LEVEL.
+//
+// Returns:
+// - Compression: The compression settings.
+// - error: An error if the codec is unknown or the level is invalid.
+func compressionFromEnv() (Compression, error) {
+	comp := Compression{Codec: codecNone}
+	if codec := os.Getenv("BACKUP_COMPRESSION"); codec != "" {
+		comp.Codec = strings.ToLower(codec)
+	}
+
+	if levelStr := os.Getenv("BACKUP_COMPRESSION_LEVEL"); levelStr != "" {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil {
+			return comp, fmt.Errorf("error parsing BACKUP_COMPRESSION_LEVEL: %v", err)
+		}
+		comp.Level = level
+	}
+
+	return comp, comp.Validate()
+}
+
+// Validate checks if the codec is known and the level is within its range.
+//
+// Returns:
+// - error: An error if the codec or level is invalid, otherwise nil.
+func (c Compression) Validate() error {
+	switch c.Codec {
+	case "", codecNone:
+	case codecGzip:
+		if c.Level < 0 || c.Level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between 1 and %d", gzip.BestCompression)
+		}
+	case codecZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22")
+		}
+	default:
+		return fmt.Errorf("unknown compression codec: %s, should be one of none, gzip, zstd", c.Codec)
+	}
+	return nil
+}
+
+// Extension returns the file name extension recording the codec.
+//
+// Returns:
+// - string: The extension appended to compressed file names, empty when uncompressed.
+func (c Compression) Extension() string {
+	switch c.Codec {
+	case codecGzip:
+		return ".gz"
+	case codecZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// NewWriter wraps w so that everything written is compressed with the configured codec.
+// Closing the returned writer flushes the compressed stream but does not close w.
+//
+// Parameters:
+// - w: The writer receiving the compressed stream.
+//
+// Returns:
+// - io.WriteCloser: The compressing writer.
+// - error: An error if the encoder cannot be created.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case codecGzip:
+		level := gzip.DefaultCompression
+		if c.Level > 0 {
+			level = c.Level
+		}
+		return gzip.NewWriterLevel(w, level)
+	case codecZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// codecFromName detects the compression codec of a backup file from its name.
+//
+// Parameters:
+// - name: The file name or storage key of the backup file.
+//
+// Returns:
+// - string: The codec the file was compressed with.
+func codecFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return codecGzip
+	case strings.HasSuffix(name, ".zst"):
+		return codecZstd
+	default:
+		return codecNone
+	}
+}
+
+// trimCompressionExt removes the compression extension from a backup file name.
+//
+// Parameters:
+// - name: The file name or storage key of the backup file.
+//
+// Returns:
+// - string: The name as it was before compression.
+func trimCompressionExt(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+}
+
+// newDecompressReader wraps r so that the backup file called name is transparently decompressed.
+//
+// Parameters:
+// - r: The reader over the stored backup file.
+// - name: The file name or storage key, used to detect the codec.
+//
+// Returns:
+// - io.ReadCloser: The decompressing reader. Closing it does not close r.
+// - error: An error if the compressed stream header is invalid.
+func newDecompressReader(r io.Reader, name string) (io.ReadCloser, error) {
+	switch codecFromName(name) {
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing.
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFileEnv    = "MBRGO_CONFIG"  // Environment variable naming the configuration file, when --config is not given.
+	configProfileEnv = "MBRGO_PROFILE" // Environment variable naming the profile, when --profile is not given.
+)
+
+// configKey maps a setting of the configuration file to the environment variable it stands for.
+//
+// Fields:
+// - Path: The dotted path of the setting in the configuration file (e.g., "mysql.host").
+// - Env: The environment variable holding the setting.
+type configKey struct {
+	Path string
+	Env  string
+}
+
+// configKeys lists every setting of the configuration file. Each setting stands for an environment variable,
+// so the file, the environment and --set flags are read by the same code.
+var configKeys = []configKey{
+	{"mysql.host", "MYSQL_HOST"},
+	{"mysql.port", "MYSQL_PORT"},
+	{"mysql.socket", "MYSQL_SOCKET"},
+	{"mysql.user", "MYSQL_USER"},
+	{"mysql.password", "MYSQL_PASSWORD"},
+	{"mysql.user_file", "MYSQL_USER_FILE"},
+	{"mysql.user_command", "MYSQL_USER_COMMAND"},
+	{"mysql.password_file", "MYSQL_PASSWORD_FILE"},
+	{"mysql.password_command", "MYSQL_PASSWORD_COMMAND"},
+	{"mysql.credentials_refresh", "MYSQL_CREDENTIALS_REFRESH"},
+	{"mysql.vault.path", "MYSQL_VAULT_PATH"},
+	{"mysql.vault.user_field", "MYSQL_VAULT_USER_FIELD"},
+	{"mysql.vault.password_field", "MYSQL_VAULT_PASSWORD_FIELD"},
+	{"mysql.flavor", "MYSQL_FLAVOR"},
+	{"mysql.server_id", "MYSQL_SERVER_ID"},
+	{"mysql.charset", "MYSQL_CHARSET"},
+	{"mysql.tls.mode", "MYSQL_TLS_MODE"},
+	{"mysql.tls.ca", "MYSQL_TLS_CA"},
+	{"mysql.tls.cert", "MYSQL_TLS_CERT"},
+	{"mysql.tls.key", "MYSQL_TLS_KEY"},
+	{"mysql.tls.server_name", "MYSQL_TLS_SERVER_NAME"},
+	{"mysql.ssh.host", "MYSQL_SSH_HOST"},
+	{"mysql.ssh.user", "MYSQL_SSH_USER"},
+	{"mysql.ssh.key_file", "MYSQL_SSH_KEY_FILE"},
+	{"mysql.ssh.key_passphrase", "MYSQL_SSH_KEY_PASSPHRASE"},
+	{"mysql.ssh.known_hosts", "MYSQL_SSH_KNOWN_HOSTS"},
+	{"mysql.ssh.insecure_ignore_host_key", "MYSQL_SSH_INSECURE_IGNORE_HOST_KEY"},
+	{"backup_dir", "MYSQL_BACKUP_PATH"},
+	{"storage.backend", "STORAGE_BACKEND"},
+	{"storage.prefix", "STORAGE_PREFIX"},
+	{"storage.s3.bucket", "AWS_S3_BUCKET"},
+	{"storage.s3.endpoint", "AWS_S3_ENDPOINT"},
+	{"storage.s3.region", "AWS_S3_REGION"},
+	{"storage.s3.force_path_style", "AWS_S3_FORCE_PATH_STYLE"},
+	{"storage.s3.ca_bundle", "AWS_S3_CA_BUNDLE"},
+	{"storage.s3.insecure_skip_verify", "AWS_S3_INSECURE_SKIP_VERIFY"},
+	{"storage.s3.part_size_mb", "AWS_S3_PART_SIZE_MB"},
+	{"storage.s3.upload_concurrency", "AWS_S3_UPLOAD_CONCURRENCY"},
+	{"storage.s3.access_key_id", "AWS_ACCESS_KEY_ID"},
+	{"storage.s3.access_key_id_file", "AWS_ACCESS_KEY_ID_FILE"},
+	{"storage.s3.secret_access_key", "AWS_SECRET_ACCESS_KEY"},
+	{"storage.s3.secret_access_key_file", "AWS_SECRET_ACCESS_KEY_FILE"},
+	{"storage.s3.profile", "AWS_PROFILE"},
+	{"storage.fs.root", "STORAGE_FS_ROOT"},
+	{"compression.codec", "BACKUP_COMPRESSION"},
+	{"compression.level", "BACKUP_COMPRESSION_LEVEL"},
+	{"encryption.key_file", "BACKUP_ENCRYPTION_KEY_FILE"},
+	{"encryption.key", "BACKUP_ENCRYPTION_KEY"},
+	{"encryption.key_id", "BACKUP_ENCRYPTION_KEY_ID"},
+	{"encryption.age_recipients", "BACKUP_AGE_RECIPIENTS"},
+	{"encryption.age_recipients_file", "BACKUP_AGE_RECIPIENTS_FILE"},
+	{"encryption.age_identity_files", "BACKUP_AGE_IDENTITY_FILE"},
+	{"binlog.gtid_mode", "BACKUP_GTID_MODE"},
+	{"binlog.upload_queue_size", "BACKUP_UPLOAD_QUEUE_SIZE"},
+	{"binlog.live_upload", "BACKUP_BINLOG_LIVE_UPLOAD"},
+	{"binlog.heartbeat_period", "BACKUP_BINLOG_HEARTBEAT_PERIOD"},
+	{"binlog.read_timeout", "BACKUP_BINLOG_READ_TIMEOUT"},
+	{"binlog.reconnect_max_backoff", "BACKUP_BINLOG_RECONNECT_MAX_BACKOFF"},
+	{"schedule.weekday", "BACKUP_SCHEDULE_WEEKDAY"},
+	{"schedule.hour", "BACKUP_SCHEDULE_HOUR"},
+	{"retention.keep_full_backups", "BACKUP_RETENTION_KEEP_FULL_BACKUPS"},
+	{"retention.max_age_days", "BACKUP_RETENTION_MAX_AGE_DAYS"},
+	{"shutdown_timeout", "BACKUP_SHUTDOWN_TIMEOUT"},
+	{"vault.address", "VAULT_ADDR"},
+	{"vault.token", "VAULT_TOKEN"},
+	{"vault.token_file", "VAULT_TOKEN_FILE"},
+	{"vault.namespace", "VAULT_NAMESPACE"},
+	{"vault.ca_cert", "VAULT_CACERT"},
+	{"vault.skip_verify", "VAULT_SKIP_VERIFY"},
+	{"daemon.max_concurrent_dumps", "MBRGO_MAX_CONCURRENT_DUMPS"},
+	{"daemon.status_file", "MBRGO_STATUS_FILE"},
+	{"daemon.status_interval", "MBRGO_STATUS_INTERVAL"},
+}
+
+// envReference matches the environment variable references interpolated into the values of the configuration file:
+// "${NAME}", "${NAME:-default}", and "$$" for a literal dollar sign.
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// globalOptions holds the options given before the command on the command line.
+//
+// Fields:
+// - ConfigPath: The path to the configuration file, empty to read MBRGO_CONFIG.
+// - Profile: The profile of the configuration file to use, empty to read MBRGO_PROFILE.
+// - Target: The target of the configuration file whose settings are used, empty for the shared settings only.
+// - EnvFile: The path to a .env file, empty to load .env from the working directory if it exists.
+// - Settings: Settings given as path=value, overriding the configuration file and the environment.
+type globalOptions struct {
+	ConfigPath string
+	Profile    string
+	Target     string
+	EnvFile    string
+	Settings   settingFlags
+}
+
+// settingFlags collects the values of the repeatable --set flag.
+type settingFlags []string
+
+// String returns the settings given so far.
+func (s *settingFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set adds a setting given as path=value.
+func (s *settingFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// configFile is a parsed configuration file. Settings outside profiles are shared by every profile,
+// and the settings of the selected profile override them.
+//
+// Fields:
+// - Path: The path the file was read from.
+// - DefaultProfile: The profile used when none is selected, empty if none.
+// - Shared: The settings shared by every profile.
+// - Profiles: The settings of each named profile.
+// - Targets: The settings of each server managed by the daemon, applied over the shared and profile settings.
+type configFile struct {
+	Path           string
+	DefaultProfile string
+	Shared         map[string]any
+	Profiles       map[string]map[string]any
+	Targets        map[string]map[string]any
+}
+
+// parseGlobalOptions reads the options given before the command.
+//
+// Parameters:
+// - args: The command line arguments, without the program name.
+//
+// Returns:
+// - globalOptions: The options.
+// - []string: The command and its arguments.
+// - error: An error if an option is unknown or malformed.
+func parseGlobalOptions(args []string) (globalOptions, []string, error) {
+	var opts globalOptions
+	fs := flag.NewFlagSet("mbrgo", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "config", "", "path to the YAML configuration file (default $"+configFileEnv+")")
+	fs.StringVar(&opts.Profile, "profile", "", "profile of the configuration file to use (default $"+configProfileEnv+")")
+	fs.StringVar(&opts.Target, "target", "", "target of the configuration file to run the command against")
+	fs.StringVar(&opts.EnvFile, "env-file", "", "path to a .env file (default .env if it exists)")
+	fs.Var(&opts.Settings, "set", "setting given as path=value, e.g. mysql.host=db1 (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return opts, nil, err
+	}
+	return opts, fs.Args(), nil
+}
+
+// loadDotEnv loads a .env file into the environment, without overriding variables already set.
+//
+// Parameters:
+// - path: The path to the file, empty to load .env from the working directory if it exists.
+//
+// Returns:
+// - error: An error if the file cannot be loaded, or if an explicitly given file does not exist.
+func loadDotEnv(path string) error {
+	if path == "" {
+		if _, err := os.Stat(".env"); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		path = ".env"
+	}
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf("error loading %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadConfigFile reads and parses a configuration file.
+//
+// Parameters:
+// - path: The path to the file.
+//
+// Returns:
+// - *configFile: The parsed file.
+// - error: An error if the file cannot be read or is not a valid configuration.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	cfg := &configFile{Path: path, Shared: doc, Profiles: map[string]map[string]any{}, Targets: map[string]map[string]any{}}
+	if cfg.Shared == nil {
+		cfg.Shared = map[string]any{}
+	}
+	if value, ok := cfg.Shared["default_profile"]; ok {
+		name, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: default_profile must be a string", path)
+		}
+		cfg.DefaultProfile = name
+		delete(cfg.Shared, "default_profile")
+	}
+	if value, ok := cfg.Shared["profiles"]; ok {
+		profiles, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: profiles must map profile names to settings", path)
+		}
+		for name, settings := range profiles {
+			if settings == nil {
+				settings = map[string]any{}
+			}
+			profile, ok := settings.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: profile %s must hold settings", path, name)
+			}
+			cfg.Profiles[name] = profile
+		}
+		delete(cfg.Shared, "profiles")
+	}
+	if value, ok := cfg.Shared["targets"]; ok {
+		targets, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: targets must map target names to settings", path)
+		}
+		for name, settings := range targets {
+			if err := validateTargetName(name); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if settings == nil {
+				settings = map[string]any{}
+			}
+			target, ok := settings.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: target %s must hold settings", path, name)
+			}
+			cfg.Targets[name] = target
+		}
+		delete(cfg.Shared, "targets")
+	}
+	if cfg.DefaultProfile != "" {
+		if _, ok := cfg.Profiles[cfg.DefaultProfile]; !ok {
+			return nil, fmt.Errorf("%s: default_profile %s is not defined", path, cfg.DefaultProfile)
+		}
+	}
+	return cfg, nil
+}
+
+// profileNames returns the names of the profiles of the file.
+//
+// Returns:
+// - []string: The profile names, sorted.
+func (c *configFile) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectProfile resolves the profile to use.
+//
+// Parameters:
+// - profile: The profile asked for on the command line or in MBRGO_PROFILE, empty if none.
+//
+// Returns:
+// - string: The profile to use, empty to use the shared settings only.
+// - error: An error if the profile is not defined, or if the file has profiles and none is selected.
+func (c *configFile) selectProfile(profile string) (string, error) {
+	if profile == "" {
+		profile = c.DefaultProfile
+	}
+	if profile == "" {
+		if len(c.Profiles) > 0 {
+			return "", fmt.Errorf("%s defines the profiles %s, select one with --profile or %s", c.Path, strings.Join(c.profileNames(), ", "), configProfileEnv)
+		}
+		return "", nil
+	}
+	if _, ok := c.Profiles[profile]; !ok {
+		return "", fmt.Errorf("profile %s is not defined in %s", profile, c.Path)
+	}
+	return profile, nil
+}
+
+// settings resolves the settings of a profile into environment variables.
+// Environment variable references in the values are interpolated.
+//
+// Parameters:
+// - profile: The profile, empty for the shared settings only.
+//
+// Returns:
+// - map[string]string: The value of each environment variable set by the file.
+// - error: An error if a setting is unknown, malformed or refers to an undefined environment variable.
+func (c *configFile) settings(profile string) (map[string]string, error) {
+	return resolveSettings(mergeSettings(c.Shared, c.Profiles[profile]), c.Path)
+}
+
+// targetNames returns the names of the targets of the file.
+//
+// Returns:
+// - []string: The target names, sorted.
+func (c *configFile) targetNames() []string {
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// targetSettings resolves the settings of a target into environment variables, without the shared settings.
+// Environment variable references in the values are interpolated.
+//
+// Parameters:
+// - name: The target.
+//
+// Returns:
+// - map[string]string: The value of each environment variable set by the target.
+// - error: An error if the target is not defined, or a setting is unknown, malformed, daemon wide or refers to an
+// undefined environment variable.
+func (c *configFile) targetSettings(name string) (map[string]string, error) {
+	target, ok := c.Targets[name]
+	if !ok {
+		return nil, fmt.Errorf("target %s is not defined in %s", name, c.Path)
+	}
+	if _, ok := target["daemon"]; ok {
+		return nil, fmt.Errorf("%s: target %s: daemon settings apply to every target and cannot be set per target", c.Path, name)
+	}
+	return resolveSettings(target, fmt.Sprintf("%s: target %s", c.Path, name))
+}
+
+// resolveSettings converts nested settings into the environment variables they stand for.
+//
+// Parameters:
+// - settings: The nested settings.
+// - origin: Where the settings come from, prefixed to the errors.
+//
+// Returns:
+// - map[string]string: The value of each environment variable.
+// - error: An error if a setting is unknown, malformed or refers to an undefined environment variable.
+func resolveSettings(settings map[string]any, origin string) (map[string]string, error) {
+	flat := map[string]string{}
+	if err := flattenSettings("", settings, flat); err != nil {
+		return nil, fmt.Errorf("%s: %w", origin, err)
+	}
+
+	env := make(map[string]string, len(flat))
+	for path, value := range flat {
+		name, ok := configEnvName(path)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown setting %s", origin, path)
+		}
+		value, err := interpolateEnv(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", origin, path, err)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// mergeSettings merges the settings of a profile over the shared settings, section by section.
+//
+// Parameters:
+// - base: The shared settings.
+// - override: The settings of the profile, nil if none.
+//
+// Returns:
+// - map[string]any: The merged settings; base and override are not modified.
+func mergeSettings(base, override map[string]any) map[string]any {
+	merged := make(map[string]any, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseSection, baseOK := merged[key].(map[string]any)
+		section, ok := value.(map[string]any)
+		if baseOK && ok {
+			merged[key] = mergeSettings(baseSection, section)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// flattenSettings converts nested settings into dotted paths with string values.
+// Lists are joined with commas, as in the environment variables they stand for.
+//
+// Parameters:
+// - prefix: The path of value, empty at the top level.
+// - value: The settings or value to flatten.
+// - out: Receives the value of each path.
+//
+// Returns:
+// - error: An error if a value is neither a section, a scalar nor a list of scalars.
+func flattenSettings(prefix string, value any, out map[string]string) error {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			if err := flattenSettings(path, item, out); err != nil {
+				return err
+			}
+		}
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]any, []any:
+				return fmt.Errorf("%s must be a list of values", prefix)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		out[prefix] = strings.Join(items, ",")
+	case nil:
+		// An empty setting leaves the environment variable unset.
+	case time.Time:
+		return fmt.Errorf("%s must be quoted", prefix)
+	default:
+		out[prefix] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// configEnvName returns the environment variable a setting stands for.
+//
+// Parameters:
+// - path: The dotted path of the setting.
+//
+// Returns:
+// - string: The environment variable.
+// - bool: True if the setting is known, otherwise false.
+func configEnvName(path string) (string, bool) {
+	for _, key := range configKeys {
+		if key.Path == path {
+			return key.Env, true
+		}
+	}
+	return "", false
+}
+
+// interpolateEnv replaces the environment variable references in a value of the configuration file.
+//
+// Parameters:
+// - value: The value as written in the file.
+//
+// Returns:
+// - string: The value with every reference replaced.
+// - error: An error if a variable without default is not set.
+func interpolateEnv(value string) (string, error) {
+	var missing []string
+	result := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		match := envReference.FindStringSubmatch(ref)
+		v, ok := os.LookupEnv(match[1])
+		if match[2] != "" && v == "" {
+			return match[3]
+		}
+		if !ok {
+			missing = append(missing, match[1])
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// parseSettingFlags resolves the settings given with --set into environment variables.
+//
+// Parameters:
+// - settings: The settings, each given as path=value.
+//
+// Returns:
+// - map[string]string: The value of each environment variable set by the flags.
+// - error: An error if a setting is malformed or unknown.
+func parseSettingFlags(settings []string) (map[string]string, error) {
+	env := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		path, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --set %s, expected path=value", setting)
+		}
+		name, ok := configEnvName(path)
+		if !ok {
+			return nil, fmt.Errorf("invalid --set %s: unknown setting %s", setting, path)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// applySettings sets environment variables from the configuration file or the command line.
+//
+// Parameters:
+// - settings: The value of each environment variable.
+// - override: True to replace variables already set, false to keep them (the environment takes precedence over the file).
+//
+// Returns:
+// - func(): Restores the environment as it was before.
+func applySettings(settings map[string]string, override bool) func() {
+	previous := map[string]*string{}
+	for name, value := range settings {
+		old, set := os.LookupEnv(name)
+		if set && !override {
+			continue
+		}
+		if set {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// applyConfiguration layers the configuration file, the environment and the --set flags, in increasing order
+// of precedence, into the environment read by the rest of the service.
+//
+// Parameters:
+// - cfg: The configuration file, nil if none.
+// - profile: The profile of the file to use, empty to select the default.
+// - flagSettings: The environment variables set with --set.
+//
+// Returns:
+// - func(): Restores the environment as it was before.
+// - error: An error if the profile or a setting of the file is invalid.
+func applyConfiguration(cfg *configFile, profile string, flagSettings map[string]string) (func(), error) {
+	restoreFile := func() {}
+	if cfg != nil {
+		selected, err := cfg.selectProfile(profile)
+		if err != nil {
+			return nil, err
+		}
+		settings, err := cfg.settings(selected)
+		if err != nil {
+			return nil, err
+		}
+		restoreFile = applySettings(settings, false)
+	}
+	restoreFlags := applySettings(flagSettings, true)
+	return func() {
+		restoreFlags()
+		restoreFile()
+	}, nil
+}
+
+// validateConfiguration checks every setting of the environment without connecting to the server or the storage.
+// It extends DB.Validate to the storage, codecs, schedule and retention settings.
+//
+// Returns:
+// - error: Every problem found, joined, otherwise nil.
+func validateConfiguration() error {
+	var errs []error
+	db, err := initDb()
+	if err != nil {
+		errs = append(errs, err)
+	} else if err := db.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compressionFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid compression configuration: %w", err))
+	}
+	if _, err := encryptionFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid encryption configuration: %w", err))
+	}
+	if err := validateStorageConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid storage configuration: %w", err))
+	}
+	if _, _, err := scheduleFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid schedule: %w", err))
+	}
+	if _, err := retentionFromEnv(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid retention: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// validateStorageConfig checks the settings of the storage backend selected by STORAGE_BACKEND.
+//
+// Returns:
+// - error: An error if the backend is unknown or its settings are incomplete or malformed.
+func validateStorageConfig() error {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "s3":
+		s3Cfg, err := s3ConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		if s3Cfg.Bucket == "" {
+			return fmt.Errorf("AWS_S3_BUCKET is required for the s3 backend")
+		}
+	case "fs":
+		if os.Getenv("STORAGE_FS_ROOT") == "" {
+			return fmt.Errorf("STORAGE_FS_ROOT is required for the fs backend")
+		}
+	default:
+		return fmt.Errorf("unknown storage backend: %s, should be one of s3, fs", backend)
+	}
+	return nil
+}
+
+// scheduleFromEnv reads the schedule of the backup scheduler from BACKUP_SCHEDULE_WEEKDAY and BACKUP_SCHEDULE_HOUR.
+//
+// Returns:
+// - string: The weekday, empty if not set.
+// - string: The time of day, empty if not set.
+// - error: An error if a value is set but invalid.
+func scheduleFromEnv() (string, string, error) {
+	weekday := os.Getenv("BACKUP_SCHEDULE_WEEKDAY")
+	hour := os.Getenv("BACKUP_SCHEDULE_HOUR")
+	if weekday != "" {
+		if _, err := parseWeekday(weekday); err != nil {
+			return weekday, hour, err
+		}
+	}
+	if hour != "" {
+		if _, err := time.Parse("15:04", hour); err != nil {
+			return weekday, hour, fmt.Errorf("invalid hour %s, expected HH:MM", hour)
+		}
+	}
+	return weekday, hour, nil
+}
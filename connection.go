@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// TLS modes of the connections to the server, named after the --ssl-mode option of the MySQL client tools.
+const (
+	tlsModeDisabled       = "disabled"        // Plain TCP connections.
+	tlsModeRequired       = "required"        // Encrypted connections, without verifying the server certificate.
+	tlsModeVerifyCA       = "verify-ca"       // Encrypted connections to a server whose certificate is signed by the CA.
+	tlsModeVerifyIdentity = "verify-identity" // As verify-ca, and the certificate must also match the server host name.
+)
+
+// TLSOptions holds the TLS settings of the connections to the server.
+//
+// Fields:
+// - Mode: The TLS mode, one of disabled, required, verify-ca or verify-identity.
+// - CA: The path to the PEM encoded CA certificates verifying the server certificate (the system pool when empty).
+// - Cert: The path to the PEM encoded client certificate, for servers requiring X509 authentication.
+// - Key: The path to the PEM encoded private key of the client certificate.
+// - ServerName: The host name the server certificate must match, the connection host when empty.
+type TLSOptions struct {
+	Mode       string
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+// tlsFromEnv reads the TLS settings from MYSQL_TLS_MODE, MYSQL_TLS_CA, MYSQL_TLS_CERT, MYSQL_TLS_KEY and MYSQL_TLS_SERVER_NAME.
+//
+// Returns:
+// - TLSOptions: The TLS settings.
+// - error: An error if the mode is unknown or the settings are inconsistent.
+func tlsFromEnv() (TLSOptions, error) {
+	opts := TLSOptions{
+		Mode:       strings.ToLower(os.Getenv("MYSQL_TLS_MODE")),
+		CA:         os.Getenv("MYSQL_TLS_CA"),
+		Cert:       os.Getenv("MYSQL_TLS_CERT"),
+		Key:        os.Getenv("MYSQL_TLS_KEY"),
+		ServerName: os.Getenv("MYSQL_TLS_SERVER_NAME"),
+	}
+	return opts, opts.Validate()
+}
+
+// Validate checks if the TLS mode is known and the client certificate is complete.
+//
+// Returns:
+// - error: An error if the mode is unknown or only one of the client certificate and key is set, otherwise nil.
+func (t TLSOptions) Validate() error {
+	switch t.Mode {
+	case "", tlsModeDisabled:
+		if t.CA != "" || t.Cert != "" {
+			return fmt.Errorf("TLS certificates are set but the TLS mode is disabled")
+		}
+	case tlsModeRequired, tlsModeVerifyCA, tlsModeVerifyIdentity:
+	default:
+		return fmt.Errorf("unknown TLS mode: %s, should be one of disabled, required, verify-ca, verify-identity", t.Mode)
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("both the TLS client certificate and key must be set")
+	}
+	return nil
+}
+
+// Config builds the TLS configuration of a connection to the server.
+//
+// Parameters:
+// - host: The host name of the server, verified against its certificate in verify-identity mode.
+//
+// Returns:
+// - *tls.Config: The TLS configuration, nil when TLS is disabled.
+// - error: An error if a certificate or key cannot be loaded.
+func (t TLSOptions) Config(host string) (*tls.Config, error) {
+	if t.Mode == "" || t.Mode == tlsModeDisabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in TLS CA file %s", t.CA)
+		}
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch t.Mode {
+	case tlsModeRequired:
+		cfg.InsecureSkipVerify = true
+	case tlsModeVerifyCA:
+		// The chain is verified by hand, as the standard verification also checks the host name.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, cfg.RootCAs)
+		}
+	case tlsModeVerifyIdentity:
+		cfg.ServerName = host
+		if t.ServerName != "" {
+			cfg.ServerName = t.ServerName
+		}
+	}
+	return cfg, nil
+}
+
+// verifyCertificateChain verifies that a server certificate is signed by a trusted CA, whatever its host name.
+//
+// Parameters:
+// - rawCerts: The DER encoded certificates sent by the server, leaf first.
+// - roots: The trusted CA certificates, the system pool when nil.
+//
+// Returns:
+// - error: An error if the certificate cannot be parsed or is not signed by a trusted CA.
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server sent no TLS certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// toolOptions returns the TLS options of the MySQL client tools, as lines of an option file.
+// The tools cannot verify the certificate against another name than the host they connect to, so when they reach
+// the server through the SSH tunnel forwarder, or the certificate name is overridden, verify-identity is relaxed
+// to verify-ca for them; the connections of the service itself still verify the identity.
+//
+// Parameters:
+// - flavor: The server flavor, selecting the option names of the MariaDB client tools.
+// - nameVerifiable: False when the tools connect to another host name than the one the certificate is issued to.
+//
+// Returns:
+// - []string: The option lines, empty when the TLS mode is not set.
+func (t TLSOptions) toolOptions(flavor string, nameVerifiable bool) []string {
+	mode := t.Mode
+	if mode == tlsModeVerifyIdentity && !nameVerifiable {
+		log.Printf("the MySQL client tools cannot verify the server name through the SSH tunnel or with MYSQL_TLS_SERVER_NAME, using verify-ca for them")
+		mode = tlsModeVerifyCA
+	}
+
+	var lines []string
+	if flavor == mysql.MariaDBFlavor {
+		switch mode {
+		case "":
+			return nil
+		case tlsModeDisabled:
+			return []string{"skip-ssl"}
+		case tlsModeVerifyIdentity:
+			lines = append(lines, "ssl", "ssl-verify-server-cert")
+		default:
+			lines = append(lines, "ssl")
+		}
+	} else {
+		switch mode {
+		case "":
+			return nil
+		case tlsModeDisabled:
+			return []string{"ssl-mode=DISABLED"}
+		case tlsModeRequired:
+			lines = append(lines, "ssl-mode=REQUIRED")
+		case tlsModeVerifyCA:
+			lines = append(lines, "ssl-mode=VERIFY_CA")
+		case tlsModeVerifyIdentity:
+			lines = append(lines, "ssl-mode=VERIFY_IDENTITY")
+		}
+	}
+	if t.CA != "" {
+		lines = append(lines, "ssl-ca="+optionValue(t.CA))
+	}
+	if t.Cert != "" {
+		lines = append(lines, "ssl-cert="+optionValue(t.Cert), "ssl-key="+optionValue(t.Key))
+	}
+	return lines
+}
+
+// serverAddress returns the network and address of the server, as seen from this host or from the SSH server.
+//
+// Returns:
+// - string: "unix" when a socket is configured, otherwise "tcp".
+// - string: The socket path, or host:port.
+func (db *DB) serverAddress() (string, string) {
+	if db.Socket != "" {
+		return "unix", db.Socket
+	}
+	return "tcp", net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+}
+
+// dialServer opens a network connection to the server, through the SSH tunnel when one is configured.
+// It has the signature of the dial functions of both MySQL libraries and ignores the address they pass.
+//
+// Parameters:
+// - ctx: The context for the dial.
+//
+// Returns:
+// - net.Conn: The connection to the server.
+// - error: An error if the server or the SSH server cannot be reached.
+func (db *DB) dialServer(ctx context.Context, _, _ string) (net.Conn, error) {
+	network, address := db.serverAddress()
+	if db.tunnel != nil {
+		return db.tunnel.dial(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// closeTunnel closes the SSH tunnel, if any.
+func (db *DB) closeTunnel() {
+	if db.tunnel != nil {
+		db.tunnel.Close()
+	}
+}
+
+// openConn opens the database/sql connection pool to the server, over TCP, a Unix socket or the SSH tunnel,
+// with the configured TLS settings.
+// Each new connection logs in with the current credentials, so rotated credentials are used without reopening the pool.
+//
+// Returns:
+// - *sql.DB: The connection pool; connections are only established when first used.
+// - error: An error if the TLS settings cannot be loaded.
+func (db *DB) openConn() (*sql.DB, error) {
+	cfg := mysqldriver.NewConfig()
+	cfg.Net, cfg.Addr = db.serverAddress()
+	if db.tunnel != nil {
+		cfg.DialFunc = db.dialServer
+	}
+	cfg.DBName = "information_schema"
+	// The driver logs to standard error by default, bypassing the redacting output of the standard logger.
+	cfg.Logger = log.Default()
+
+	tlsConfig, err := db.TLS.Config(db.Host)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS = tlsConfig
+
+	// Check the settings once, so an invalid configuration fails here instead of on every connection.
+	if _, err := mysqldriver.NewConnector(cfg.Clone()); err != nil {
+		return nil, fmt.Errorf("invalid connection settings: %w", err)
+	}
+	conn := sql.OpenDB(&credentialConnector{db: db, cfg: cfg})
+	if db.Credentials != nil && db.Credentials.dynamic() {
+		// Pooled connections are replaced in time for credentials revoked after a rotation.
+		conn.SetConnMaxLifetime(rotatedConnMaxLifetime)
+	}
+	return conn, nil
+}
+
+// credentialConnector is a driver.Connector logging in with the current credentials of the database configuration.
+//
+// Fields:
+// - db: The database configuration holding the credentials.
+// - cfg: The connection settings, without credentials.
+type credentialConnector struct {
+	db  *DB
+	cfg *mysqldriver.Config
+}
+
+// Connect opens a new connection to the server with the current credentials.
+func (c *credentialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg := c.cfg.Clone()
+	cfg.User, cfg.Passwd = c.db.credentials()
+	connector, err := mysqldriver.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Driver returns the MySQL driver.
+func (c *credentialConnector) Driver() driver.Driver {
+	return &mysqldriver.MySQLDriver{}
+}
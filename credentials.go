@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCredentialRefresh = time.Minute      // Default interval at which secret files, commands and static Vault secrets are re-read.
+	credentialFetchTimeout   = 30 * time.Second // Longest time reading the credentials may take.
+	credentialRetryInterval  = 30 * time.Second // Delay before retrying after the credentials could not be refreshed.
+	rotatedConnMaxLifetime   = 5 * time.Minute  // Lifetime of pooled connections when the credentials can rotate.
+)
+
+// secretFileEnvVars lists the secrets besides the MySQL credentials that can be read from a file or a command
+// through the <NAME>_FILE and <NAME>_COMMAND variables. They are read once, at startup.
+var secretFileEnvVars = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+}
+
+// secretRef tells where a secret is read from: the value of an environment variable, a file (such as a Docker or
+// Kubernetes secret) named by <NAME>_FILE, or the output of a command given by <NAME>_COMMAND.
+//
+// Fields:
+// - Name: The name of the environment variable.
+// - Value: The value of the environment variable.
+// - File: The file holding the secret.
+// - Command: The command printing the secret, as program and arguments.
+type secretRef struct {
+	Name    string
+	Value   string
+	File    string
+	Command []string
+}
+
+// secretFromEnv reads where a secret is configured from <NAME>, <NAME>_FILE and <NAME>_COMMAND.
+// The command is split on white space and run without a shell.
+//
+// Parameters:
+// - name: The name of the environment variable holding the secret.
+//
+// Returns:
+// - secretRef: Where the secret is read from, empty if none is set.
+// - error: An error if more than one of the variables is set.
+func secretFromEnv(name string) (secretRef, error) {
+	ref := secretRef{
+		Name:    name,
+		Value:   os.Getenv(name),
+		File:    os.Getenv(name + "_FILE"),
+		Command: strings.Fields(os.Getenv(name + "_COMMAND")),
+	}
+	set := 0
+	for _, isSet := range []bool{ref.Value != "", ref.File != "", len(ref.Command) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return secretRef{}, fmt.Errorf("only one of %s, %s_FILE and %s_COMMAND can be set", name, name, name)
+	}
+	return ref, nil
+}
+
+// isSet reports whether the secret is configured.
+func (s secretRef) isSet() bool {
+	return s.Value != "" || s.File != "" || len(s.Command) > 0
+}
+
+// dynamic reports whether the secret can change while the service runs.
+func (s secretRef) dynamic() bool {
+	return s.File != "" || len(s.Command) > 0
+}
+
+// read returns the current value of the secret.
+// The trailing newline of a file or command output is removed.
+//
+// Parameters:
+// - ctx: The context for the command, killed once it is cancelled.
+//
+// Returns:
+// - string: The secret, empty if it is not configured.
+// - error: An error if the file cannot be read or the command fails.
+func (s secretRef) read(ctx context.Context) (string, error) {
+	switch {
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", s.Name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case len(s.Command) > 0:
+		var stderr bytes.Buffer
+		command := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+		command.Stderr = &stderr
+		output, err := command.Output()
+		if err != nil {
+			return "", redactError(fmt.Errorf("%s_COMMAND failed: %w: %s", s.Name, err, strings.TrimSpace(stderr.String())))
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	default:
+		return s.Value, nil
+	}
+}
+
+// resolveSecretEnv sets the variables of secretFileEnvVars from their <NAME>_FILE or <NAME>_COMMAND variables.
+//
+// Returns:
+// - error: An error if a secret is configured twice or cannot be read.
+func resolveSecretEnv() error {
+	for _, name := range secretFileEnvVars {
+		ref, err := secretFromEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ref.dynamic() {
+			continue
+		}
+		value, err := ref.read(context.Background())
+		if err != nil {
+			return err
+		}
+		os.Setenv(name, value)
+	}
+	return nil
+}
+
+// CredentialProvider reads the MySQL credentials from the environment, secret files, commands or HashiCorp Vault,
+// and keeps them current while the service runs.
+//
+// Fields:
+// - User: Where the user is read from, also used when the Vault secret has no user field.
+// - Password: Where the password is read from, unless Vault is used.
+// - Vault: The Vault client, nil when the credentials are not read from Vault.
+// - VaultPath: The path of the Vault secret holding the credentials (KV or database secrets engine).
+// - UserField: The field of the Vault secret holding the user.
+// - PasswordField: The field of the Vault secret holding the password.
+// - Refresh: The interval at which secret files, commands and Vault secrets without a lease are re-read.
+// - lease: The Vault secret last read, holding its lease.
+type CredentialProvider struct {
+	User          secretRef
+	Password      secretRef
+	Vault         *vaultClient
+	VaultPath     string
+	UserField     string
+	PasswordField string
+	Refresh       time.Duration
+	lease         *vaultSecret
+}
+
+// credentialsFromEnv reads where the MySQL credentials come from: MYSQL_USER and MYSQL_PASSWORD, their _FILE and
+// _COMMAND variants, or the Vault secret named by MYSQL_VAULT_PATH. MYSQL_CREDENTIALS_REFRESH sets how often they are re-read.
+//
+// Returns:
+// - *CredentialProvider: The credential provider.
+// - error: An error if a setting is invalid or conflicting.
+func credentialsFromEnv() (*CredentialProvider, error) {
+	user, err := secretFromEnv("MYSQL_USER")
+	if err != nil {
+		return nil, err
+	}
+	password, err := secretFromEnv("MYSQL_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	p := &CredentialProvider{User: user, Password: password, Refresh: defaultCredentialRefresh}
+
+	if v := os.Getenv("MYSQL_CREDENTIALS_REFRESH"); v != "" {
+		refresh, err := time.ParseDuration(v)
+		if err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("invalid MYSQL_CREDENTIALS_REFRESH: %s", v)
+		}
+		p.Refresh = refresh
+	}
+
+	if path := os.Getenv("MYSQL_VAULT_PATH"); path != "" {
+		if password.isSet() {
+			return nil, fmt.Errorf("MYSQL_PASSWORD cannot be set when the credentials are read from Vault")
+		}
+		p.Vault, err = vaultFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		p.VaultPath = strings.Trim(path, "/")
+		p.UserField = os.Getenv("MYSQL_VAULT_USER_FIELD")
+		if p.UserField == "" {
+			p.UserField = "username"
+		}
+		p.PasswordField = os.Getenv("MYSQL_VAULT_PASSWORD_FIELD")
+		if p.PasswordField == "" {
+			p.PasswordField = "password"
+		}
+	}
+	return p, nil
+}
+
+// dynamic reports whether the credentials can change while the service runs.
+func (p *CredentialProvider) dynamic() bool {
+	return p.Vault != nil || p.User.dynamic() || p.Password.dynamic()
+}
+
+// fetch reads the current credentials.
+//
+// Parameters:
+// - ctx: The context for reading the secrets.
+//
+// Returns:
+// - string: The MySQL user.
+// - string: The MySQL password.
+// - *vaultSecret: The Vault secret the credentials were read from, nil when Vault is not used.
+// - error: An error if a secret cannot be read.
+func (p *CredentialProvider) fetch(ctx context.Context) (string, string, *vaultSecret, error) {
+	if p.Vault == nil {
+		user, err := p.User.read(ctx)
+		if err != nil {
+			return "", "", nil, err
+		}
+		password, err := p.Password.read(ctx)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return user, password, nil, nil
+	}
+
+	secret, err := p.Vault.read(ctx, p.VaultPath)
+	if err != nil {
+		return "", "", nil, err
+	}
+	password, ok := secret.field(p.PasswordField)
+	if !ok {
+		return "", "", nil, fmt.Errorf("vault secret %s has no %s field", p.VaultPath, p.PasswordField)
+	}
+	user, ok := secret.field(p.UserField)
+	if !ok {
+		if user, err = p.User.read(ctx); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return user, password, secret, nil
+}
+
+// refreshInterval returns the time until the credentials are refreshed: two thirds of the lease of a Vault secret,
+// otherwise the refresh interval.
+//
+// Returns:
+// - time.Duration: The time until the next refresh.
+func (p *CredentialProvider) refreshInterval() time.Duration {
+	if p.lease != nil && p.lease.LeaseDuration > 0 {
+		return leaseRefreshInterval(p.lease.LeaseDuration)
+	}
+	return p.Refresh
+}
+
+// leaseRefreshInterval returns two thirds of a lease duration, so a lease is renewed well before it expires.
+//
+// Parameters:
+// - seconds: The lease duration, in seconds.
+//
+// Returns:
+// - time.Duration: The time until the lease is renewed, at least one second.
+func leaseRefreshInterval(seconds int) time.Duration {
+	interval := time.Duration(seconds) * time.Second * 2 / 3
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+// credentials returns the current MySQL credentials.
+//
+// Returns:
+// - string: The MySQL user.
+// - string: The MySQL password.
+func (db *DB) credentials() (string, string) {
+	db.credentialsMu.RLock()
+	defer db.credentialsMu.RUnlock()
+	return db.User, db.Password
+}
+
+// setCredentials replaces the MySQL credentials used by new connections and tool runs.
+//
+// Parameters:
+// - user: The MySQL user.
+// - password: The MySQL password.
+//
+// Returns:
+// - bool: True if credentials were set before and have changed, otherwise false.
+func (db *DB) setCredentials(user, password string) bool {
+	db.credentialsMu.Lock()
+	defer db.credentialsMu.Unlock()
+	rotated := (db.User != "" || db.Password != "") && (db.User != user || db.Password != password)
+	db.User, db.Password = user, password
+	return rotated
+}
+
+// loadCredentials reads the MySQL credentials from their provider and applies them.
+//
+// Parameters:
+// - ctx: The context for reading the secrets.
+//
+// Returns:
+// - error: An error if the credentials cannot be read.
+func (db *DB) loadCredentials(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, credentialFetchTimeout)
+	defer cancel()
+
+	user, password, lease, err := db.Credentials.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load MySQL credentials: %w", err)
+	}
+	registerSecret(password)
+	db.Credentials.lease = lease
+	if db.setCredentials(user, password) {
+		db.logf("MySQL credentials rotated, new connections log in as %s", user)
+	}
+	return nil
+}
+
+// renewCredentials keeps the MySQL credentials current until ctx is cancelled: Vault leases are renewed, and
+// new credentials are read when a lease cannot be renewed any more, when the refresh interval of secret files,
+// commands and static Vault secrets elapses, and on SIGHUP. The Vault token is renewed as well when it has a TTL.
+// It returns at once when the credentials cannot change.
+//
+// Parameters:
+// - ctx: The context cancelled when the service stops.
+func (db *DB) renewCredentials(ctx context.Context) {
+	p := db.Credentials
+	if p == nil || !p.dynamic() {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	credentialsDue := time.Now().Add(p.refreshInterval())
+	var tokenDue time.Time
+	if p.Vault != nil {
+		// The first renewal tells whether the token expires at all.
+		tokenDue = time.Now()
+	}
+	for {
+		due := credentialsDue
+		if !tokenDue.IsZero() && tokenDue.Before(due) {
+			due = tokenDue
+		}
+		reload := false
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-hup:
+			timer.Stop()
+			db.logf("SIGHUP received, reloading MySQL credentials")
+			reload = true
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if !tokenDue.IsZero() && !now.Before(tokenDue) {
+			tokenDue = db.renewVaultToken(ctx)
+		}
+		if reload || !now.Before(credentialsDue) {
+			credentialsDue = time.Now().Add(db.refreshCredentials(ctx, reload))
+		}
+	}
+}
+
+// refreshCredentials renews the lease of the credentials, or reads new credentials when there is no lease to
+// renew, the lease reached its maximum TTL, or a reload is requested.
+//
+// Parameters:
+// - ctx: The context for the requests.
+// - reload: True to read new credentials even if the lease could be renewed.
+//
+// Returns:
+// - time.Duration: The time until the next refresh.
+func (db *DB) refreshCredentials(ctx context.Context, reload bool) time.Duration {
+	p := db.Credentials
+	if lease := p.lease; !reload && lease != nil && lease.Renewable && lease.LeaseID != "" {
+		requested := time.Duration(lease.LeaseDuration) * time.Second
+		renewCtx, cancel := context.WithTimeout(ctx, credentialFetchTimeout)
+		renewed, err := p.Vault.renewLease(renewCtx, lease.LeaseID, requested)
+		cancel()
+		switch {
+		case err != nil:
+			db.logf("failed to renew the lease of the MySQL credentials, reading new credentials: %v", err)
+		case time.Duration(renewed.LeaseDuration)*time.Second*2 < requested:
+			// The lease is close to its maximum TTL, Vault no longer extends it by the full duration.
+			db.logf("lease %s of the MySQL credentials expires in %ds, reading new credentials", lease.LeaseID, renewed.LeaseDuration)
+		default:
+			db.logf("renewed lease %s of the MySQL credentials for %ds", lease.LeaseID, renewed.LeaseDuration)
+			return leaseRefreshInterval(renewed.LeaseDuration)
+		}
+	}
+
+	if err := db.loadCredentials(ctx); err != nil {
+		db.logf("%v, retrying in %s", err, credentialRetryInterval)
+		return credentialRetryInterval
+	}
+	return p.refreshInterval()
+}
+
+// renewVaultToken renews the Vault token when it has a TTL.
+//
+// Parameters:
+// - ctx: The context for the request.
+//
+// Returns:
+// - time.Time: When the token is renewed next, zero if it does not expire or cannot be renewed.
+func (db *DB) renewVaultToken(ctx context.Context) time.Time {
+	renewCtx, cancel := context.WithTimeout(ctx, credentialFetchTimeout)
+	defer cancel()
+	secret, err := db.Credentials.Vault.renewToken(renewCtx)
+	if err != nil {
+		db.logf("Vault token not renewed: %v", err)
+		return time.Time{}
+	}
+	if secret.Auth == nil || secret.Auth.LeaseDuration <= 0 || !secret.Auth.Renewable {
+		return time.Time{}
+	}
+	db.logf("renewed Vault token for %ds", secret.Auth.LeaseDuration)
+	return time.Now().Add(leaseRefreshInterval(secret.Auth.LeaseDuration))
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentDumps = 1           // Full dumps the daemon runs at once when MBRGO_MAX_CONCURRENT_DUMPS is not set.
+	defaultStatusInterval     = time.Minute // Interval of the status reports of the daemon when MBRGO_STATUS_INTERVAL is not set.
+	statusFileName            = "status.json"
+)
+
+// Full backup states of a target reported by the daemon.
+const (
+	dumpStateIdle    = "idle"    // No full backup is running.
+	dumpStateWaiting = "waiting" // A full backup waits for another target's dump to finish.
+	dumpStateRunning = "running" // A full backup is running.
+)
+
+// targetName matches the names of the targets, which are also used as directory names and storage prefixes.
+var targetName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// validateTargetName checks that a target name can be used as a directory name and storage prefix.
+//
+// Parameters:
+// - name: The target name.
+//
+// Returns:
+// - error: An error if the name is empty, too long or contains other characters than letters, digits, "_", "." and "-".
+func validateTargetName(name string) error {
+	if !targetName.MatchString(name) {
+		return fmt.Errorf("invalid target name %q: use up to 64 letters, digits, '_', '.' and '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// applyTarget applies the settings of a target over the environment. Unless the target sets its own, its backup
+// directory and storage prefix are those of the shared settings followed by the target name, so targets never
+// share a checkpoint or a backup chain.
+//
+// Parameters:
+// - name: The target.
+//
+// Returns:
+// - func(): Restores the environment as it was before.
+// - error: An error if the target is not defined or one of its settings is invalid.
+func (c *configFile) applyTarget(name string) (func(), error) {
+	settings, err := c.targetSettings(name)
+	if err != nil {
+		return nil, err
+	}
+	saved := os.Environ()
+	defaults := map[string]string{"STORAGE_PREFIX": path.Join(os.Getenv("STORAGE_PREFIX"), name)}
+	if dir := os.Getenv("MYSQL_BACKUP_PATH"); dir != "" {
+		defaults["MYSQL_BACKUP_PATH"] = filepath.Join(dir, name)
+	}
+	applySettings(defaults, true)
+	applySettings(settings, true)
+	return func() { restoreEnvironment(saved) }, nil
+}
+
+// restoreEnvironment replaces the environment with a saved one, including the variables set since.
+//
+// Parameters:
+// - saved: The environment as returned by os.Environ.
+func restoreEnvironment(saved []string) {
+	os.Clearenv()
+	for _, kv := range saved {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// logf logs a line through the logger of the target, prefixed with its name, or the standard logger outside the daemon.
+//
+// Parameters:
+// - format: The format of the line, as for log.Printf.
+// - v: The values formatted.
+func (db *DB) logf(format string, v ...any) {
+	if db.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	db.logger.Printf(format, v...)
+}
+
+// dumpLimiter caps the number of full dumps running at once across the targets of the daemon, so a fleet of
+// servers scheduled at the same hour does not saturate the host, the network or the storage.
+//
+// Fields:
+// - slots: Holds one element per running dump; its capacity is the limit.
+// - mu: Guards states.
+// - states: The full backup state of each target waiting for or holding a slot.
+type dumpLimiter struct {
+	slots  chan struct{}
+	mu     sync.Mutex
+	states map[string]string
+}
+
+// newDumpLimiter creates a limit on the full dumps running at once.
+//
+// Parameters:
+// - limit: The number of dumps allowed to run at once, at least 1.
+//
+// Returns:
+// - *dumpLimiter: The limit.
+func newDumpLimiter(limit int) *dumpLimiter {
+	return &dumpLimiter{slots: make(chan struct{}, limit), states: map[string]string{}}
+}
+
+// acquire waits for a dump slot. A nil limiter does not limit anything.
+//
+// Parameters:
+// - ctx: The context cancelling the wait.
+// - name: The target taking the slot.
+//
+// Returns:
+// - func(): Releases the slot once the dump finished.
+// - error: An error if ctx is cancelled before a slot is free.
+func (l *dumpLimiter) acquire(ctx context.Context, name string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		log.Printf("[%s] %d full backups running, waiting for one to finish", name, cap(l.slots))
+		l.setState(name, dumpStateWaiting)
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.setState(name, "")
+			return nil, ctx.Err()
+		}
+	}
+	l.setState(name, dumpStateRunning)
+	return func() {
+		l.setState(name, "")
+		<-l.slots
+	}, nil
+}
+
+// setState records the full backup state of a target.
+//
+// Parameters:
+// - name: The target.
+// - state: The state, empty once the target holds no slot.
+func (l *dumpLimiter) setState(name, state string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state == "" {
+		delete(l.states, name)
+	} else {
+		l.states[name] = state
+	}
+}
+
+// state returns the full backup state of a target.
+//
+// Parameters:
+// - name: The target.
+//
+// Returns:
+// - string: One of idle, waiting or running.
+func (l *dumpLimiter) state(name string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state, ok := l.states[name]; ok {
+		return state
+	}
+	return dumpStateIdle
+}
+
+// DaemonOptions holds the settings of the daemon shared by every target.
+//
+// Fields:
+// - MaxConcurrentDumps: The number of full dumps running at once across all targets.
+// - StatusFile: The file the status of every target is written to.
+// - StatusInterval: The interval at which the status is logged and written.
+type DaemonOptions struct {
+	MaxConcurrentDumps int
+	StatusFile         string
+	StatusInterval     time.Duration
+}
+
+// daemonFromEnv reads the daemon settings from MBRGO_MAX_CONCURRENT_DUMPS, MBRGO_STATUS_FILE and MBRGO_STATUS_INTERVAL.
+//
+// Parameters:
+// - backupDir: The parent of the backup directories of the targets, holding the status file by default.
+//
+// Returns:
+// - DaemonOptions: The daemon settings.
+// - error: An error if a value is malformed.
+func daemonFromEnv(backupDir string) (DaemonOptions, error) {
+	opts := DaemonOptions{
+		MaxConcurrentDumps: defaultMaxConcurrentDumps,
+		StatusFile:         os.Getenv("MBRGO_STATUS_FILE"),
+		StatusInterval:     defaultStatusInterval,
+	}
+	if v := os.Getenv("MBRGO_MAX_CONCURRENT_DUMPS"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return opts, fmt.Errorf("invalid MBRGO_MAX_CONCURRENT_DUMPS: %s, should be a positive integer", v)
+		}
+		opts.MaxConcurrentDumps = limit
+	}
+	if v := os.Getenv("MBRGO_STATUS_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return opts, fmt.Errorf("invalid MBRGO_STATUS_INTERVAL: %s", v)
+		}
+		opts.StatusInterval = interval
+	}
+	if opts.StatusFile == "" && backupDir != "" {
+		opts.StatusFile = filepath.Join(backupDir, statusFileName)
+	}
+	return opts, nil
+}
+
+// Target is a server managed by the daemon, with its own connection, schedule, backup directory, storage prefix
+// and binlog archiver.
+//
+// Fields:
+// - Name: The name of the target in the configuration file.
+// - DB: The database configuration of the target.
+// - DBConn: The database connection of the target.
+// - Weekday: The day of the week of the full backup.
+// - Hour: The time of day of the full backup.
+// - BackupDir: The local directory of the backups and checkpoint of the target.
+// - StoragePrefix: The key prefix of the backups of the target in the storage.
+// - storageRoot: The bucket or directory holding the storage prefix, telling whether two targets share a storage.
+// - scheduler: The scheduler of the full and incremental backups, nil until the daemon runs.
+type Target struct {
+	Name          string
+	DB            *DB
+	DBConn        *sql.DB
+	Weekday       string
+	Hour          string
+	BackupDir     string
+	StoragePrefix string
+	storageRoot   string
+	scheduler     *BackupScheduler
+}
+
+// openTarget sets up a target from the environment, once the settings of the target are applied.
+//
+// Parameters:
+// - name: The target.
+//
+// Returns:
+// - *Target: The target, connected lazily like the single server commands.
+// - error: An error if a setting is invalid or missing, or the storage cannot be initialized.
+func openTarget(name string) (*Target, error) {
+	weekday, hour, err := scheduleFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule: %w", err)
+	}
+	if weekday == "" || hour == "" {
+		return nil, fmt.Errorf("schedule.weekday and schedule.hour are required")
+	}
+	backupDir := os.Getenv("MYSQL_BACKUP_PATH")
+	if backupDir == "" {
+		return nil, fmt.Errorf("backup_dir is required, or backup-local-dir for the daemon")
+	}
+
+	mysqlDB, dbConn, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	mysqlDB.Name = name
+	mysqlDB.logger = log.New(log.Writer(), "["+name+"] ", log.Flags()|log.Lmsgprefix)
+	storageRoot := "s3:" + os.Getenv("AWS_S3_ENDPOINT") + "/" + os.Getenv("AWS_S3_BUCKET")
+	if os.Getenv("STORAGE_BACKEND") == "fs" {
+		storageRoot = "fs:" + filepath.Clean(os.Getenv("STORAGE_FS_ROOT"))
+	}
+	return &Target{
+		Name:          name,
+		DB:            mysqlDB,
+		DBConn:        dbConn,
+		Weekday:       weekday,
+		Hour:          hour,
+		BackupDir:     filepath.Clean(backupDir),
+		StoragePrefix: strings.Trim(os.Getenv("STORAGE_PREFIX"), "/"),
+		storageRoot:   storageRoot,
+	}, nil
+}
+
+// overlaps reports whether two targets would mix their backups: the same backup directory, or storage prefixes
+// of which one contains the other in the same bucket or directory. Catalogs and retention work on everything below
+// a prefix, so a target would list and prune the backups of the other.
+//
+// Parameters:
+// - other: The other target.
+//
+// Returns:
+// - error: An error describing what the targets share, nil if they are apart.
+func (t *Target) overlaps(other *Target) error {
+	if t.BackupDir == other.BackupDir {
+		return fmt.Errorf("targets %s and %s use the same backup directory %s", t.Name, other.Name, t.BackupDir)
+	}
+	if t.storageRoot != other.storageRoot {
+		return nil
+	}
+	a, b := t.StoragePrefix+"/", other.StoragePrefix+"/"
+	if t.StoragePrefix == "" || other.StoragePrefix == "" || strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+		return fmt.Errorf("targets %s and %s store their backups below the same storage prefix (%q and %q)", t.Name, other.Name, t.StoragePrefix, other.StoragePrefix)
+	}
+	return nil
+}
+
+// loadTargets sets up every target of the configuration file, each with the shared settings, the environment and
+// its own settings.
+//
+// Parameters:
+// - cfg: The configuration file.
+//
+// Returns:
+// - []*Target: The targets, sorted by name.
+// - error: An error naming the first target that cannot be set up.
+func loadTargets(cfg *configFile) ([]*Target, error) {
+	var targets []*Target
+	for _, name := range cfg.targetNames() {
+		target, err := loadTarget(cfg, name)
+		if err != nil {
+			closeTargets(targets)
+			return nil, fmt.Errorf("target %s: %w", name, err)
+		}
+		for _, other := range targets {
+			if err := target.overlaps(other); err != nil {
+				closeTargets(append(targets, target))
+				return nil, err
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// loadTarget sets up one target, with its settings applied to the environment only while it is read.
+//
+// Parameters:
+// - cfg: The configuration file.
+// - name: The target.
+//
+// Returns:
+// - *Target: The target.
+// - error: An error if the target cannot be set up.
+func loadTarget(cfg *configFile, name string) (*Target, error) {
+	restore, err := cfg.applyTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+	if err := resolveSecretEnv(); err != nil {
+		return nil, fmt.Errorf("invalid secrets configuration: %w", err)
+	}
+	registerSecretsFromEnv()
+	return openTarget(name)
+}
+
+// closeTargets closes the connections and SSH tunnels of the targets.
+//
+// Parameters:
+// - targets: The targets.
+func closeTargets(targets []*Target) {
+	for _, t := range targets {
+		t.DBConn.Close()
+		t.DB.closeTunnel()
+	}
+}
+
+// TargetStatus reports the state of a target of the daemon.
+//
+// Fields:
+// - Name: The name of the target.
+// - Server: The address of the server, with the SSH server it is reached through.
+// - Schedule: The weekday and time of the full backup.
+// - BackupDir: The local directory of the backups of the target.
+// - StoragePrefix: The key prefix of the backups of the target in the storage.
+// - FullBackup: The state of the full backup: idle, waiting for a dump slot, or running.
+// - SchedulerStatus: The times of the full backups and the state of the incremental backup.
+type TargetStatus struct {
+	Name          string `json:"name"`
+	Server        string `json:"server"`
+	Schedule      string `json:"schedule"`
+	BackupDir     string `json:"backup_dir"`
+	StoragePrefix string `json:"storage_prefix"`
+	FullBackup    string `json:"full_backup"`
+	SchedulerStatus
+}
+
+// DaemonStatus is the content of the status file of the daemon.
+//
+// Fields:
+// - UpdatedAt: The time the status was taken.
+// - MaxConcurrentDumps: The number of full dumps running at once across all targets.
+// - Targets: The status of each target, sorted by name.
+type DaemonStatus struct {
+	UpdatedAt          time.Time      `json:"updated_at"`
+	MaxConcurrentDumps int            `json:"max_concurrent_dumps"`
+	Targets            []TargetStatus `json:"targets"`
+}
+
+// Status returns the state of the target.
+//
+// Parameters:
+// - dumps: The dump limit of the daemon, reporting whether the target waits for or runs a full dump.
+//
+// Returns:
+// - TargetStatus: A snapshot of the state.
+func (t *Target) Status(dumps *dumpLimiter) TargetStatus {
+	_, server := t.DB.serverAddress()
+	if t.DB.tunnel != nil {
+		server += " via ssh " + t.DB.SSH.Host
+	}
+	status := TargetStatus{
+		Name:          t.Name,
+		Server:        server,
+		Schedule:      t.Weekday + " " + t.Hour,
+		BackupDir:     t.BackupDir,
+		StoragePrefix: t.StoragePrefix,
+		FullBackup:    dumps.state(t.Name),
+	}
+	if t.scheduler != nil {
+		status.SchedulerStatus = t.scheduler.Status()
+	}
+	return status
+}
+
+// summary formats the status of a target as a single log line.
+//
+// Returns:
+// - string: The status line.
+func (s TargetStatus) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] full backup %s", s.Name, s.FullBackup)
+	if !s.LastFullBackup.IsZero() {
+		if s.LastFullBackupError != "" {
+			fmt.Fprintf(&b, ", last failed at %s: %s", s.LastFullBackup.Format(time.RFC3339), s.LastFullBackupError)
+		} else {
+			fmt.Fprintf(&b, ", last at %s", s.LastFullBackup.Format(time.RFC3339))
+		}
+	}
+	if !s.NextFullBackup.IsZero() {
+		fmt.Fprintf(&b, ", next at %s", s.NextFullBackup.Format(time.RFC3339))
+	}
+	inc := s.Incremental
+	switch {
+	case !inc.Running:
+		b.WriteString("; incremental not running")
+	case inc.Connected:
+		fmt.Fprintf(&b, "; incremental at %s:%d, lag %s", inc.BinlogFile, inc.Position, inc.Lag.Round(time.Second))
+	default:
+		fmt.Fprintf(&b, "; incremental disconnected since %s: %s", inc.DisconnectedSince.Format(time.RFC3339), inc.LastError)
+	}
+	return b.String()
+}
+
+// runDaemon runs the schedule of every target until ctx is cancelled, logging and writing the status of every
+// target at each status interval. On shutdown, every target finishes or aborts its full backup and stores the
+// last chunk and checkpoint of its incremental backup, within its shutdown timeout.
+//
+// Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
+// - targets: The targets.
+// - opts: The daemon settings.
+//
+// Returns:
+// - error: An error if the schedule of a target is invalid, otherwise nil once every target stopped.
+func runDaemon(ctx context.Context, targets []*Target, opts DaemonOptions) error {
+	dumps := newDumpLimiter(opts.MaxConcurrentDumps)
+	for _, t := range targets {
+		scheduler, err := NewBackupScheduler(t.DB, t.DBConn, t.Weekday, t.Hour, t.BackupDir)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		t.scheduler = scheduler
+		t.DB.dumps = dumps
+	}
+
+	log.Printf("daemon started with %d targets, at most %d full backups at once", len(targets), opts.MaxConcurrentDumps)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		// Renew leased credentials and pick up rotated ones while the daemon runs.
+		go t.DB.renewCredentials(ctx)
+		wg.Add(1)
+		go func(t *Target) {
+			defer wg.Done()
+			log.Printf("[%s] backup scheduler enabled every %s at %s", t.Name, t.Weekday, t.Hour)
+			t.scheduler.Run(ctx)
+		}(t)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	ticker := time.NewTicker(opts.StatusInterval)
+	defer ticker.Stop()
+	reportStatus(targets, dumps, opts, false)
+	for {
+		select {
+		case <-ticker.C:
+			reportStatus(targets, dumps, opts, true)
+		case <-stopped:
+			reportStatus(targets, dumps, opts, true)
+			log.Print("daemon stopped")
+			return nil
+		}
+	}
+}
+
+// reportStatus writes the status of every target to the status file, and logs it.
+//
+// Parameters:
+// - targets: The targets.
+// - dumps: The dump limit of the daemon.
+// - opts: The daemon settings.
+// - logIt: A boolean indicating whether the status is logged as well.
+func reportStatus(targets []*Target, dumps *dumpLimiter, opts DaemonOptions, logIt bool) {
+	status := DaemonStatus{UpdatedAt: time.Now().UTC(), MaxConcurrentDumps: opts.MaxConcurrentDumps}
+	for _, t := range targets {
+		targetStatus := t.Status(dumps)
+		status.Targets = append(status.Targets, targetStatus)
+		if logIt {
+			log.Print(targetStatus.summary())
+		}
+	}
+	if opts.StatusFile == "" {
+		return
+	}
+	if err := writeStatusFile(opts.StatusFile, status); err != nil {
+		log.Printf("failed to write status file: %v", err)
+	}
+}
+
+// writeStatusFile writes the status of the daemon to a file, replacing it atomically.
+//
+// Parameters:
+// - path: The status file.
+// - status: The status.
+//
+// Returns:
+// - error: An error if the file cannot be written.
+func writeStatusFile(path string, status DaemonStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+	return writeFileAtomic(path, bytes.NewReader(append(data, '\n')))
+}
+
+// readStatusFile reads the status written by a running daemon.
+//
+// Parameters:
+// - path: The status file.
+//
+// Returns:
+// - DaemonStatus: The status.
+// - error: An error if the file cannot be read or decoded.
+func readStatusFile(path string) (DaemonStatus, error) {
+	var status DaemonStatus
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return status, fmt.Errorf("failed to read status file: %w", err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("failed to decode status file %s: %w", path, err)
+	}
+	return status, nil
+}
+
+// writeStatusTable writes the status of the targets of the daemon as a human readable table.
+//
+// Parameters:
+// - w: The writer receiving the table.
+// - status: The status of the daemon.
+//
+// Returns:
+// - error: An error if writing fails, otherwise nil.
+func writeStatusTable(w io.Writer, status DaemonStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSERVER\tFULL BACKUP\tLAST FULL BACKUP\tNEXT FULL BACKUP\tINCREMENTAL\tBINLOG\tLAG")
+	for _, t := range status.Targets {
+		last := "-"
+		if !t.LastFullBackup.IsZero() {
+			last = t.LastFullBackup.Local().Format("2006-01-02 15:04")
+			if t.LastFullBackupError != "" {
+				last += " (failed)"
+			}
+		}
+		next := "-"
+		if !t.NextFullBackup.IsZero() {
+			next = t.NextFullBackup.Local().Format("2006-01-02 15:04")
+		}
+		incremental, binlog, lag := "stopped", "-", "-"
+		if t.Incremental.Running {
+			incremental = "disconnected"
+			if t.Incremental.Connected {
+				incremental = "connected"
+				lag = t.Incremental.Lag.Round(time.Second).String()
+			}
+			if t.Incremental.BinlogFile != "" {
+				binlog = fmt.Sprintf("%s:%d", t.Incremental.BinlogFile, t.Incremental.Position)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Name, t.Server, t.FullBackup, last, next, incremental, binlog, lag)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "updated %s, at most %d full backups at once\n", status.UpdatedAt.Local().Format("2006-01-02 15:04:05"), status.MaxConcurrentDumps)
+	return err
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	encryptionAlgorithm = "AES-256-GCM-STREAM" // Algorithm recorded in the metadata of encrypted files.
+	encryptionChunkSize = 64 * 1024            // Size of the plaintext segments sealed independently.
+	encryptionMagic     = "MBRGOENC1"          // Header identifying the encrypted stream format.
+)
+
+// Encryption holds the keys used to encrypt new backups and decrypt existing ones.
+// Backups are encrypted either with a symmetric master key or to a set of age recipients.
+//
+// Fields:
+// - MasterKey: The 32 byte AES-256 master key, empty when master key encryption is disabled.
+// - KeyID: The identifier of the master key, recorded next to each encrypted file.
+// - AgeRecipients: The age public keys new backups are encrypted to, empty when age encryption is disabled.
+// - AgeRecipientNames: The configured public keys of AgeRecipients, recorded next to each encrypted file.
+// - AgeIdentities: The age private keys used to decrypt backups at restore time.
+type Encryption struct {
+	MasterKey         []byte
+	KeyID             string
+	AgeRecipients     []age.Recipient
+	AgeRecipientNames []string
+	AgeIdentities     []age.Identity
+}
+
+// encryptionMeta is the metadata needed to decrypt a file, stored next to it.
+//
+// Fields:
+// - Algorithm: The encryption algorithm of the file.
+// - KeyID: The identifier of the master key that wrapped the data key.
+// - WrappedKey: The base64 encoded data key, encrypted with the master key.
+// - ChunkSize: The size of the plaintext segments.
+type encryptionMeta struct {
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"key_id"`
+	WrappedKey string `json:"wrapped_key"`
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+// encryptionFromEnv reads the encryption settings from the environment.
+// The master key comes from BACKUP_ENCRYPTION_KEY_FILE or BACKUP_ENCRYPTION_KEY and may be given as
+// 64 hex characters, base64 or, in a key file, 32 raw bytes. Age recipients and identities are read
+// by ageRecipientsFromEnv and from BACKUP_AGE_IDENTITY_FILE.
+//
+// Returns:
+// - Encryption: The encryption settings, disabled when no key is configured.
+// - error: An error if a key cannot be read or both encryption modes are configured.
+func encryptionFromEnv() (Encryption, error) {
+	var enc Encryption
+	var err error
+
+	enc.AgeRecipients, enc.AgeRecipientNames, err = ageRecipientsFromEnv()
+	if err != nil {
+		return enc, err
+	}
+	if identityFile := os.Getenv("BACKUP_AGE_IDENTITY_FILE"); identityFile != "" {
+		enc.AgeIdentities, err = loadAgeIdentities(strings.Split(identityFile, ","))
+		if err != nil {
+			return enc, err
+		}
+	}
+
+	var raw []byte
+	if keyFile := os.Getenv("BACKUP_ENCRYPTION_KEY_FILE"); keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return enc, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		raw = data
+	} else if key := os.Getenv("BACKUP_ENCRYPTION_KEY"); key != "" {
+		raw = []byte(key)
+	} else {
+		return enc, nil
+	}
+
+	if len(enc.AgeRecipients) > 0 {
+		return enc, fmt.Errorf("configure either an encryption master key or age recipients, not both")
+	}
+
+	masterKey, err := parseMasterKey(raw)
+	if err != nil {
+		return enc, err
+	}
+	enc.MasterKey = masterKey
+
+	enc.KeyID = os.Getenv("BACKUP_ENCRYPTION_KEY_ID")
+	if enc.KeyID == "" {
+		// Derive a stable identifier so restores can tell keys apart without revealing them.
+		sum := sha256.Sum256(masterKey)
+		enc.KeyID = hex.EncodeToString(sum[:8])
+	}
+	return enc, nil
+}
+
+// parseMasterKey decodes a master key given as hex, base64 or raw bytes.
+//
+// Parameters:
+// - raw: The encoded key.
+//
+// Returns:
+// - []byte: The 32 byte master key.
+// - error: An error if the key does not decode to 32 bytes.
+func parseMasterKey(raw []byte) ([]byte, error) {
+	if len(raw) == 32 {
+		return raw, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 32 bytes, encoded as hex or base64")
+}
+
+// Enabled reports whether backups are encrypted with the master key.
+//
+// Returns:
+// - bool: True if a master key is configured, otherwise false.
+func (e Encryption) Enabled() bool {
+	return len(e.MasterKey) > 0
+}
+
+// AgeEnabled reports whether backups are encrypted to age recipients.
+//
+// Returns:
+// - bool: True if at least one age recipient is configured, otherwise false.
+func (e Encryption) AgeEnabled() bool {
+	return len(e.AgeRecipients) > 0
+}
+
+// NewWriter generates a fresh data key and wraps w so that everything written is encrypted with it.
+// Closing the returned writer seals the final segment but does not close w.
+//
+// Parameters:
+// - w: The writer receiving the encrypted stream.
+//
+// Returns:
+// - io.WriteCloser: The encrypting writer.
+// - *encryptionMeta: The metadata needed to decrypt the stream, including the wrapped data key.
+// - error: An error if the data key cannot be generated or wrapped.
+func (e Encryption) NewWriter(w io.Writer) (io.WriteCloser, *encryptionMeta, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrapped, err := sealWithKey(e.MasterKey, dataKey, []byte(e.KeyID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return nil, nil, err
+	}
+
+	meta := &encryptionMeta{
+		Algorithm:  encryptionAlgorithm,
+		KeyID:      e.KeyID,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		ChunkSize:  encryptionChunkSize,
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptionChunkSize)}, meta, nil
+}
+
+// NewReader unwraps the data key described by meta and returns a reader decrypting r.
+//
+// Parameters:
+// - r: The reader over the encrypted stream.
+// - meta: The metadata stored next to the encrypted file.
+//
+// Returns:
+// - io.Reader: The decrypting reader. It fails if the stream was modified or truncated.
+// - error: An error if the master key does not match or the data key cannot be unwrapped.
+func (e Encryption) NewReader(r io.Reader, meta *encryptionMeta) (io.Reader, error) {
+	if meta == nil || meta.Algorithm != encryptionAlgorithm || meta.ChunkSize <= 0 {
+		return nil, fmt.Errorf("unsupported encryption metadata")
+	}
+	if !e.Enabled() {
+		return nil, fmt.Errorf("file is encrypted with key %s but no encryption key is configured", meta.KeyID)
+	}
+	if meta.KeyID != e.KeyID {
+		return nil, fmt.Errorf("file is encrypted with key %s but the configured key is %s", meta.KeyID, e.KeyID)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(meta.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	dataKey, err := openWithKey(e.MasterKey, wrapped, []byte(meta.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != encryptionMagic {
+		return nil, fmt.Errorf("not an encrypted backup stream")
+	}
+	return &decryptReader{r: br, aead: aead, chunkSize: meta.ChunkSize}, nil
+}
+
+// newGCM creates an AES-256-GCM cipher for key.
+//
+// Parameters:
+// - key: The 32 byte key.
+//
+// Returns:
+// - cipher.AEAD: The AEAD cipher.
+// - error: An error if the key is invalid.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithKey encrypts plaintext with key under a random nonce, which is prepended to the result.
+//
+// Parameters:
+// - key: The 32 byte key.
+// - plaintext: The data to encrypt.
+// - additionalData: Data authenticated but not encrypted.
+//
+// Returns:
+// - []byte: The nonce followed by the ciphertext.
+// - error: An error if encryption fails.
+func sealWithKey(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openWithKey reverses sealWithKey.
+//
+// Parameters:
+// - key: The 32 byte key.
+// - sealed: The nonce followed by the ciphertext.
+// - additionalData: The data authenticated when sealing.
+//
+// Returns:
+// - []byte: The plaintext.
+// - error: An error if the ciphertext is invalid or the key is wrong.
+func openWithKey(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// segmentNonce builds the nonce of a segment: an 11 byte big-endian counter followed by a final flag.
+// Binding the position and the final flag into the nonce detects reordered or truncated streams.
+//
+// Parameters:
+// - counter: The index of the segment.
+// - final: Whether the segment is the last one of the stream.
+//
+// Returns:
+// - []byte: The 12 byte nonce.
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals everything written to it in fixed size segments.
+//
+// Fields:
+// - w: The writer receiving the sealed segments.
+// - aead: The cipher keyed with the data key.
+// - buf: The plaintext of the segment being filled.
+// - counter: The index of the next segment.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// Write buffers p, sealing each segment once it is full and more data follows.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the remaining plaintext as the final segment.
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+// flush seals the buffered plaintext and writes it out.
+//
+// Parameters:
+// - final: Whether the segment is the last one of the stream.
+//
+// Returns:
+// - error: An error if the segment cannot be written.
+func (e *encryptWriter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.counter, final), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader opens the sealed segments read from r.
+//
+// Fields:
+// - r: The reader over the sealed segments.
+// - aead: The cipher keyed with the data key.
+// - chunkSize: The size of the plaintext segments.
+// - counter: The index of the next segment.
+// - plain: The decrypted data not yet returned to the caller.
+// - done: Set once the final segment has been opened.
+type decryptReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	chunkSize int
+	counter   uint64
+	plain     []byte
+	done      bool
+}
+
+// Read returns decrypted data, failing if a segment was modified or the stream ends before the final segment.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next sealed segment.
+//
+// Returns:
+// - error: An error if the segment cannot be read or authenticated.
+func (d *decryptReader) next() error {
+	sealed := make([]byte, d.chunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	final := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one only if nothing follows it.
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			final = true
+		}
+	}
+
+	plain, err := d.aead.Open(nil, segmentNonce(d.counter, final), sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted stream is corrupted or truncated at segment %d", d.counter)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+// isEncryptedName reports whether a stored file name carries the encryption extension.
+//
+// Parameters:
+// - name: The stored file name or storage key.
+//
+// Returns:
+// - bool: True if the file is encrypted, otherwise false.
+func isEncryptedName(name string) bool {
+	return strings.HasSuffix(name, ".enc")
+}
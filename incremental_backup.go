@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
@@ -15,29 +22,474 @@ import (
 const (
 	bufferSize  = 2 * 1024 * 1024  // Size of the buffer for binlog events.
 	maxFileSize = 10 * 1024 * 1024 // Maximum size of a single backup file.
+
+	defaultHeartbeatPeriod     = 30 * time.Second // Default interval of the heartbeats sent by the server on an idle binlog stream.
+	reconnectInitialBackoff    = time.Second      // Delay before the first attempt to reconnect a lost binlog stream.
+	defaultReconnectMaxBackoff = 2 * time.Minute  // Default longest delay between two attempts to reconnect.
 )
 
-var (
-	buffer        = make([]byte, 0, bufferSize) // Buffer to store binlog events.
-	currentSize   int64                         // Current size of the backup file.
-	fileIndex     = 0                           // Index for naming backup files.
-	currentFile   *os.File                      // Current backup file being written to.
-	currentBinlog = "binlog.000001"             // Current binlog file being processed.
+// Transaction states of the binlog stream, used to tell whether the current backup file ends with a complete transaction.
+const (
+	txnNone     = iota // Between transactions.
+	txnStarting        // After a GTID event, until it is known whether an explicit transaction follows.
+	txnOpen            // Inside a transaction ended by a XID event or a COMMIT or ROLLBACK statement.
 )
 
-// openNewFile creates a new backup file in the specified directory.
+// errConnectionLost marks a failure of the binlog connection, after which the stream is resumed from the last rotated backup file.
+var errConnectionLost = errors.New("binlog connection lost")
+
+// ArchiverStatus reports the state of a BinlogArchiver.
+//
+// Fields:
+// - Running: A boolean indicating whether the archiver is running.
+// - Connected: A boolean indicating whether the binlog stream is connected.
+// - BinlogFile: The binlog file of the last received event.
+// - Position: The position following the last received event.
+// - LastEventTime: The time the last received event was written on the server.
+// - Lag: How far the stream is behind the server: 0 after a heartbeat, the age of the last event otherwise.
+// - Disconnects: The number of times the binlog connection was lost.
+// - ChainBreaks: The number of times the binlogs to resume from were gone and a new chain was started.
+// - DisconnectedSince: The time the binlog connection was lost, zero while connected.
+// - LastError: The last error of the binlog connection, empty if none.
+type ArchiverStatus struct {
+	Running           bool          `json:"running"`
+	Connected         bool          `json:"connected"`
+	BinlogFile        string        `json:"binlog_file"`
+	Position          uint32        `json:"position"`
+	LastEventTime     time.Time     `json:"last_event_time"`
+	Lag               time.Duration `json:"lag"`
+	Disconnects       int           `json:"disconnects"`
+	ChainBreaks       int           `json:"chain_breaks"`
+	DisconnectedSince time.Time     `json:"disconnected_since"`
+	LastError         string        `json:"last_error,omitempty"`
+}
+
+// BinlogArchiver streams the binary log of a MySQL server into binlog chunks and stores them in the storage backend.
+// All state of the stream is held by the archiver, so several servers can be archived from one process, each
+// with its own archiver and backup directory.
+//
+// Fields:
+// - db: The database configuration object holding the connection settings, storage backend and codecs.
+// - dbConn: The database connection object, used to identify the server.
+// - backupDir: The directory where backup files and the checkpoint are stored.
+// - buffer: Buffer to store binlog events.
+// - currentSize: Current size of the backup file.
+// - fileIndex: Index for naming backup files.
+// - currentFile: Current backup file being written to.
+// - currentBinlog: Current binlog file being processed.
+// - chunkGTIDs: GTIDs of the complete transactions in the current backup file.
+// - txnGTID: GTID of the transaction being written, added to chunkGTIDs once the transaction is complete.
+// - headerSize: Size of the binlog header events at the start of the current backup file.
+// - txnStartSize: Size of the current backup file before the last transaction started.
+// - txnStartPos: Stream position before the last transaction started.
+// - txnStartTime: Time of the last event before the last transaction started.
+// - streamPos: Position following the last event written to the current backup file.
+// - resumePos: Position following the last rotated backup file, where a lost stream is resumed.
+// - lastEventTime: Time of the last event written to the current backup file.
+// - archivedGTIDs: GTID set executed up to the last rotated backup file, nil if unknown.
+// - checkpointFile: Path of the checkpoint file updated after each stored backup file.
+// - serverUUID: UUID of the server the binlog is read from.
+// - formatDesc: Format description event of the current binlog, written at the start of each backup file.
+// - previousGTIDs: Previous GTIDs event of the current binlog, written after the format description event.
+// - txn: The transaction state of the stream (txnNone, txnStarting or txnOpen).
+// - received: A boolean indicating whether the current connection has delivered an event.
+// - chainRestarted: A boolean indicating whether a new chain was started and has not delivered an event yet.
+// - uploader: Uploader storing rotated backup files in the background.
+// - liveUpload: Upload of the current backup file, nil unless live upload is enabled.
+// - mu: Guards cancel, done and status.
+// - cancel: Cancels the running stream, nil when the archiver is not running.
+// - done: Closed when the running stream has stopped.
+// - status: The state of the stream reported by Status.
+type BinlogArchiver struct {
+	db        *DB
+	dbConn    *sql.DB
+	backupDir string
+
+	buffer         []byte
+	currentSize    int64
+	fileIndex      int
+	currentFile    *os.File
+	currentBinlog  string
+	chunkGTIDs     mysql.GTIDSet
+	txnGTID        mysql.GTIDSet
+	headerSize     int64
+	txnStartSize   int64
+	txnStartPos    mysql.Position
+	txnStartTime   time.Time
+	streamPos      mysql.Position
+	resumePos      mysql.Position
+	lastEventTime  time.Time
+	archivedGTIDs  mysql.GTIDSet
+	checkpointFile string
+	serverUUID     string
+	formatDesc     []byte
+	previousGTIDs  []byte
+	txn            int
+	received       bool
+	chainRestarted bool
+	uploader       *binlogUploader
+	liveUpload     *liveChunk
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	status ArchiverStatus
+}
+
+// NewBinlogArchiver creates a BinlogArchiver.
 //
 // Parameters:
-// - dirPath: The directory where the new backup file will be created.
+// - db: The database configuration object holding the connection settings, storage backend and codecs.
+// - dbConn: The database connection object, used to identify the server.
+// - backupDir: The directory where backup files and the checkpoint are stored.
+//
+// Returns:
+// - *BinlogArchiver: The archiver, ready to Run.
+func NewBinlogArchiver(db *DB, dbConn *sql.DB, backupDir string) *BinlogArchiver {
+	return &BinlogArchiver{
+		db:             db,
+		dbConn:         dbConn,
+		backupDir:      backupDir,
+		buffer:         make([]byte, 0, bufferSize),
+		currentBinlog:  "binlog.000001",
+		checkpointFile: checkpointPath(backupDir),
+	}
+}
+
+// Run streams binlog events until ctx is cancelled, Stop is called or an error occurs.
+// It resumes from the checkpoint left by a previous run, or from the position of the last full backup.
+// A lost connection is re-established with an increasing delay, resuming after the last rotated backup file.
+// On return, the current backup file is stored if it ends with a complete transaction, and every rotated
+// backup file has been stored.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+//
+// Returns:
+// - error: An error if the incremental backup process fails, otherwise nil.
+func (a *BinlogArchiver) Run(ctx context.Context) error {
+	a.mu.Lock()
+	if a.done != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("binlog archiver for %s is already running", a.backupDir)
+	}
+	ctx, a.cancel = context.WithCancel(ctx)
+	a.done = make(chan struct{})
+	a.status = ArchiverStatus{}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.cancel()
+		close(a.done)
+		a.cancel, a.done = nil, nil
+		a.status.Connected = false
+		a.mu.Unlock()
+	}()
+
+	a.db.logf("MySQL incremental backup started...")
+	metadataFile := fmt.Sprintf("%s/binlog_position.txt", a.backupDir)
+	pos, gtidSet, err := a.startPosition(metadataFile)
+	if err != nil {
+		return err
+	}
+	if err := a.resetPosition(pos, gtidSet); err != nil {
+		return fmt.Errorf("cannot resume from %s: %w", metadataFile, err)
+	}
+
+	a.uploader = newBinlogUploader(a.db, a.checkpointFile, a.db.UploadQueueSize)
+	streamErr := a.stream(ctx)
+	// Backup files already rotated are still stored, so the checkpoint covers them on restart.
+	if err := a.uploader.close(); err != nil && streamErr == nil {
+		streamErr = err
+	}
+	if streamErr != nil {
+		a.mu.Lock()
+		a.status.LastError = streamErr.Error()
+		a.mu.Unlock()
+	}
+	return streamErr
+}
+
+// Stop stops the running stream and waits until Run has stored the backup files and returned.
+// It does nothing if the archiver is not running.
+func (a *BinlogArchiver) Stop() {
+	a.mu.Lock()
+	cancel, done := a.cancel, a.done
+	a.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Status reports the state of the archiver. It is safe to call while the archiver is running.
+//
+// Returns:
+// - ArchiverStatus: The connection state, position and lag of the stream.
+func (a *BinlogArchiver) Status() ArchiverStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := a.status
+	status.Running = a.done != nil
+	// No heartbeat arrives while disconnected, so the stream falls further behind.
+	if !status.Connected && !status.LastEventTime.IsZero() {
+		status.Lag = time.Since(status.LastEventTime)
+	}
+	return status
+}
+
+// stream runs the binlog stream, reconnecting with an exponentially increasing delay, up to the configured
+// maximum, whenever the connection is lost. The delay starts over once a connection delivers events again.
+// When the binlogs to resume from are gone, a new chain is started from a fresh full backup.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+//
+// Returns:
+// - error: An error if the stream cannot be resumed or a backup file cannot be stored, otherwise nil once ctx is cancelled.
+func (a *BinlogArchiver) stream(ctx context.Context) error {
+	maxBackoff := a.db.ReconnectMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultReconnectMaxBackoff
+	}
+	backoff := reconnectInitialBackoff
+	for {
+		err := a.connect(ctx)
+		if a.received {
+			a.chainRestarted = false
+		}
+		if errors.Is(err, errChainBroken) {
+			a.discardChunk()
+			a.disconnected(err)
+			// A chain broken again before any event was archived would only lead to another full backup.
+			if a.chainRestarted {
+				return err
+			}
+			if err := a.restartChain(ctx, err); err != nil {
+				return err
+			}
+			a.chainRestarted = true
+			backoff = reconnectInitialBackoff
+			continue
+		}
+		if !errors.Is(err, errConnectionLost) {
+			return err
+		}
+		a.discardChunk()
+		a.disconnected(err)
+		if a.received {
+			backoff = reconnectInitialBackoff
+		}
+		a.db.logf("%v, reconnecting from %s in %s", err, a.resumeDescription(), backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.db.logf("incremental backup cancelled.")
+			return nil
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect checks that the binlogs to resume from are still on the server and that no other replica uses the
+// server ID, then opens a binlog connection, from the GTID set in GTID mode and from the binlog position otherwise,
+// and streams its events.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+//
+// Returns:
+// - error: An error wrapping errConnectionLost if the connection failed and may be retried, errChainBroken if
+// the binlogs to resume from are gone, another error if the stream cannot go on, otherwise nil once ctx is cancelled.
+func (a *BinlogArchiver) connect(ctx context.Context) error {
+	a.received = false
+	if err := a.checkChain(); err != nil {
+		return err
+	}
+	if err := checkServerID(a.dbConn, a.db.serverID(), a.db.flavor()); err != nil {
+		return err
+	}
+
+	cfg, err := a.db.binlogSyncerConfig()
+	if err != nil {
+		return err
+	}
+	syncer := replication.NewBinlogSyncer(cfg)
+	defer syncer.Close()
+
+	var streamer *replication.BinlogStreamer
+	if a.db.GTIDMode {
+		a.db.logf("resuming incremental backup from GTID set: %s", a.archivedGTIDs.String())
+		streamer, err = syncer.StartSyncGTID(a.archivedGTIDs.Clone())
+	} else {
+		streamer, err = syncer.StartSync(a.resumePos)
+	}
+	if err != nil {
+		if fatal := streamFatalError(err); fatal != nil {
+			return fatal
+		}
+		return fmt.Errorf("%w: failed to start binlog sync: %v", errConnectionLost, err)
+	}
+	a.connected()
+	return a.streamData(ctx, streamer)
+}
+
+// streamFatalError tells apart the errors of the binlog connection that reconnecting cannot fix.
+//
+// Parameters:
+// - err: The error returned by the binlog connection.
+//
+// Returns:
+// - error: The error to stop the archiver with, nil if the connection may be retried.
+func streamFatalError(err error) error {
+	var myErr *mysql.MyError
+	if !errors.As(err, &myErr) {
+		return nil
+	}
+	switch myErr.Code {
+	case mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG:
+		if isServerIDConflict(myErr) {
+			// Reconnecting would disconnect the other replica in turn.
+			return fmt.Errorf("%w: another replica connected with the same server ID: %w", errServerIDConflict, err)
+		}
+		// Typically the binlogs holding the next event were purged, so the chain of backups is broken.
+		return fmt.Errorf("%w: server can no longer send the binlogs to resume from: %w", errChainBroken, err)
+	case mysql.ER_ACCESS_DENIED_ERROR, mysql.ER_DBACCESS_DENIED_ERROR, mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR:
+		return fmt.Errorf("not allowed to read the binlog: %w", err)
+	}
+	return nil
+}
+
+// resumeDescription describes where a lost stream is resumed, for logging.
+//
+// Returns:
+// - string: The GTID set in GTID mode, the binlog position otherwise.
+func (a *BinlogArchiver) resumeDescription() string {
+	if a.db.GTIDMode {
+		return fmt.Sprintf("GTID set %s", a.archivedGTIDs.String())
+	}
+	return fmt.Sprintf("%s:%d", a.resumePos.Name, a.resumePos.Pos)
+}
+
+// connected records that the binlog stream is connected.
+func (a *BinlogArchiver) connected() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.status.DisconnectedSince.IsZero() {
+		a.db.logf("binlog stream reconnected after %s", time.Since(a.status.DisconnectedSince).Round(time.Second))
+	}
+	a.status.Connected = true
+	a.status.DisconnectedSince = time.Time{}
+}
+
+// disconnected records that the binlog connection was lost.
+//
+// Parameters:
+// - err: The error of the binlog connection.
+func (a *BinlogArchiver) disconnected(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.status.Connected {
+		a.status.Disconnects++
+		a.status.DisconnectedSince = time.Now()
+	} else if a.status.DisconnectedSince.IsZero() {
+		a.status.DisconnectedSince = time.Now()
+	}
+	a.status.Connected = false
+	a.status.LastError = err.Error()
+}
+
+// recordEvent updates the reported position and lag after an event was received.
+//
+// Parameters:
+// - ev: The received binlog event.
+func (a *BinlogArchiver) recordEvent(ev *replication.BinlogEvent) {
+	a.received = true
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status.BinlogFile = a.streamPos.Name
+	a.status.Position = a.streamPos.Pos
+	if ev.Header.EventType == replication.HEARTBEAT_EVENT {
+		// The server only sends heartbeats once it has sent every event.
+		a.status.Lag = 0
+		return
+	}
+	if ev.Header.Timestamp > 0 {
+		a.status.LastEventTime = time.Unix(int64(ev.Header.Timestamp), 0).UTC()
+		a.status.Lag = max(time.Since(a.status.LastEventTime), 0)
+	}
+}
+
+// startPosition determines where the stream resumes: the checkpoint of a previous run if there is one,
+// otherwise the position saved by the last full backup.
+//
+// Parameters:
+// - metadataFile: The path to the binlog position file of the last full backup.
+//
+// Returns:
+// - mysql.Position: The binlog position to resume from.
+// - string: The executed GTID set to resume from, empty if unknown.
+// - error: An error if the checkpoint cannot be read or belongs to another server.
+func (a *BinlogArchiver) startPosition(metadataFile string) (mysql.Position, string, error) {
+	pos, gtidSet := getLastBinlogPosition(metadataFile)
+
+	var err error
+	if a.db.flavor() == mysql.MySQLFlavor {
+		a.serverUUID, err = queryServerUUID(a.dbConn)
+		if err != nil {
+			a.db.logf("error fetching server UUID: %v", err)
+		}
+	}
+	checkpoint, err := loadCheckpoint(a.checkpointFile)
+	if err != nil {
+		return pos, gtidSet, err
+	}
+	if checkpoint == nil {
+		return pos, gtidSet, nil
+	}
+
+	if checkpoint.ServerUUID != "" && a.serverUUID != "" && checkpoint.ServerUUID != a.serverUUID {
+		// Binlog positions are only meaningful on the server that wrote them, GTIDs are not.
+		if !a.db.GTIDMode {
+			return pos, gtidSet, fmt.Errorf("checkpoint %s belongs to server %s but connected to %s, remove it to resume from the last full backup", a.checkpointFile, checkpoint.ServerUUID, a.serverUUID)
+		}
+		a.db.logf("checkpoint %s belongs to server %s, resuming on %s by GTID set", a.checkpointFile, checkpoint.ServerUUID, a.serverUUID)
+	}
+	pos = mysql.Position{Name: checkpoint.BinlogFile, Pos: checkpoint.Position}
+	if checkpoint.GTIDSet != "" {
+		gtidSet = checkpoint.GTIDSet
+	}
+	a.db.logf("resuming incremental backup from checkpoint after %s: %s at %d", checkpoint.LastChunk, pos.Name, pos.Pos)
+	return pos, gtidSet, nil
+}
+
+// openNewFile creates a new backup file in the backup directory.
+// When live upload is enabled, the upload of the file to the storage backend starts right away.
 //
 // Returns:
-// - *os.File: The newly created file.
 // - error: An error if the file creation fails.
-func openNewFile(dirPath string) (*os.File, error) {
-	filename := fmt.Sprintf("%s/incr_backup_%s_%d_%s.log", dirPath, currentBinlog, fileIndex, time.Now().Format("20060102_150405"))
-	fileIndex++
-	log.Printf("rotating to new file: %s", filename)
-	return os.Create(filename)
+func (a *BinlogArchiver) openNewFile() error {
+	filename := fmt.Sprintf("%s/incr_backup_%s_%d_%s.log", a.backupDir, a.currentBinlog, a.fileIndex, time.Now().Format("20060102_150405"))
+	a.fileIndex++
+	a.db.logf("rotating to new file: %s", filename)
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if a.db.LiveUpload {
+		a.liveUpload, err = startLiveChunk(a.db, filepath.Base(filename))
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to start upload of %s: %w", filename, err)
+		}
+	}
+	a.currentFile = file
+	a.currentSize = 0
+	return nil
 }
 
 // streamData streams binlog events from the MySQL server and writes them to backup files.
@@ -45,167 +497,427 @@ func openNewFile(dirPath string) (*os.File, error) {
 // Parameters:
 // - ctx: The context for managing cancellations.
 // - streamer: The binlog streamer instance.
-// - dirPath: The directory where backup files will be stored.
-func streamData(ctx context.Context, streamer *replication.BinlogStreamer, dirPath string) {
-	log.Print("streaming data started...")
-	var err error
-	currentFile, err = openNewFile(dirPath)
-	if err != nil {
-		log.Fatalf("cannot create backup file: %v", err)
+//
+// Returns:
+// - error: An error wrapping errConnectionLost if the connection failed, another error if a backup file cannot be
+// written or stored or the server cannot send the binlog, otherwise nil once ctx is cancelled.
+func (a *BinlogArchiver) streamData(ctx context.Context, streamer *replication.BinlogStreamer) error {
+	a.db.logf("streaming data started...")
+	if err := a.openNewFile(); err != nil {
+		return fmt.Errorf("cannot create backup file: %w", err)
 	}
-	defer currentFile.Close()
+	defer func() {
+		a.currentFile.Close()
+		if a.currentSize == 0 {
+			os.Remove(a.currentFile.Name())
+		}
+		// Events of an unfinished backup file are streamed again from the checkpoint on restart.
+		if a.liveUpload != nil {
+			a.liveUpload.abort(errors.New("incremental backup stopped"))
+			a.liveUpload = nil
+		}
+	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("incremental backup cancelled.")
-			return
+			a.db.logf("incremental backup cancelled.")
+			return a.flush()
 		default:
 			ev, err := streamer.GetEvent(ctx)
 			if err != nil {
-				log.Printf("error getting binlog event: %v", err)
-				continue
+				if ctx.Err() != nil {
+					continue
+				}
+				if fatal := streamFatalError(err); fatal != nil {
+					return fatal
+				}
+				return fmt.Errorf("%w: %v", errConnectionLost, err)
+			}
+			a.db.logf("received binlog event: %T", ev.Event)
+			if err := a.processEvent(ev); err != nil {
+				return err
 			}
-			log.Printf("received binlog event: %T", ev.Event)
-			processEvent(ev, currentFile, dirPath)
+			a.recordEvent(ev)
+		}
+	}
+}
+
+// flush stores the current backup file when the stream stops, so the checkpoint covers every complete transaction
+// received. A transaction still open is cut off the file and streamed again from the checkpoint on restart.
+//
+// Returns:
+// - error: An error if the backup file cannot be written or queued for upload.
+func (a *BinlogArchiver) flush() error {
+	if a.txn != txnNone {
+		if a.txnStartSize <= a.headerSize {
+			a.db.logf("stopping inside the first transaction of %s, it is streamed again on restart", a.currentFile.Name())
+			return nil
+		}
+		a.db.logf("stopping inside a transaction, storing %s up to %s:%d", a.currentFile.Name(), a.txnStartPos.Name, a.txnStartPos.Pos)
+		if err := a.truncateOpenTransaction(); err != nil {
+			return err
+		}
+	}
+	return a.rotateFile()
+}
+
+// truncateOpenTransaction cuts the events of the open transaction off the current backup file.
+// Events already sent to a live upload cannot be taken back, so the live upload is aborted and the local
+// file is uploaded instead.
+//
+// Returns:
+// - error: An error if the backup file cannot be truncated.
+func (a *BinlogArchiver) truncateOpenTransaction() error {
+	if a.txnStartSize >= a.currentSize {
+		a.buffer = a.buffer[:a.txnStartSize-a.currentSize]
+	} else {
+		a.buffer = a.buffer[:0]
+		if err := a.currentFile.Truncate(a.txnStartSize); err != nil {
+			return fmt.Errorf("failed to truncate backup file: %w", err)
+		}
+		if _, err := a.currentFile.Seek(a.txnStartSize, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to truncate backup file: %w", err)
+		}
+		a.currentSize = a.txnStartSize
+		if a.liveUpload != nil {
+			a.liveUpload.abort(errors.New("backup file truncated"))
+			a.liveUpload = nil
 		}
 	}
+	a.streamPos, a.lastEventTime = a.txnStartPos, a.txnStartTime
+	a.txn, a.txnGTID = txnNone, nil
+	return nil
+}
+
+// discardChunk drops the current backup file after the connection was lost.
+// Its events are streamed again once reconnected, from the end of the last rotated backup file.
+func (a *BinlogArchiver) discardChunk() {
+	if a.currentSize > 0 {
+		a.db.logf("discarding unfinished backup file %s", a.currentFile.Name())
+		os.Remove(a.currentFile.Name())
+	}
+	a.buffer = a.buffer[:0]
+	a.currentSize = 0
+	a.chunkGTIDs = nil
+	a.txn, a.txnGTID = txnNone, nil
+	a.streamPos = a.resumePos
+	if a.resumePos.Name != "" {
+		a.currentBinlog = a.resumePos.Name
+	}
 }
 
 // processEvent processes a single binlog event and writes it to the backup file.
+// Backup files are only rotated before a transaction starts, so every stored file ends with a complete transaction.
+// Each backup file is a valid binlog file on its own: it starts with the binlog magic bytes, the format description
+// event and the previous GTIDs event of the binlog its events belong to.
 //
 // Parameters:
 // - ev: The binlog event to process.
-// - currentFile: The current backup file being written to.
-// - dirPath: The directory where backup files are stored.
-func processEvent(ev *replication.BinlogEvent, currentFile *os.File, dirPath string) {
+//
+// Returns:
+// - error: An error if the event cannot be written or a rotated backup file cannot be queued for upload, otherwise nil.
+func (a *BinlogArchiver) processEvent(ev *replication.BinlogEvent) error {
 	if rotateEv, ok := ev.Event.(*replication.RotateEvent); ok {
-		log.Printf("received RotateEvent: switching to new binlog file: %s", string(rotateEv.NextLogName))
-		if len(buffer) > 0 {
-			writeBufferToFile(currentFile)
+		a.db.logf("received RotateEvent: switching to new binlog file: %s", string(rotateEv.NextLogName))
+		if string(rotateEv.NextLogName) != a.currentBinlog {
+			// A stream resumed within a binlog does not repeat its previous GTIDs event.
+			a.previousGTIDs = nil
 		}
-		rotateFile(currentFile, dirPath)
-		currentBinlog = string(rotateEv.NextLogName)
-		return
+		// Name the next file after the binlog whose events it holds.
+		a.currentBinlog = string(rotateEv.NextLogName)
+		a.streamPos = mysql.Position{Name: a.currentBinlog, Pos: uint32(rotateEv.Position)}
+		a.txn, a.txnGTID = txnNone, nil
+		return a.rotateFile()
+	}
+
+	switch ev.Header.EventType {
+	case replication.FORMAT_DESCRIPTION_EVENT:
+		fde, err := chunkFormatDescription(ev)
+		if err != nil {
+			return err
+		}
+		a.formatDesc = fde
+		return nil
+	case replication.PREVIOUS_GTIDS_EVENT, replication.MARIADB_GTID_LIST_EVENT:
+		a.previousGTIDs = append([]byte(nil), ev.RawData...)
+		return nil
+	case replication.HEARTBEAT_EVENT:
+		return nil
+	}
+	// Artificial events are generated by the server for the stream and are not part of the binlog.
+	if ev.Header.Flags&replication.LOG_EVENT_ARTIFICIAL_F != 0 {
+		return nil
+	}
+
+	if isTransactionStart(ev.Header.EventType) && a.currentSize+int64(len(a.buffer)) >= maxFileSize {
+		if err := a.rotateFile(); err != nil {
+			return err
+		}
+	}
+
+	if a.currentSize+int64(len(a.buffer)) == 0 {
+		if a.formatDesc == nil {
+			return fmt.Errorf("no format description event received before %s:%d", a.currentBinlog, ev.Header.LogPos)
+		}
+		a.buffer = append(a.buffer, replication.BinLogFileHeader...)
+		a.buffer = append(a.buffer, a.formatDesc...)
+		a.buffer = append(a.buffer, a.previousGTIDs...)
+		a.headerSize = int64(len(a.buffer))
 	}
 
+	if isTransactionStart(ev.Header.EventType) {
+		// Remember the last transaction boundary, so a stream stopped mid-transaction can store the file up to it.
+		a.txnStartSize = a.currentSize + int64(len(a.buffer))
+		a.txnStartPos, a.txnStartTime = a.streamPos, a.lastEventTime
+	}
+
+	if gtidEv, ok := ev.Event.(mysql.BinlogGTIDEvent); ok {
+		a.trackChunkGTID(gtidEv)
+	}
+	a.trackTransaction(ev)
+
 	raw := ev.RawData
-	buffer = append(buffer, raw...)
-	StreamBinlogToS3(buffer, currentFile.Name())
+	a.buffer = append(a.buffer, raw...)
 
-	if len(buffer) >= bufferSize {
-		writeBufferToFile(currentFile)
+	if ev.Header.LogPos > 0 {
+		a.streamPos = mysql.Position{Name: a.currentBinlog, Pos: ev.Header.LogPos}
+		a.lastEventTime = time.Unix(int64(ev.Header.Timestamp), 0).UTC()
 	}
 
-	if currentSize >= maxFileSize {
-		rotateFile(currentFile, dirPath)
+	if len(a.buffer) >= bufferSize {
+		if err := a.writeBufferToFile(); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("processed event: %T at pos %d", ev.Event, ev.Header.LogPos)
+	a.db.logf("processed event: %T at pos %d", ev.Event, ev.Header.LogPos)
+	return nil
 }
 
-// writeBufferToFile writes the buffered binlog data to the current backup file.
+// trackTransaction follows the transaction boundaries of the stream.
+// A transaction starts with a GTID event and ends with a XID event, a COMMIT or ROLLBACK statement,
+// or, for a single statement such as DDL, with that statement.
 //
 // Parameters:
-// - currentFile: The current backup file being written to.
-func writeBufferToFile(currentFile *os.File) {
-	n, err := currentFile.Write(buffer)
+// - ev: The binlog event being written.
+func (a *BinlogArchiver) trackTransaction(ev *replication.BinlogEvent) {
+	switch e := ev.Event.(type) {
+	case *replication.MariadbGTIDEvent:
+		// MariaDB writes no BEGIN statement, the GTID event tells whether a COMMIT follows.
+		if e.IsStandalone() {
+			a.txn = txnStarting
+		} else {
+			a.txn = txnOpen
+		}
+	case *replication.GTIDEvent:
+		a.txn = txnStarting
+	case *replication.XIDEvent:
+		a.txn = txnNone
+	case *replication.QueryEvent:
+		query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+		switch {
+		case query == "BEGIN":
+			a.txn = txnOpen
+		case a.txn != txnOpen || query == "COMMIT" || query == "ROLLBACK":
+			a.txn = txnNone
+		}
+	default:
+		switch ev.Header.EventType {
+		case replication.ANONYMOUS_GTID_EVENT:
+			a.txn = txnStarting
+		case replication.XA_PREPARE_LOG_EVENT:
+			a.txn = txnNone
+		}
+	}
+	if a.txn == txnNone {
+		a.completeTransaction()
+	}
+}
+
+// writeBufferToFile writes the buffered binlog data to the current backup file, and to its live upload if any.
+//
+// Returns:
+// - error: An error if the data cannot be written.
+func (a *BinlogArchiver) writeBufferToFile() error {
+	n, err := a.currentFile.Write(a.buffer)
 	if err != nil {
-		log.Printf("failed writing to backup file: %v", err)
-		return
+		return fmt.Errorf("failed writing to backup file: %w", err)
+	}
+	if a.liveUpload != nil {
+		if _, err := a.liveUpload.Write(a.buffer); err != nil {
+			return fmt.Errorf("failed uploading backup file: %w", err)
+		}
 	}
-	currentSize += int64(n)
-	buffer = buffer[:0]
+	a.currentSize += int64(n)
+	a.buffer = a.buffer[:0]
+	return nil
 }
 
-// rotateFile closes the current backup file and creates a new one.
+// rotateFile closes the current backup file, queues it for upload and creates a new one.
+// The checkpoint is advanced by the uploader once the file is stored; an empty file is removed instead.
+// Queuing waits while the upload queue is full, which holds up the binlog stream until the storage catches up.
 //
-// Parameters:
-// - file: The current backup file to be rotated.
-// - dirPath: The directory where the new backup file will be created.
-func rotateFile(file *os.File, dirPath string) {
-	if len(buffer) > 0 {
-		if _, err := file.Write(buffer); err != nil {
-			log.Printf("failed flushing remaining data: %v", err)
+// Returns:
+// - error: An error if the backup file cannot be written or a previous backup file could not be stored.
+func (a *BinlogArchiver) rotateFile() error {
+	if len(a.buffer) > 0 {
+		if err := a.writeBufferToFile(); err != nil {
+			return err
 		}
-		buffer = buffer[:0]
 	}
-	file.Close()
-	rotatedFileName := currentFile.Name()
+	a.currentFile.Close()
+	rotatedFileName := a.currentFile.Name()
 
-	go func(fileName string) {
-		data, err := os.ReadFile(currentFile.Name())
+	job := chunkUpload{path: rotatedFileName, name: filepath.Base(rotatedFileName), live: a.liveUpload}
+	a.liveUpload = nil
+	if a.currentSize == 0 {
+		job.discard(errors.New("empty backup file"))
+		os.Remove(rotatedFileName)
+	} else {
+		if a.chunkGTIDs != nil {
+			job.gtidSet = a.chunkGTIDs.String()
+		}
+		checkpoint, err := a.streamCheckpoint(job.name)
 		if err != nil {
-			log.Printf("Error reading backup file: %v", err)
-			return
+			job.discard(err)
+			return err
 		}
-		logFile := filepath.Base(fileName)
-		UploadBufferToS3(data, logFile)
-	}(rotatedFileName)
+		job.checkpoint = checkpoint
+		if err := a.uploader.enqueue(job); err != nil {
+			return err
+		}
+	}
+	a.chunkGTIDs = nil
+	a.resumePos = a.streamPos
 
-	var err error
-	currentFile, err = openNewFile(dirPath)
+	if err := a.openNewFile(); err != nil {
+		return fmt.Errorf("cannot create new backup file: %w", err)
+	}
+	return nil
+}
+
+// streamCheckpoint builds the checkpoint recording the end of the current backup file.
+//
+// Parameters:
+// - chunk: The name of the backup file.
+//
+// Returns:
+// - *binlogCheckpoint: The checkpoint to write once the backup file is stored.
+// - error: An error if the GTID set of the backup file cannot be merged.
+func (a *BinlogArchiver) streamCheckpoint(chunk string) (*binlogCheckpoint, error) {
+	if a.archivedGTIDs != nil && a.chunkGTIDs != nil {
+		if err := a.archivedGTIDs.Update(a.chunkGTIDs.String()); err != nil {
+			return nil, fmt.Errorf("failed to update archived GTID set: %w", err)
+		}
+	}
+
+	checkpoint := &binlogCheckpoint{
+		BinlogFile:    a.streamPos.Name,
+		Position:      a.streamPos.Pos,
+		ServerUUID:    a.serverUUID,
+		LastEventTime: a.lastEventTime,
+		LastChunk:     chunk,
+	}
+	if a.archivedGTIDs != nil {
+		checkpoint.GTIDSet = a.archivedGTIDs.String()
+	}
+	return checkpoint, nil
+}
+
+// trackChunkGTID records the GTID of the transaction being written.
+//
+// Parameters:
+// - ev: The GTID event starting the transaction.
+func (a *BinlogArchiver) trackChunkGTID(ev mysql.BinlogGTIDEvent) {
+	next, err := ev.GTIDNext()
 	if err != nil {
-		log.Fatalf("Cannot create new backup file: %v", err)
+		a.db.logf("error reading GTID of transaction: %v", err)
+		return
+	}
+	a.txnGTID = next
+}
+
+// completeTransaction adds the GTID of the transaction just completed to the GTID set of the current backup file.
+func (a *BinlogArchiver) completeTransaction() {
+	if a.txnGTID == nil {
+		return
+	}
+	if a.chunkGTIDs == nil {
+		a.chunkGTIDs = a.txnGTID
+	} else if err := a.chunkGTIDs.Update(a.txnGTID.String()); err != nil {
+		a.db.logf("error tracking GTID %s: %v", a.txnGTID.String(), err)
+	}
+	a.txnGTID = nil
+}
+
+// chunkFormatDescription prepares a format description event to be written at the start of a backup file.
+// The binlog-in-use flag is cleared, as the backup file is complete once stored, and the checksum is recomputed.
+//
+// Parameters:
+// - ev: The format description event received from the server.
+//
+// Returns:
+// - []byte: The raw event to write at the start of each backup file.
+// - error: An error if the event is malformed.
+func chunkFormatDescription(ev *replication.BinlogEvent) ([]byte, error) {
+	fde, ok := ev.Event.(*replication.FormatDescriptionEvent)
+	if !ok || len(ev.RawData) < replication.EventHeaderSize+replication.BinlogChecksumLength {
+		return nil, fmt.Errorf("malformed format description event")
+	}
+
+	raw := append([]byte(nil), ev.RawData...)
+	flags := binary.LittleEndian.Uint16(raw[17:19]) &^ replication.LOG_EVENT_BINLOG_IN_USE_F
+	binary.LittleEndian.PutUint16(raw[17:19], flags)
+	if fde.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 {
+		body := len(raw) - replication.BinlogChecksumLength
+		binary.LittleEndian.PutUint32(raw[body:], crc32.ChecksumIEEE(raw[:body]))
 	}
-	currentSize = 0
+	return raw, nil
 }
 
-// getLastBinlogPosition retrieves the last binlog position from the metadata file.
+// getLastBinlogPosition retrieves the last binlog position and executed GTID set from the metadata file.
+// The GTID set is read from an optional second line, so files written before GTID mode still load.
 //
 // Parameters:
 // - metadataFile: The path to the metadata file.
 //
 // Returns:
 // - mysql.Position: The last binlog position.
-func getLastBinlogPosition(metadataFile string) mysql.Position {
-	file, err := os.Open(metadataFile)
+// - string: The executed GTID set, empty if none was recorded.
+func getLastBinlogPosition(metadataFile string) (mysql.Position, string) {
+	data, err := os.ReadFile(metadataFile)
 	if err != nil {
 		log.Printf("failed to open binlog metadata file: %v", err)
 	}
-	defer file.Close()
 
+	lines := strings.SplitN(string(data), "\n", 3)
 	var binlogFile string
 	var binlogPos uint32
-	_, err = fmt.Fscanf(file, "%s %d", &binlogFile, &binlogPos)
+	_, err = fmt.Sscanf(lines[0], "%s %d", &binlogFile, &binlogPos)
 	if err != nil {
 		log.Printf("error reading binlog position: %v", err)
 	}
+	var gtidSet string
+	if len(lines) > 1 {
+		gtidSet = strings.TrimSpace(lines[1])
+	}
 
 	log.Printf("resuming incremental backup from binlog file: %s at position %d", binlogFile, binlogPos)
 
-	return mysql.Position{Name: binlogFile, Pos: binlogPos}
+	return mysql.Position{Name: binlogFile, Pos: binlogPos}, gtidSet
 }
 
 // MysqlIncrementalBackup starts an incremental backup by streaming binlog events.
+// It runs a BinlogArchiver for backupDir until ctx is cancelled.
 //
 // Parameters:
 // - ctx: The context for managing cancellations.
+// - dbConn: The database connection object, used to identify the server.
 // - backupDir: The directory where backup files will be stored.
 //
 // Returns:
 // - error: An error if the incremental backup process fails, otherwise nil.
-func (db *DB) MysqlIncrementalBackup(ctx context.Context, backupDir string) error {
-	log.Print("MySQL incremental backup started...")
-	cfg := replication.BinlogSyncerConfig{
-		ServerID: 100,
-		Flavor:   "mysql",
-		Host:     db.Host,
-		Port:     uint16(db.Port),
-		User:     db.User,
-		Password: db.Password,
-	}
-
-	metadataFile := fmt.Sprintf("%s/binlog_position.txt", backupDir)
-
-	pos := getLastBinlogPosition(metadataFile)
-
-	syncer := replication.NewBinlogSyncer(cfg)
-
-	streamer, err := syncer.StartSync(pos)
-	if err != nil {
-		return fmt.Errorf("failed to start binlog sync: %w", err)
-	}
-	streamData(ctx, streamer, backupDir)
-	return nil
+func (db *DB) MysqlIncrementalBackup(ctx context.Context, dbConn *sql.DB, backupDir string) error {
+	return NewBinlogArchiver(db, dbConn, backupDir).Run(ctx)
 }
@@ -3,50 +3,197 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
+	"time"
 )
 
 // main is the entry point of the application.
-// It initializes the database configuration, validates it, and handles CLI arguments.
+// It loads the configuration, initializes the database configuration, validates it, and handles CLI arguments.
 func main() {
+	// Every log line goes through the redaction of the secrets registered below.
+	log.SetOutput(redactingWriter{out: os.Stderr})
 	log.Print("service started...")
 
-	// Load environment variables from the .env file.
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("error loading .env file: ", err)
+	opts, cliArgs, err := parseGlobalOptions(os.Args[1:])
+	if err != nil {
+		log.Fatal("invalid options: ", err)
+	}
+
+	// Load environment variables from the .env file, if any.
+	if err := loadDotEnv(opts.EnvFile); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the configuration file and the settings given with --set.
+	cfg, flagSettings, profile, err := loadConfiguration(opts)
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	// Validating the configuration needs neither the database nor the storage backend.
+	if len(cliArgs) > 0 && cliArgs[0] == "config" {
+		if err := configCli(cliArgs, cfg, profile, flagSettings); err != nil {
+			log.Fatalf("config failed: %v", err)
+		}
+		return
+	}
+
+	// The configuration file is overridden by the environment, and both by --set.
+	if _, err := applyConfiguration(cfg, profile, flagSettings); err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	// The daemon reads the settings of each target itself.
+	if len(cliArgs) > 0 && cliArgs[0] == "daemon" {
+		if err := daemonCli(cliArgs, cfg); err != nil {
+			log.Fatalf("daemon failed: %v", err)
+		}
+		return
+	}
+	// A single command can be run against one target of the daemon, e.g. to restore it.
+	if opts.Target != "" {
+		if cfg == nil {
+			log.Fatalf("target %s selected without a config file", opts.Target)
+		}
+		if _, err := cfg.applyTarget(opts.Target); err != nil {
+			log.Fatal("invalid configuration: ", err)
+		}
+	}
+	// Read the secrets given as files or commands.
+	if err := resolveSecretEnv(); err != nil {
+		log.Fatal("invalid secrets configuration: ", err)
+	}
+	registerSecretsFromEnv()
+
+	// Decrypting a local file needs neither the database nor the storage backend.
+	if len(cliArgs) > 0 && cliArgs[0] == "decrypt" {
+		if err := decryptCli(cliArgs); err != nil {
+			log.Fatalf("decrypt failed: %v", err)
+		}
+		return
+	}
+
+	// Reading the status of the daemon only needs its status file.
+	if len(cliArgs) > 0 && cliArgs[0] == "status" {
+		if err := statusCli(cliArgs); err != nil {
+			log.Fatalf("status failed: %v", err)
+		}
+		return
+	}
+
+	// Initialize the database configuration, the storage backend and the connection to the MySQL database.
+	mysqlDB, dbConn, err := openDatabase()
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer dbConn.Close()
+	defer mysqlDB.closeTunnel()
+
+	// SIGINT and SIGTERM cancel the root context, so running backups can finish or be marked aborted.
+	ctx, stop := shutdownContext(mysqlDB.shutdownTimeout())
+	defer stop()
+
+	// Renew leased credentials and pick up rotated ones while the command runs.
+	go mysqlDB.renewCredentials(ctx)
+
+	// Handle CLI arguments.
+	if err := CliArgHandler(ctx, cliArgs, mysqlDB, dbConn); err != nil {
+		log.Fatalf("error handling cli arguments: %v", err)
+	}
+}
 
+// loadConfiguration reads the configuration file named by --config or MBRGO_CONFIG, and the settings given with --set.
+//
+// Parameters:
+// - opts: The options given before the command.
+//
+// Returns:
+// - *configFile: The configuration file, nil if none is given.
+// - map[string]string: The environment variables set with --set.
+// - string: The profile selected with --profile or MBRGO_PROFILE, empty if none.
+// - error: An error if the file cannot be read or a --set flag is invalid.
+func loadConfiguration(opts globalOptions) (*configFile, map[string]string, string, error) {
+	flagSettings, err := parseSettingFlags(opts.Settings)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	profile := opts.Profile
+	if profile == "" {
+		profile = os.Getenv(configProfileEnv)
+	}
+	path := opts.ConfigPath
+	if path == "" {
+		path = os.Getenv(configFileEnv)
+	}
+	if path == "" {
+		if profile != "" {
+			return nil, nil, "", fmt.Errorf("profile %s selected without a config file", profile)
+		}
+		return nil, flagSettings, "", nil
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	log.Printf("loaded config file %s", path)
+	return cfg, flagSettings, profile, nil
+}
+
+// openDatabase sets up the database configuration, codecs, retention policy and storage backend from the environment,
+// and opens the connection to the server.
+//
+// Returns:
+// - *DB: The database configuration.
+// - *sql.DB: The database connection, established when first used.
+// - error: An error if a setting is invalid or the storage backend cannot be initialized.
+func openDatabase() (*DB, *sql.DB, error) {
 	// Initialize the database configuration.
 	mysqlDB, err := initDb()
 	if err != nil {
-		log.Fatal("failed to initialize DB: ", err)
+		return nil, nil, fmt.Errorf("failed to initialize DB: %w", err)
 	}
 
 	// Validate the database configuration.
 	if err := mysqlDB.Validate(); err != nil {
-		log.Fatal("invalid DB configuration: ", err)
+		return nil, nil, fmt.Errorf("invalid DB configuration: %w", err)
 	}
 
-	// Create a connection to the MySQL database.
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/information_schema", mysqlDB.User, mysqlDB.Password, mysqlDB.Host, mysqlDB.Port)
-	dbConn, err := sql.Open("mysql", dsn)
+	// Read the compression settings applied to new backups.
+	mysqlDB.Compression, err = compressionFromEnv()
 	if err != nil {
-		log.Fatalf("failed to connect to MySQL: %v", err)
+		return nil, nil, fmt.Errorf("invalid compression configuration: %w", err)
 	}
-	defer dbConn.Close()
 
-	// Handle CLI arguments.
-	cliArgs := os.Args[1:]
-	if err := CliArgHandler(cliArgs, mysqlDB, dbConn); err != nil {
-		log.Fatalf("error handling cli arguments: %v", err)
+	// Read the keys used to encrypt new backups and decrypt existing ones.
+	mysqlDB.Encryption, err = encryptionFromEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encryption configuration: %w", err)
+	}
+
+	// Read the retention policy applied after scheduled full backups.
+	mysqlDB.Retention, err = retentionFromEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid retention configuration: %w", err)
+	}
+
+	// Initialize the storage backend holding the backups.
+	mysqlDB.Storage, err = newStorage(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize storage: %w", err)
 	}
+
+	// Create a connection to the MySQL database.
+	dbConn, err := mysqlDB.openConn()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	return mysqlDB, dbConn, nil
 }
 
 // initDb initializes the database configuration by reading environment variables.
@@ -56,9 +203,17 @@ func main() {
 // - error: An error if any required environment variable is missing or invalid.
 func initDb() (*DB, error) {
 	mysqlDB := &DB{
-		Host:     os.Getenv("MYSQL_HOST"),
-		User:     os.Getenv("MYSQL_USER"),
-		Password: os.Getenv("MYSQL_PASSWORD"),
+		Host:   os.Getenv("MYSQL_HOST"),
+		Socket: os.Getenv("MYSQL_SOCKET"),
+	}
+
+	var err error
+	mysqlDB.Credentials, err = credentialsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials configuration: %w", err)
+	}
+	if err := mysqlDB.loadCredentials(context.Background()); err != nil {
+		return nil, err
 	}
 
 	portStr := os.Getenv("MYSQL_PORT")
@@ -70,42 +225,139 @@ func initDb() (*DB, error) {
 		mysqlDB.Port = port
 	}
 
+	mysqlDB.Flavor = strings.ToLower(os.Getenv("MYSQL_FLAVOR"))
+	mysqlDB.Charset = os.Getenv("MYSQL_CHARSET")
+
+	serverIDStr := os.Getenv("MYSQL_SERVER_ID")
+	if serverIDStr != "" {
+		serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+		if err != nil || serverID == 0 {
+			return nil, fmt.Errorf("invalid MYSQL_SERVER_ID: %s", serverIDStr)
+		}
+		mysqlDB.ServerID = uint32(serverID)
+	}
+
+	mysqlDB.TLS, err = tlsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	mysqlDB.SSH, err = sshFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH tunnel configuration: %w", err)
+	}
+	if mysqlDB.SSH.Enabled() {
+		mysqlDB.tunnel = newSSHTunnel(mysqlDB.SSH)
+	}
+
+	gtidModeStr := os.Getenv("BACKUP_GTID_MODE")
+	if gtidModeStr != "" {
+		gtidMode, err := strconv.ParseBool(gtidModeStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing BACKUP_GTID_MODE: %v", err)
+		}
+		mysqlDB.GTIDMode = gtidMode
+	}
+
+	uploadQueueStr := os.Getenv("BACKUP_UPLOAD_QUEUE_SIZE")
+	if uploadQueueStr != "" {
+		uploadQueue, err := strconv.Atoi(uploadQueueStr)
+		if err != nil || uploadQueue < 1 {
+			return nil, fmt.Errorf("invalid BACKUP_UPLOAD_QUEUE_SIZE: %s", uploadQueueStr)
+		}
+		mysqlDB.UploadQueueSize = uploadQueue
+	}
+
+	liveUploadStr := os.Getenv("BACKUP_BINLOG_LIVE_UPLOAD")
+	if liveUploadStr != "" {
+		liveUpload, err := strconv.ParseBool(liveUploadStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing BACKUP_BINLOG_LIVE_UPLOAD: %v", err)
+		}
+		mysqlDB.LiveUpload = liveUpload
+	}
+
+	heartbeatStr := os.Getenv("BACKUP_BINLOG_HEARTBEAT_PERIOD")
+	if heartbeatStr != "" {
+		heartbeat, err := time.ParseDuration(heartbeatStr)
+		if err != nil || heartbeat <= 0 {
+			return nil, fmt.Errorf("invalid BACKUP_BINLOG_HEARTBEAT_PERIOD: %s", heartbeatStr)
+		}
+		mysqlDB.HeartbeatPeriod = heartbeat
+	}
+
+	readTimeoutStr := os.Getenv("BACKUP_BINLOG_READ_TIMEOUT")
+	if readTimeoutStr != "" {
+		readTimeout, err := time.ParseDuration(readTimeoutStr)
+		if err != nil || readTimeout <= 0 {
+			return nil, fmt.Errorf("invalid BACKUP_BINLOG_READ_TIMEOUT: %s", readTimeoutStr)
+		}
+		mysqlDB.ReadTimeout = readTimeout
+	}
+
+	maxBackoffStr := os.Getenv("BACKUP_BINLOG_RECONNECT_MAX_BACKOFF")
+	if maxBackoffStr != "" {
+		maxBackoff, err := time.ParseDuration(maxBackoffStr)
+		if err != nil || maxBackoff <= 0 {
+			return nil, fmt.Errorf("invalid BACKUP_BINLOG_RECONNECT_MAX_BACKOFF: %s", maxBackoffStr)
+		}
+		mysqlDB.ReconnectMaxBackoff = maxBackoff
+	}
+
+	shutdownTimeoutStr := os.Getenv("BACKUP_SHUTDOWN_TIMEOUT")
+	if shutdownTimeoutStr != "" {
+		shutdownTimeout, err := time.ParseDuration(shutdownTimeoutStr)
+		if err != nil || shutdownTimeout <= 0 {
+			return nil, fmt.Errorf("invalid BACKUP_SHUTDOWN_TIMEOUT: %s", shutdownTimeoutStr)
+		}
+		mysqlDB.ShutdownTimeout = shutdownTimeout
+	}
+
 	return mysqlDB, nil
 }
 
 // CliArgHandler processes the CLI arguments and executes the corresponding commands.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - cliArgs: The list of CLI arguments.
 // - mysqlDB: The database configuration object.
 // - dbConn: The database connection object.
 //
 // Returns:
 // - error: An error if the CLI arguments are invalid or the command execution fails.
-func CliArgHandler(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
+func CliArgHandler(ctx context.Context, cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 	if len(cliArgs) < 1 {
 		return fmt.Errorf("invalid argument, one of backup or restore must be provided")
 	}
 
 	switch cliArgs[0] {
 	case "backup":
-		if err := backupCli(cliArgs, mysqlDB, dbConn); err != nil {
+		if err := backupCli(ctx, cliArgs, mysqlDB, dbConn); err != nil {
 			return fmt.Errorf("database backup failed: %w", err)
 		}
 	case "restore":
-		if err := restoreCli(cliArgs, mysqlDB); err != nil {
+		if err := restoreCli(ctx, cliArgs, mysqlDB); err != nil {
 			return fmt.Errorf("database restore failed: %w", err)
 		}
 	case "incremental-backup":
-		if err := incrementalBackupCli(cliArgs, mysqlDB); err != nil {
+		if err := incrementalBackupCli(ctx, cliArgs, mysqlDB, dbConn); err != nil {
 			return fmt.Errorf("incremental backup failed: %w", err)
 		}
+	case "list-backups":
+		if err := listBackupsCli(cliArgs, mysqlDB); err != nil {
+			return fmt.Errorf("list backups failed: %w", err)
+		}
 	case "enable-all-backup-scheduler":
-		if err := allBacupCli(cliArgs, mysqlDB, dbConn); err != nil {
+		if err := allBacupCli(ctx, cliArgs, mysqlDB, dbConn); err != nil {
 			return fmt.Errorf("enable all backup scheduler failed: %w", err)
 		}
+	case "prune-backups":
+		if err := pruneBackupsCli(ctx, cliArgs, mysqlDB); err != nil {
+			return fmt.Errorf("prune backups failed: %w", err)
+		}
 	default:
-		return fmt.Errorf("invalid command: %s, should be one of backup, restore, incremental-backup, enable-all-backup-scheduler", cliArgs[0])
+		return fmt.Errorf("invalid command: %s, should be one of backup, restore, incremental-backup, list-backups, enable-all-backup-scheduler, prune-backups, daemon, status, decrypt, config", cliArgs[0])
 	}
 	return nil
 }
@@ -113,18 +365,19 @@ func CliArgHandler(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 // backupCli handles the "backup" CLI command.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - cliArgs: The list of CLI arguments.
 // - mysqlDB: The database configuration object.
 // - dbConn: The database connection object.
 //
 // Returns:
 // - error: An error if the backup process fails.
-func backupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
+func backupCli(ctx context.Context, cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 	if len(cliArgs) < 2 {
 		return fmt.Errorf("for backup, one of the all-database-full-backup, database=db_name, or databases=db1,db2,db3 must be provided")
 	}
 
-	var backupLocalDir string
+	backupLocalDir := os.Getenv("MYSQL_BACKUP_PATH")
 	for _, arg := range cliArgs[1:] {
 		if strings.HasPrefix(arg, "backup-local-dir=") {
 			parts := strings.SplitN(arg, "=", 2)
@@ -134,15 +387,11 @@ func backupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 		}
 	}
 
-	if backupLocalDir == "" {
-		return fmt.Errorf("for backup, backup-local-dir must be provided (e.g., backup-local-dir=your/path)")
-	}
-
 	arg := cliArgs[1]
 	switch {
 	case arg == "all-database-full-backup":
 		// All databases full backup
-		if err := mysqlDB.MysqlBackup(dbConn, true, "", nil, backupLocalDir); err != nil {
+		if err := mysqlDB.MysqlBackup(ctx, dbConn, true, "", nil, backupLocalDir); err != nil {
 			return fmt.Errorf("all database full backup failed: %w", err)
 		}
 	case strings.HasPrefix(arg, "database="):
@@ -152,7 +401,7 @@ func backupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 			return fmt.Errorf("invalid argument for single database backup. Usage: database=db_name")
 		}
 		database := parts[1]
-		if err := mysqlDB.MysqlBackup(dbConn, false, database, nil, backupLocalDir); err != nil {
+		if err := mysqlDB.MysqlBackup(ctx, dbConn, false, database, nil, backupLocalDir); err != nil {
 			return fmt.Errorf("database full backup failed: %w", err)
 		}
 	case strings.HasPrefix(arg, "databases="):
@@ -167,7 +416,7 @@ func backupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 			cleanedDatabase := strings.Trim(database, " ")
 			cleanedDbList = append(cleanedDbList, cleanedDatabase)
 		}
-		if err := mysqlDB.MysqlBackup(dbConn, false, "", cleanedDbList, backupLocalDir); err != nil {
+		if err := mysqlDB.MysqlBackup(ctx, dbConn, false, "", cleanedDbList, backupLocalDir); err != nil {
 			return fmt.Errorf("multiple databases full backup failed: %w", err)
 		}
 	default:
@@ -179,13 +428,14 @@ func backupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 // restoreCli handles the "restore" CLI command.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - cliArgs: The list of CLI arguments.
 // - mysqlDB: The database configuration object.
 //
 // Returns:
 // - error: An error if the restore process fails.
-func restoreCli(cliArgs []string, mysqlDB *DB) error {
-	var backupS3Dir, restoreDir string
+func restoreCli(ctx context.Context, cliArgs []string, mysqlDB *DB) error {
+	var backupS3Dir, restoreDir, restoreMode, identityFile, untilTime, untilPosition, untilGTID string
 	for _, arg := range cliArgs[1:] {
 		if strings.HasPrefix(arg, "backup-s3-dir=") {
 			parts := strings.SplitN(arg, "=", 2)
@@ -197,15 +447,66 @@ func restoreCli(cliArgs []string, mysqlDB *DB) error {
 			if len(parts) == 2 {
 				restoreDir = parts[1]
 			}
+		} else if strings.HasPrefix(arg, "restore-mode=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				restoreMode = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "identity-file=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				identityFile = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "until-time=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				untilTime = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "until-position=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				untilPosition = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "until-gtid=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				untilGTID = parts[1]
+			}
 		}
 	}
-	if backupS3Dir == "" || restoreDir == "" {
-		return fmt.Errorf("for restore, both backup-s3-dir and restore-dir must be provided (e.g., backup-s3-dir=your/s3/path restore-dir=/your/restore/path)")
+
+	if identityFile != "" {
+		identities, err := loadAgeIdentities(strings.Split(identityFile, ","))
+		if err != nil {
+			return err
+		}
+		mysqlDB.Encryption.AgeIdentities = append(mysqlDB.Encryption.AgeIdentities, identities...)
+	}
+
+	target, err := parseRecoveryTarget(untilTime, untilPosition, untilGTID)
+	if err != nil {
+		return err
+	}
+
+	var streaming bool
+	switch restoreMode {
+	case "", "download":
+		// A point-in-time recovery searches the whole storage for its full backup unless backup-s3-dir narrows it down.
+		if (backupS3Dir == "" && target == nil) || restoreDir == "" {
+			return fmt.Errorf("for restore, both backup-s3-dir and restore-dir must be provided (e.g., backup-s3-dir=your/s3/path restore-dir=/your/restore/path)")
+		}
+	case "stream":
+		if backupS3Dir == "" && target == nil {
+			return fmt.Errorf("for restore, backup-s3-dir must be provided (e.g., backup-s3-dir=your/s3/path)")
+		}
+		streaming = true
+	default:
+		return fmt.Errorf("invalid restore-mode: %s, should be one of download, stream", restoreMode)
 	}
 	arg := cliArgs[1]
 	switch {
 	case arg == "all-database-full-restore":
-		if err := mysqlDB.MysqlRestore(backupS3Dir, restoreDir, true, "", nil); err != nil {
+		if err := mysqlDB.MysqlRestore(ctx, backupS3Dir, restoreDir, streaming, true, "", nil, target); err != nil {
 			return fmt.Errorf("all database restore failed: %w", err)
 		}
 	case strings.HasPrefix(arg, "database="):
@@ -214,7 +515,7 @@ func restoreCli(cliArgs []string, mysqlDB *DB) error {
 			return fmt.Errorf("invalid argument for single database restore. Usage: database=db_name")
 		}
 		database := parts[1]
-		if err := mysqlDB.MysqlRestore(backupS3Dir, restoreDir, false, database, nil); err != nil {
+		if err := mysqlDB.MysqlRestore(ctx, backupS3Dir, restoreDir, streaming, false, database, nil, target); err != nil {
 			return fmt.Errorf("restore failed: %w", err)
 		}
 	case strings.HasPrefix(arg, "databases="):
@@ -223,7 +524,7 @@ func restoreCli(cliArgs []string, mysqlDB *DB) error {
 			return fmt.Errorf("invalid argument for multiple databases restore. Usage: databases=db1,db2,db3")
 		}
 		dbList := strings.Split(parts[1], ",")
-		if err := mysqlDB.MysqlRestore(backupS3Dir, restoreDir, false, "", dbList); err != nil {
+		if err := mysqlDB.MysqlRestore(ctx, backupS3Dir, restoreDir, streaming, false, "", dbList, target); err != nil {
 			return fmt.Errorf("restore failed: %w", err)
 		}
 	default:
@@ -232,16 +533,124 @@ func restoreCli(cliArgs []string, mysqlDB *DB) error {
 	return nil
 }
 
+// listBackupsCli handles the "list-backups" CLI command.
+//
+// Parameters:
+// - cliArgs: The list of CLI arguments.
+// - mysqlDB: The database configuration object.
+//
+// Returns:
+// - error: An error if the arguments are invalid or the catalog cannot be loaded.
+func listBackupsCli(cliArgs []string, mysqlDB *DB) error {
+	var backupS3Dir, output string
+	var filter catalogFilter
+	for _, arg := range cliArgs[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid argument for list-backups: %s", arg)
+		}
+		switch parts[0] {
+		case "backup-s3-dir":
+			backupS3Dir = parts[1]
+		case "database":
+			filter.Database = parts[1]
+		case "since", "until":
+			t, err := parseCatalogTime(parts[1])
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", parts[0], err)
+			}
+			if parts[0] == "since" {
+				filter.Since = t
+			} else {
+				filter.Until = t
+			}
+		case "output":
+			output = parts[1]
+		default:
+			return fmt.Errorf("unknown argument for list-backups: %s", parts[0])
+		}
+	}
+
+	sets, err := loadBackupCatalog(context.Background(), mysqlDB.Storage, backupS3Dir)
+	if err != nil {
+		return err
+	}
+	sets = filterBackupSets(sets, filter)
+
+	switch output {
+	case "", "table":
+		return writeCatalogTable(os.Stdout, sets)
+	case "json":
+		return writeCatalogJSON(os.Stdout, sets)
+	default:
+		return fmt.Errorf("invalid output: %s, should be one of table, json", output)
+	}
+}
+
+// decryptCli handles the "decrypt" CLI command.
+// The master key is read from the environment, age identities from identity-file or BACKUP_AGE_IDENTITY_FILE.
+//
+// Parameters:
+// - cliArgs: The list of CLI arguments.
+//
+// Returns:
+// - error: An error if the file cannot be decrypted.
+func decryptCli(cliArgs []string) error {
+	var input, output, identityFile string
+	for _, arg := range cliArgs[1:] {
+		if strings.HasPrefix(arg, "input=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				input = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "output=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				output = parts[1]
+			}
+		} else if strings.HasPrefix(arg, "identity-file=") {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 2 {
+				identityFile = parts[1]
+			}
+		}
+	}
+
+	if input == "" || output == "" {
+		return fmt.Errorf("for decrypt, both input and output must be provided (e.g., input=backup.sql.gz.age output=backup.sql.gz)")
+	}
+
+	enc, err := encryptionFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid encryption configuration: %w", err)
+	}
+	if identityFile != "" {
+		identities, err := loadAgeIdentities(strings.Split(identityFile, ","))
+		if err != nil {
+			return err
+		}
+		enc.AgeIdentities = append(enc.AgeIdentities, identities...)
+	}
+
+	if err := decryptFile(enc, input, output); err != nil {
+		return err
+	}
+	log.Printf("decrypted %s to %s", input, output)
+	return nil
+}
+
 // incrementalBackupCli handles the "incremental-backup" CLI command.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - cliArgs: The list of CLI arguments.
 // - mysqlDB: The database configuration object.
+// - dbConn: The database connection object.
 //
 // Returns:
 // - error: An error if the incremental backup process fails.
-func incrementalBackupCli(cliArgs []string, mysqlDB *DB) error {
-	var backupLocalDir string
+func incrementalBackupCli(ctx context.Context, cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
+	backupLocalDir := os.Getenv("MYSQL_BACKUP_PATH")
 	for _, arg := range cliArgs[1:] {
 		if strings.HasPrefix(arg, "backup-local-dir=") {
 			parts := strings.SplitN(arg, "=", 2)
@@ -255,7 +664,11 @@ func incrementalBackupCli(cliArgs []string, mysqlDB *DB) error {
 		return fmt.Errorf("for backup, backup-local-dir must be provided (e.g., backup-local-dir=your/path)")
 	}
 
-	if err := mysqlDB.MysqlIncrementalBackup(context.Background(), backupLocalDir); err != nil {
+	// The archiver stores its last chunk and checkpoint on shutdown, within the shutdown timeout.
+	err := runUntilShutdown(ctx, mysqlDB.shutdownTimeout(), "incremental backup", func(ctx context.Context) error {
+		return mysqlDB.MysqlIncrementalBackup(ctx, dbConn, backupLocalDir)
+	})
+	if err != nil {
 		return fmt.Errorf("incremental backup failed: %w", err)
 	}
 	return nil
@@ -264,14 +677,20 @@ func incrementalBackupCli(cliArgs []string, mysqlDB *DB) error {
 // allBacupCli handles the "enable-all-backup-scheduler" CLI command.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - cliArgs: The list of CLI arguments.
 // - mysqlDB: The database configuration object.
 // - dbConn: The database connection object.
 //
 // Returns:
 // - error: An error if the scheduler setup fails.
-func allBacupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
-	var weekday, hourStr, backupLocalDir string
+func allBacupCli(ctx context.Context, cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
+	// The schedule and directory of the configuration are overridden by the arguments.
+	weekday, hourStr, err := scheduleFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	backupLocalDir := os.Getenv("MYSQL_BACKUP_PATH")
 	for _, arg := range cliArgs[1:] {
 		if strings.HasPrefix(arg, "weekday=") {
 			parts := strings.SplitN(arg, "=", 2)
@@ -295,8 +714,222 @@ func allBacupCli(cliArgs []string, mysqlDB *DB, dbConn *sql.DB) error {
 		return fmt.Errorf("for enable-all-backup-scheduler, both weekday, hour and backup-local-dir must be provided (e.g., weekday=Mon hour=00:00 backup-local-dir=your/path)")
 	}
 	log.Printf("enabling backup scheduler every %s at %s", weekday, hourStr)
-	if err := mysqlDB.EnableAllBackupScheduler(dbConn, weekday, hourStr, backupLocalDir); err != nil {
+	if err := mysqlDB.EnableAllBackupScheduler(ctx, dbConn, weekday, hourStr, backupLocalDir); err != nil {
 		return fmt.Errorf("failed to enable backup scheduler: %v", err)
 	}
-	select {}
+	return nil
+}
+
+// pruneBackupsCli handles the "prune-backups" CLI command.
+//
+// Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
+// - cliArgs: The list of CLI arguments.
+// - mysqlDB: The database configuration object.
+//
+// Returns:
+// - error: An error if no retention policy is configured or the backups cannot be pruned.
+func pruneBackupsCli(ctx context.Context, cliArgs []string, mysqlDB *DB) error {
+	var dryRun bool
+	for _, arg := range cliArgs[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] != "dry-run" {
+			return fmt.Errorf("unknown argument for prune-backups: %s", arg)
+		}
+		value, err := strconv.ParseBool(parts[1])
+		if err != nil {
+			return fmt.Errorf("error parsing dry-run: %v", err)
+		}
+		dryRun = value
+	}
+
+	if !mysqlDB.Retention.Enabled() {
+		return fmt.Errorf("no retention policy configured, set retention.keep_full_backups or retention.max_age_days")
+	}
+	_, err := pruneBackups(ctx, mysqlDB.Storage, mysqlDB.Retention, dryRun)
+	return err
+}
+
+// daemonCli handles the "daemon" CLI command, running the schedule of every target of the configuration file.
+// The backup directory of each target is below backup-local-dir (or backup_dir), unless the target sets its own.
+//
+// Parameters:
+// - cliArgs: The list of CLI arguments.
+// - cfg: The configuration file, nil if none.
+//
+// Returns:
+// - error: An error if the configuration has no targets, a target cannot be set up, or a schedule is invalid.
+func daemonCli(cliArgs []string, cfg *configFile) error {
+	if cfg == nil || len(cfg.Targets) == 0 {
+		return fmt.Errorf("the daemon needs a configuration file with targets")
+	}
+	backupLocalDir := os.Getenv("MYSQL_BACKUP_PATH")
+	for _, arg := range cliArgs[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] != "backup-local-dir" {
+			return fmt.Errorf("invalid argument for daemon: %s", arg)
+		}
+		backupLocalDir = parts[1]
+	}
+	os.Setenv("MYSQL_BACKUP_PATH", backupLocalDir)
+
+	opts, err := daemonFromEnv(backupLocalDir)
+	if err != nil {
+		return fmt.Errorf("invalid daemon configuration: %w", err)
+	}
+	targets, err := loadTargets(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(targets)
+
+	// Every target is given its own shutdown timeout, the longest one is logged.
+	var timeout time.Duration
+	for _, t := range targets {
+		timeout = max(timeout, t.DB.shutdownTimeout())
+	}
+	ctx, stop := shutdownContext(timeout)
+	defer stop()
+	return runDaemon(ctx, targets, opts)
+}
+
+// statusCli handles the "status" CLI command, printing the status of the targets written by a running daemon.
+//
+// Parameters:
+// - cliArgs: The list of CLI arguments.
+//
+// Returns:
+// - error: An error if the status file cannot be read.
+func statusCli(cliArgs []string) error {
+	opts, err := daemonFromEnv(os.Getenv("MYSQL_BACKUP_PATH"))
+	if err != nil {
+		return fmt.Errorf("invalid daemon configuration: %w", err)
+	}
+	statusFile, output := opts.StatusFile, ""
+	for _, arg := range cliArgs[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid argument for status: %s", arg)
+		}
+		switch parts[0] {
+		case "status-file":
+			statusFile = parts[1]
+		case "output":
+			output = parts[1]
+		default:
+			return fmt.Errorf("unknown argument for status: %s", parts[0])
+		}
+	}
+	if statusFile == "" {
+		return fmt.Errorf("for status, status-file must be provided, or daemon.status_file or backup_dir configured")
+	}
+
+	status, err := readStatusFile(statusFile)
+	if err != nil {
+		return err
+	}
+	switch output {
+	case "", "table":
+		return writeStatusTable(os.Stdout, status)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	default:
+		return fmt.Errorf("invalid output: %s, should be one of table, json", output)
+	}
+}
+
+// configCli handles the "config" CLI command.
+// "config validate" checks the selected profile, or every profile of the file when none is selected, each layered
+// with the environment and the --set flags as for any other command.
+//
+// Parameters:
+// - cliArgs: The list of CLI arguments.
+// - cfg: The configuration file, nil if none.
+// - profile: The profile selected with --profile or MBRGO_PROFILE, empty if none.
+// - flagSettings: The environment variables set with --set.
+//
+// Returns:
+// - error: An error if the arguments are invalid or a configuration is invalid.
+func configCli(cliArgs []string, cfg *configFile, profile string, flagSettings map[string]string) error {
+	if len(cliArgs) != 2 || cliArgs[1] != "validate" {
+		return fmt.Errorf("invalid argument for config, should be validate")
+	}
+
+	profiles := []string{profile}
+	if cfg != nil && profile == "" && cfg.DefaultProfile == "" && len(cfg.Profiles) > 0 {
+		profiles = cfg.profileNames()
+	}
+	failed := 0
+	for _, name := range profiles {
+		label := "configuration"
+		if name != "" {
+			label = "profile " + name
+		} else if cfg != nil && cfg.DefaultProfile != "" {
+			label = "profile " + cfg.DefaultProfile
+		}
+
+		restore, err := applyConfiguration(cfg, name, flagSettings)
+		if err != nil {
+			failed++
+			printValidation(label, err)
+			continue
+		}
+		if cfg == nil || len(cfg.Targets) == 0 {
+			err = validateSettings()
+			printValidation(label, err)
+		} else {
+			// Each target is validated with the settings the daemon runs it with.
+			if _, daemonErr := daemonFromEnv(os.Getenv("MYSQL_BACKUP_PATH")); daemonErr != nil {
+				err = fmt.Errorf("invalid daemon configuration: %w", daemonErr)
+				printValidation(label, err)
+			}
+			for _, target := range cfg.targetNames() {
+				restoreTarget, targetErr := cfg.applyTarget(target)
+				if targetErr == nil {
+					targetErr = validateSettings()
+					restoreTarget()
+				}
+				printValidation(label+", target "+target, targetErr)
+				err = errors.Join(err, targetErr)
+			}
+		}
+		restore()
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d configurations are invalid", failed, len(profiles))
+	}
+	return nil
+}
+
+// validateSettings reads the secrets given as files or commands and checks every setting of the environment.
+//
+// Returns:
+// - error: Every problem found, joined, otherwise nil.
+func validateSettings() error {
+	if err := resolveSecretEnv(); err != nil {
+		return err
+	}
+	registerSecretsFromEnv()
+	return validateConfiguration()
+}
+
+// printValidation prints the result of validating a configuration, with the problems found.
+//
+// Parameters:
+// - label: The configuration, e.g. "profile prod".
+// - err: The problems found, nil if the configuration is valid.
+func printValidation(label string, err error) {
+	if err == nil {
+		fmt.Printf("%s: valid\n", label)
+		return
+	}
+	fmt.Printf("%s: invalid\n", label)
+	for _, line := range strings.Split(redact(err.Error()), "\n") {
+		fmt.Printf("  - %s\n", line)
+	}
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	manifestVersion = 1 // Version of the manifest format, bumped on incompatible changes.
+
+	manifestStatusCompleted = "completed" // Every backup file of the set was stored.
+	manifestStatusPartial   = "partial"   // Some, but not all, backup files of the set were stored.
+	manifestStatusFailed    = "failed"    // No backup file of the set was stored.
+	manifestStatusAborted   = "aborted"   // The run was interrupted by a shutdown before every backup file was stored.
+)
+
+// BackupManifest describes a backup set produced by a single MysqlBackup run.
+// It is stored as "<timestamp>_backup_manifest.json" next to the dumps it describes.
+//
+// Fields:
+// - Version: The version of the manifest format.
+// - ID: The timestamp shared by the names of every file of the set (e.g., "20240101_000000").
+// - AllDatabases: A boolean indicating whether the set holds a dump of all databases.
+// - Databases: The databases requested for the set (empty when AllDatabases is true).
+// - Status: The outcome of the run, one of completed, partial, failed or aborted.
+// - StartTime: The time the run started.
+// - EndTime: The time the run finished.
+// - ServerVersion: The version reported by the MySQL server.
+// - Binlog: The binary log coordinates of the dump snapshot (of the last dump for several databases), nil when unknown.
+// - Compression: The compression codec applied to the files.
+// - CompressionLevel: The compression level, 0 for the codec default.
+// - Encryption: The encryption applied to the files, nil when they are not encrypted.
+// - Files: The backup files of the set.
+type BackupManifest struct {
+	Version          int                 `json:"version"`
+	ID               string              `json:"id"`
+	AllDatabases     bool                `json:"all_databases"`
+	Databases        []string            `json:"databases,omitempty"`
+	Status           string              `json:"status"`
+	StartTime        time.Time           `json:"start_time"`
+	EndTime          time.Time           `json:"end_time"`
+	ServerVersion    string              `json:"server_version,omitempty"`
+	Binlog           *binlogCoordinates  `json:"binlog,omitempty"`
+	Compression      string              `json:"compression"`
+	CompressionLevel int                 `json:"compression_level,omitempty"`
+	Encryption       *manifestEncryption `json:"encryption,omitempty"`
+	Files            []ManifestFile      `json:"files"`
+}
+
+// ManifestFile describes a single backup file of a backup set.
+//
+// Fields:
+// - Database: The database dumped to the file, empty for a dump of all databases.
+// - Name: The stored name of the file.
+// - Key: The storage key of the file.
+// - Size: The size of the stored file in bytes, after compression and encryption.
+// - SHA256: The hex encoded SHA-256 checksum of the stored file.
+// - DumpOptions: The mysqldump options selecting what was dumped (connection options are omitted).
+// - Binlog: The binary log coordinates of the snapshot the file was dumped from, nil when unknown.
+// - Error: The reason the file could not be stored, empty on success.
+type ManifestFile struct {
+	Database    string             `json:"database,omitempty"`
+	Name        string             `json:"name"`
+	Key         string             `json:"key"`
+	Size        int64              `json:"size"`
+	SHA256      string             `json:"sha256"`
+	DumpOptions []string           `json:"dump_options"`
+	Binlog      *binlogCoordinates `json:"binlog,omitempty"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// binlogCoordinates holds the binary log position of the server at the snapshot of a dump.
+//
+// Fields:
+// - File: The name of the current binary log file.
+// - Position: The position within the current binary log file.
+// - GTIDSet: The executed GTID set, empty when GTIDs are disabled.
+type binlogCoordinates struct {
+	File     string `json:"file"`
+	Position uint32 `json:"position"`
+	GTIDSet  string `json:"gtid_set,omitempty"`
+}
+
+// manifestEncryption records how the files of a backup set are encrypted.
+//
+// Fields:
+// - Algorithm: The encryption algorithm (AES-256-GCM-STREAM or age).
+// - KeyID: The identifier of the master key, for AES-256-GCM-STREAM.
+// - Recipients: The public keys the files are encrypted to, for age.
+type manifestEncryption struct {
+	Algorithm  string   `json:"algorithm"`
+	KeyID      string   `json:"key_id,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// newBackupManifest starts the manifest of a backup set.
+//
+// Parameters:
+// - db: The database configuration object holding the codecs.
+// - start: The time the run started, also used to derive the ID of the set.
+// - allDBFull: A boolean indicating whether all databases are backed up.
+// - databases: The databases backed up (ignored when allDBFull is true).
+//
+// Returns:
+// - *BackupManifest: The manifest, to be completed as files are stored.
+func newBackupManifest(db *DB, start time.Time, allDBFull bool, databases []string) *BackupManifest {
+	manifest := &BackupManifest{
+		Version:          manifestVersion,
+		ID:               start.Format("20060102_150405"),
+		AllDatabases:     allDBFull,
+		StartTime:        start.UTC(),
+		Compression:      db.Compression.Codec,
+		CompressionLevel: db.Compression.Level,
+		Files:            []ManifestFile{},
+	}
+	if manifest.Compression == "" {
+		manifest.Compression = codecNone
+	}
+	if !allDBFull {
+		manifest.Databases = databases
+	}
+
+	if db.Encryption.AgeEnabled() {
+		manifest.Encryption = &manifestEncryption{Algorithm: "age", Recipients: db.Encryption.AgeRecipientNames}
+	} else if db.Encryption.Enabled() {
+		manifest.Encryption = &manifestEncryption{Algorithm: encryptionAlgorithm, KeyID: db.Encryption.KeyID}
+	}
+	return manifest
+}
+
+// fileName returns the name the manifest is stored under.
+//
+// Returns:
+// - string: The file name of the manifest.
+func (m *BackupManifest) fileName() string {
+	return fmt.Sprintf("%s_backup_manifest.json", m.ID)
+}
+
+// finish records the server state and the outcome of the run.
+// The binlog coordinates of the set are those of its stored dumps. Each dump of several databases has its own
+// snapshot, so the set is only known to contain every transaction before the snapshot of the last one; it gets no
+// coordinates when a stored dump has none.
+// Failing to query the server is logged but does not fail the backup.
+//
+// Parameters:
+// - dbConn: The database connection object.
+func (m *BackupManifest) finish(dbConn *sql.DB) {
+	m.EndTime = time.Now().UTC()
+
+	if err := dbConn.QueryRow("SELECT VERSION()").Scan(&m.ServerVersion); err != nil {
+		log.Printf("error fetching server version: %v", err)
+	}
+
+	failed, unknownBinlog := 0, false
+	for _, file := range m.Files {
+		switch {
+		case file.Error != "":
+			failed++
+		case file.Binlog == nil:
+			unknownBinlog = true
+		default:
+			m.Binlog = file.Binlog
+		}
+	}
+	if unknownBinlog {
+		m.Binlog = nil
+	}
+	switch {
+	case len(m.Files) > 0 && failed == 0:
+		m.Status = manifestStatusCompleted
+	case failed < len(m.Files):
+		m.Status = manifestStatusPartial
+	default:
+		m.Status = manifestStatusFailed
+	}
+}
+
+// save stores the manifest under key.
+//
+// Parameters:
+// - ctx: The context for managing the upload.
+// - st: The storage receiving the manifest.
+// - key: The storage key of the manifest.
+//
+// Returns:
+// - error: An error if the manifest cannot be encoded or stored.
+func (m *BackupManifest) save(ctx context.Context, st Storage, key string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := st.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to store manifest %s: %w", key, err)
+	}
+	return nil
+}
+
+// readManifest loads a backup manifest from the storage.
+//
+// Parameters:
+// - ctx: The context for managing the download.
+// - st: The storage holding the manifest.
+// - key: The storage key of the manifest.
+//
+// Returns:
+// - *BackupManifest: The decoded manifest.
+// - error: An error if the manifest cannot be read or decoded.
+func readManifest(ctx context.Context, st Storage, key string) (*BackupManifest, error) {
+	reader, err := st.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", key, err)
+	}
+	defer reader.Close()
+
+	var manifest BackupManifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+// binlogEnabled reports whether the server writes a binary log, without which dumps have no binlog coordinates.
+//
+// Parameters:
+// - dbConn: The database connection object.
+//
+// Returns:
+// - bool: True if binary logging is enabled, otherwise false.
+// - error: An error if the query fails.
+func binlogEnabled(dbConn *sql.DB) (bool, error) {
+	var enabled bool
+	err := dbConn.QueryRow("SELECT @@GLOBAL.log_bin").Scan(&enabled)
+	return enabled, err
+}
+
+// maxDumpHeaderSize bounds the part of a dump searched for its binlog coordinates, which mysqldump writes before
+// the first database.
+const maxDumpHeaderSize = 1 << 20
+
+// Statements of the dump header recording the binlog coordinates of the snapshot: the commented CHANGE MASTER or
+// CHANGE REPLICATION SOURCE of --master-data=2 and --source-data=2, the GTID_PURGED set of MySQL, and the
+// commented gtid_slave_pos of MariaDB.
+var (
+	dumpPositionLine = regexp.MustCompile(`^-- CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+	dumpGTIDPurged   = regexp.MustCompile(`GTID_PURGED=.*'([^']*)'\s*;`)
+	dumpGTIDSlavePos = regexp.MustCompile(`^-- SET GLOBAL gtid_slave_pos='([^']*)'`)
+)
+
+// dumpCoordinatesScanner is an io.Writer reading the binlog coordinates of the snapshot from the header of a dump
+// as it streams. Scanning stops at the first database, so the rest of the dump passes through untouched.
+//
+// Fields:
+// - coords: The coordinates found so far.
+// - found: A boolean indicating whether the binlog file and position were found.
+// - line: The start of a line not yet complete.
+// - gtidStatement: The start of a GTID_PURGED statement spanning several lines, one per server UUID.
+// - scanned: The number of bytes scanned.
+// - done: A boolean indicating whether the header has ended.
+type dumpCoordinatesScanner struct {
+	coords        binlogCoordinates
+	found         bool
+	line          []byte
+	gtidStatement string
+	scanned       int
+	done          bool
+}
+
+// Write scans the lines of the dump header in p.
+func (s *dumpCoordinatesScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for !s.done && len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.line = append(s.line, p...)
+			break
+		}
+		s.line = append(s.line, p[:i]...)
+		s.scanLine(string(s.line))
+		s.line = s.line[:0]
+		p = p[i+1:]
+	}
+	s.scanned += n
+	if s.scanned > maxDumpHeaderSize {
+		s.done, s.line = true, nil
+	}
+	return n, nil
+}
+
+// scanLine reads the binlog coordinates from a line of the dump header.
+//
+// Parameters:
+// - line: The line, without its newline.
+func (s *dumpCoordinatesScanner) scanLine(line string) {
+	if s.gtidStatement != "" || strings.Contains(line, "GTID_PURGED=") {
+		s.gtidStatement += line
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			if m := dumpGTIDPurged.FindStringSubmatch(s.gtidStatement); m != nil {
+				s.coords.GTIDSet = m[1]
+			}
+			s.gtidStatement = ""
+		}
+		return
+	}
+	if m := dumpPositionLine.FindStringSubmatch(line); m != nil {
+		if position, err := strconv.ParseUint(m[2], 10, 32); err == nil {
+			s.coords.File, s.coords.Position, s.found = m[1], uint32(position), true
+		}
+		return
+	}
+	if m := dumpGTIDSlavePos.FindStringSubmatch(line); m != nil {
+		s.coords.GTIDSet = m[1]
+		return
+	}
+	if strings.HasPrefix(line, "-- Current Database:") || strings.HasPrefix(line, "CREATE ") || strings.HasPrefix(line, "USE ") {
+		s.done = true
+	}
+}
+
+// coordinates returns the binlog coordinates found in the dump header.
+//
+// Returns:
+// - *binlogCoordinates: The coordinates, nil when the dump records no binlog position.
+func (s *dumpCoordinatesScanner) coordinates() *binlogCoordinates {
+	if !s.found {
+		return nil
+	}
+	coords := s.coords
+	return &coords
+}
+
+// checksumWriter is an io.Writer computing the size and SHA-256 checksum of everything written to it.
+//
+// Fields:
+// - hash: The running SHA-256 checksum.
+// - size: The number of bytes written.
+type checksumWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+// newChecksumWriter creates a checksumWriter.
+//
+// Returns:
+// - *checksumWriter: The checksum writer.
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{hash: sha256.New()}
+}
+
+// Write adds p to the checksum.
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.hash.Write(p)
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// Sum returns the hex encoded SHA-256 checksum of everything written so far.
+func (c *checksumWriter) Sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
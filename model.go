@@ -1,25 +1,78 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
 
 // DB holds the configuration for the database connection and backup settings.
 //
 // Fields:
+// - Name: The name of the target in the daemon, prefixed to its log lines (empty outside the daemon).
 // - Host: The database server host (e.g., "localhost" or an IP address).
 // - User: The database user with sufficient privileges for backup and restore operations.
 // - Password: The password for the database user.
+// - Credentials: The provider reading the user and password and keeping them current, nil for fixed credentials.
 // - Database: The name of a single database to connect to (optional if AllDatabases is true).
 // - Databases: A list of specific databases to back up (optional if AllDatabases is true).
 // - AllDatabases: A boolean indicating whether to back up all databases.
 // - Port: The port number on which the database server is running (e.g., 3306 for MySQL).
+// - Socket: The Unix socket of the server, used instead of Host and Port when set.
+// - Flavor: The server flavor, mysql or mariadb, selecting the binlog protocol and GTID format (mysql when empty).
+// - ServerID: The server ID the incremental backup registers with as a replica, unique among the replicas of the server (0 for the default).
+// - Charset: The character set of the binlog connection, the client default when empty.
+// - TLS: The TLS settings of the connections to the server.
+// - SSH: The settings of the SSH tunnel the connections to the server go through, for servers behind a bastion host.
+// - Storage: The storage backend where backups are uploaded to and restored from.
+// - Compression: The codec applied to full dumps and binlog chunks before they are stored.
+// - Encryption: The master key or age recipients used to encrypt full dumps and binlog chunks before they are stored.
+// - Retention: The policy removing old backups from the storage after scheduled full backups.
+// - GTIDMode: A boolean indicating whether incremental backups are positioned by GTID set instead of binlog file and position.
+// - UploadQueueSize: The number of rotated binlog chunks that may wait to be stored before the binlog stream is held up.
+// - LiveUpload: A boolean indicating whether binlog chunks are uploaded while they are written instead of once rotated.
+// - HeartbeatPeriod: The interval at which the server sends heartbeats on an idle binlog stream, 0 for the default.
+// - ReadTimeout: The time without an event or heartbeat after which the binlog connection is considered lost, 0 for three heartbeat periods.
+// - ReconnectMaxBackoff: The longest delay between two attempts to reconnect a lost binlog stream, 0 for the default.
+// - ShutdownTimeout: The time running backups are given to finish once a shutdown is requested, 0 for the default.
+// - credentialsMu: Guards User and Password, which are replaced when the credentials rotate.
+// - tunnel: The SSH tunnel, nil when the server is reached directly.
+// - logger: The logger prefixing the log lines of the target with its name, nil outside the daemon.
+// - dumps: The limit on full dumps running at once, shared by the targets of the daemon (nil for no limit).
 type DB struct {
-	Host         string
-	User         string
-	Password     string
-	Database     string
-	Databases    []string
-	AllDatabases bool
-	Port         int
+	Name                string
+	Host                string
+	User                string
+	Password            string
+	Credentials         *CredentialProvider
+	Database            string
+	Databases           []string
+	AllDatabases        bool
+	Port                int
+	Socket              string
+	Flavor              string
+	ServerID            uint32
+	Charset             string
+	TLS                 TLSOptions
+	SSH                 SSHOptions
+	Storage             Storage
+	Compression         Compression
+	Encryption          Encryption
+	Retention           Retention
+	GTIDMode            bool
+	UploadQueueSize     int
+	LiveUpload          bool
+	HeartbeatPeriod     time.Duration
+	ReadTimeout         time.Duration
+	ReconnectMaxBackoff time.Duration
+	ShutdownTimeout     time.Duration
+	credentialsMu       sync.RWMutex
+	tunnel              *sshTunnel
+	logger              *log.Logger
+	dumps               *dumpLimiter
 }
 
 // Validate checks if the DB struct has valid values.
@@ -27,8 +80,8 @@ type DB struct {
 // Returns:
 // - error: An error if any required field is missing or invalid, otherwise nil.
 func (db *DB) Validate() error {
-	if db.Host == "" {
-		return fmt.Errorf("host is required")
+	if db.Host == "" && db.Socket == "" {
+		return fmt.Errorf("host or socket is required")
 	}
 	if db.User == "" {
 		return fmt.Errorf("user is required")
@@ -36,8 +89,16 @@ func (db *DB) Validate() error {
 	if db.Password == "" {
 		return fmt.Errorf("password is required")
 	}
-	if db.Port <= 0 {
+	if db.Socket == "" && db.Port <= 0 {
 		return fmt.Errorf("port must be a positive integer")
 	}
+	if db.TLS.Mode == tlsModeVerifyIdentity && db.Host == "" && db.TLS.ServerName == "" {
+		return fmt.Errorf("TLS mode verify-identity needs the host or MYSQL_TLS_SERVER_NAME to verify the server certificate")
+	}
+	switch db.Flavor {
+	case "", mysql.MySQLFlavor, mysql.MariaDBFlavor:
+	default:
+		return fmt.Errorf("unknown flavor: %s, should be one of mysql, mariadb", db.Flavor)
+	}
 	return nil
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxDatabaseNameLength is the longest database name MySQL accepts.
+const maxDatabaseNameLength = 64
+
+// mysqldumpVersion matches the release in the output of mysqldump --version: "Ver 8.0.36" from MySQL 8, and
+// "Distrib 5.7.44" from older releases and MariaDB.
+var mysqldumpVersion = regexp.MustCompile(`(?:Ver|Distrib) (\d+)\.(\d+)\.(\d+)`)
+
+// mysqlCommand builds the command running a MySQL client tool (mysqldump or mysql) against the server.
+// The connection settings and credentials are passed in a temporary option file readable only by the current
+// user, so the password never shows up in the process list or in logged command lines.
+//
+// Parameters:
+// - ctx: The context for the command, the tool is killed once it is cancelled.
+// - tool: The name of the tool to run.
+// - args: The arguments of the tool, after the connection settings.
+//
+// Returns:
+// - *exec.Cmd: The command, not started.
+// - func(): A function removing the option file, called once the command has exited.
+// - error: An error if the option file cannot be written.
+func (db *DB) mysqlCommand(ctx context.Context, tool string, args ...string) (*exec.Cmd, func(), error) {
+	optionFile, err := db.writeOptionFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(optionFile) }
+
+	// --defaults-extra-file is only recognized as the first argument.
+	command := exec.CommandContext(ctx, tool, append([]string{"--defaults-extra-file=" + optionFile}, args...)...)
+	return command, cleanup, nil
+}
+
+// sourceDataOption returns the mysqldump option writing the binlog coordinates of the dump snapshot to the dump as
+// a comment: --source-data=2 from MySQL 8.0.26, which deprecates --master-data, and --master-data=2 for older
+// releases and MariaDB.
+//
+// Parameters:
+// - ctx: The context for running mysqldump --version.
+//
+// Returns:
+// - string: The option.
+func sourceDataOption(ctx context.Context) string {
+	output, err := exec.CommandContext(ctx, "mysqldump", "--version").Output()
+	if err != nil || bytes.Contains(output, []byte("MariaDB")) {
+		return "--master-data=2"
+	}
+	m := mysqldumpVersion.FindSubmatch(output)
+	if m == nil {
+		return "--master-data=2"
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+	patch, _ := strconv.Atoi(string(m[3]))
+	if major > 8 || (major == 8 && (minor > 0 || patch >= 26)) {
+		return "--source-data=2"
+	}
+	return "--master-data=2"
+}
+
+// writeOptionFile writes the connection settings and credentials of the server to a temporary MySQL option file.
+//
+// Returns:
+// - string: The path to the option file, created with mode 0600.
+// - error: An error if the file cannot be written.
+func (db *DB) writeOptionFile() (string, error) {
+	file, err := os.CreateTemp("", "mbrgo-*.cnf")
+	if err != nil {
+		return "", fmt.Errorf("failed to create MySQL option file: %w", err)
+	}
+	defer file.Close()
+	if err := file.Chmod(0600); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to restrict MySQL option file: %w", err)
+	}
+
+	user, password := db.credentials()
+	var b strings.Builder
+	b.WriteString("[client]\n")
+	nameVerifiable := db.TLS.ServerName == "" || db.TLS.ServerName == db.Host
+	switch {
+	case db.tunnel != nil:
+		// The tools cannot dial over SSH, they connect to the local end of the tunnel.
+		network, address := db.serverAddress()
+		host, port, err := db.tunnel.forward(network, address)
+		if err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+		fmt.Fprintf(&b, "host=%s\nport=%d\nprotocol=TCP\n", host, port)
+		nameVerifiable = false
+	case db.Socket != "":
+		fmt.Fprintf(&b, "socket=%s\nprotocol=SOCKET\n", optionValue(db.Socket))
+	default:
+		fmt.Fprintf(&b, "host=%s\n", optionValue(db.Host))
+		fmt.Fprintf(&b, "port=%s\n", strconv.Itoa(db.Port))
+	}
+	for _, line := range db.TLS.toolOptions(db.flavor(), nameVerifiable) {
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&b, "user=%s\n", optionValue(user))
+	fmt.Fprintf(&b, "password=%s\n", optionValue(password))
+	if _, err := file.WriteString(b.String()); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write MySQL option file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// optionValue quotes a value for a MySQL option file, escaping the characters the option file parser unescapes.
+//
+// Parameters:
+// - value: The value to quote.
+//
+// Returns:
+// - string: The quoted value.
+func optionValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\b", `\b`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// validateDatabaseName checks that a database name can be passed to the MySQL tools and used in backup file names.
+// Names must not start with "-", so they are never read as an option, nor contain path separators, dots or
+// control characters, so the backup file names derived from them stay in the backup directory.
+//
+// Parameters:
+// - name: The database name.
+//
+// Returns:
+// - error: An error if the name is invalid, otherwise nil.
+func validateDatabaseName(name string) error {
+	if name == "" {
+		return fmt.Errorf("database name is empty")
+	}
+	if len(name) > maxDatabaseNameLength {
+		return fmt.Errorf("database name %q is longer than %d characters", name, maxDatabaseNameLength)
+	}
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("database name %q must not start with -", name)
+	}
+	if strings.HasSuffix(name, " ") {
+		return fmt.Errorf("database name %q must not end with a space", name)
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || r == '.' || unicode.IsControl(r) {
+			return fmt.Errorf("database name %q contains an invalid character %q", name, r)
+		}
+	}
+	return nil
+}
+
+// validateDatabaseNames checks a list of database names with validateDatabaseName.
+//
+// Parameters:
+// - names: The database names.
+//
+// Returns:
+// - error: An error for the first invalid name, otherwise nil.
+func validateDatabaseNames(names []string) error {
+	for _, name := range names {
+		if err := validateDatabaseName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateFileName checks that a name is a plain file name, without directory components.
+//
+// Parameters:
+// - name: The file name.
+//
+// Returns:
+// - error: An error if the name is empty, "." or "..", or contains a path separator or control character.
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return fmt.Errorf("file name %q contains an invalid character %q", name, r)
+		}
+	}
+	return nil
+}
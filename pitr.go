@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// recoveryTarget is the point a point-in-time recovery stops at.
+// Exactly one of Time, File or GTID is set. The transaction at the target is not applied.
+//
+// Fields:
+// - Time: Stop before the first transaction committed at or after this time.
+// - File: The binary log file of the position to stop at.
+// - Position: Stop before the first transaction starting at or after this position of File.
+// - GTID: Stop before the transaction with this GTID.
+type recoveryTarget struct {
+	Time     time.Time
+	File     string
+	Position uint32
+	GTID     string
+}
+
+// parseRecoveryTarget builds the recovery target from the until-time, until-position and until-gtid restore arguments.
+//
+// Parameters:
+// - untilTime: The time to stop at (e.g., "2024-01-01 15:04:05"), empty if unused.
+// - untilPosition: The binary log position to stop at as file:pos, empty if unused.
+// - untilGTID: The GTID of the first transaction not to apply, empty if unused.
+//
+// Returns:
+// - *recoveryTarget: The recovery target, nil when no argument is set.
+// - error: An error if more than one argument is set or the value is invalid.
+func parseRecoveryTarget(untilTime, untilPosition, untilGTID string) (*recoveryTarget, error) {
+	set := 0
+	for _, value := range []string{untilTime, untilPosition, untilGTID} {
+		if value != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return nil, nil
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of until-time, until-position or until-gtid can be provided")
+	}
+
+	switch {
+	case untilTime != "":
+		t, err := parseCatalogTime(untilTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until-time: %w", err)
+		}
+		return &recoveryTarget{Time: t}, nil
+	case untilPosition != "":
+		file, posStr, ok := strings.Cut(untilPosition, ":")
+		if !ok || file == "" {
+			return nil, fmt.Errorf("invalid until-position: %s, expected file:pos (e.g., binlog.000042:1337)", untilPosition)
+		}
+		pos, err := strconv.ParseUint(posStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until-position: %s: %v", untilPosition, err)
+		}
+		return &recoveryTarget{File: file, Position: uint32(pos)}, nil
+	default:
+		gtid := strings.ToLower(strings.TrimSpace(untilGTID))
+		if _, err := mysql.ParseGTIDSet(gtidFlavor(gtid), gtid); err != nil || strings.ContainsAny(gtid, ",") {
+			return nil, fmt.Errorf("invalid until-gtid: %s, expected a single GTID (e.g., 3e11fa47-71ca-11e1-9e33-c80aa9429562:23 or 0-1-100)", untilGTID)
+		}
+		return &recoveryTarget{GTID: gtid}, nil
+	}
+}
+
+// String describes the recovery target for log messages.
+func (t *recoveryTarget) String() string {
+	switch {
+	case !t.Time.IsZero():
+		return "time " + t.Time.Format(time.RFC3339)
+	case t.File != "":
+		return fmt.Sprintf("position %s:%d", t.File, t.Position)
+	default:
+		return "GTID " + t.GTID
+	}
+}
+
+// coveredBy reports whether a full backup taken at the given coordinates can serve as the base of the recovery,
+// that is whether the backup was taken before the target.
+//
+// Parameters:
+// - set: The candidate backup set.
+//
+// Returns:
+// - bool: True if the backup set precedes the target, otherwise false.
+func (t *recoveryTarget) coveredBy(set BackupSet) bool {
+	if set.Binlog == nil {
+		return false
+	}
+	switch {
+	case !t.Time.IsZero():
+		return !set.EndTime.After(t.Time)
+	case t.File != "":
+		return compareBinlogPosition(set.Binlog.File, set.Binlog.Position, t.File, t.Position) <= 0
+	default:
+		if set.Binlog.GTIDSet == "" {
+			return false
+		}
+		executed, err := mysql.ParseGTIDSet(gtidFlavor(set.Binlog.GTIDSet), set.Binlog.GTIDSet)
+		if err != nil {
+			return false
+		}
+		target, err := mysql.ParseGTIDSet(gtidFlavor(t.GTID), t.GTID)
+		if err != nil {
+			return false
+		}
+		return !executed.Contain(target)
+	}
+}
+
+// gtidFlavor detects the server flavor of a GTID or GTID set from its format.
+// MySQL GTIDs are written as uuid:number, MariaDB GTIDs as domain-server-sequence.
+//
+// Parameters:
+// - gtid: The GTID or GTID set.
+//
+// Returns:
+// - string: The flavor, mysql or mariadb.
+func gtidFlavor(gtid string) string {
+	if strings.Contains(gtid, ":") {
+		return mysql.MySQLFlavor
+	}
+	return mysql.MariaDBFlavor
+}
+
+// compareBinlogPosition orders two binary log positions.
+// Binary log files are ordered by their numeric extension, falling back to the file name.
+//
+// Parameters:
+// - fileA: The binary log file of the first position.
+// - posA: The offset of the first position.
+// - fileB: The binary log file of the second position.
+// - posB: The offset of the second position.
+//
+// Returns:
+// - int: -1 if the first position is earlier, 1 if it is later, 0 if both are equal.
+func compareBinlogPosition(fileA string, posA uint32, fileB string, posB uint32) int {
+	if fileA != fileB {
+		seqA, errA := strconv.ParseUint(strings.TrimPrefix(path.Ext(fileA), "."), 10, 64)
+		seqB, errB := strconv.ParseUint(strings.TrimPrefix(path.Ext(fileB), "."), 10, 64)
+		if errA == nil && errB == nil && seqA != seqB {
+			if seqA < seqB {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(fileA, fileB)
+	}
+	switch {
+	case posA < posB:
+		return -1
+	case posA > posB:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// selectBaseBackup picks the newest completed backup set taken before the recovery target.
+//
+// Parameters:
+// - sets: The backup sets of the catalog, oldest first.
+// - target: The recovery target.
+// - database: The database to recover, empty for all databases.
+//
+// Returns:
+// - BackupSet: The backup set to restore before applying binary logs.
+// - error: An error if no backup set precedes the target.
+func selectBaseBackup(sets []BackupSet, target *recoveryTarget, database string) (BackupSet, error) {
+	for i := len(sets) - 1; i >= 0; i-- {
+		set := sets[i]
+		// A partial set of several databases can still hold a usable dump of the requested one.
+		if set.Status == manifestStatusFailed || (database == "" && set.Status != manifestStatusCompleted) {
+			continue
+		}
+		if database == "" && set.Type != backupTypeAll {
+			continue
+		}
+		if database != "" && !containsString(set.Databases, database) {
+			continue
+		}
+		if target.coveredBy(set) {
+			return set, nil
+		}
+	}
+	if database == "" {
+		return BackupSet{}, fmt.Errorf("no completed full backup of all databases with binlog coordinates found before %s", target)
+	}
+	return BackupSet{}, fmt.Errorf("no full backup of database %s with binlog coordinates found before %s", database, target)
+}
+
+// restoreToPoint restores a full backup and replays the archived binary logs up to the recovery target.
+// The newest full backup taken before the target is restored, then the binlog chunks following it are
+// replayed from the binlog coordinates recorded in its manifest, stopping before the target transaction.
+// The recovery fails before restoring anything when the archived chunks start after those coordinates.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - backupS3Dir: The storage directory (prefix) to search for the full backup, empty for the whole storage.
+// - restoreDir: The local directory where the backups are downloaded to (unused when streaming).
+// - streaming: A boolean indicating whether to restore directly from the storage backend.
+// - database: The database to recover, empty for all databases.
+// - target: The recovery target.
+//
+// Returns:
+// - error: An error if the recovery fails, otherwise nil.
+func (db *DB) restoreToPoint(ctx context.Context, backupS3Dir, restoreDir string, streaming bool, database string, target *recoveryTarget) error {
+	log.Printf("point-in-time recovery to %s started..!", target)
+
+	// Binlog chunks are stored by week, so they are searched in the whole storage.
+	sets, chunks, err := scanCatalog(ctx, db.Storage, "")
+	if err != nil {
+		return err
+	}
+	if backupS3Dir != "" {
+		var inDir []BackupSet
+		for _, set := range sets {
+			if strings.HasPrefix(set.ManifestKey, backupS3Dir) {
+				inDir = append(inDir, set)
+			}
+		}
+		sets = inDir
+	}
+
+	base, err := selectBaseBackup(sets, target, database)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(ctx, db.Storage, base.ManifestKey)
+	if err != nil {
+		return err
+	}
+	// Each dump of a set of several databases has its own snapshot, replay starts from that of the restored one.
+	var backupKey string
+	start := *base.Binlog
+	for _, file := range manifest.Files {
+		if file.Database == database && file.Error == "" {
+			backupKey = file.Key
+			if file.Binlog != nil {
+				start = *file.Binlog
+			}
+		}
+	}
+	if backupKey == "" {
+		return fmt.Errorf("backup set %s holds no usable backup file for %s", base.ID, describeDatabase(database))
+	}
+
+	// Chunks after a break in the chain belong to the chain of a later full backup.
+	var chainEnd time.Time
+	if len(base.Gaps) > 0 {
+		gap := base.Gaps[0]
+		if !target.Time.IsZero() && !gap.LastEventTime.IsZero() && target.Time.After(gap.LastEventTime) {
+			return fmt.Errorf("binlogs after %s:%d (%s) were not archived (%s), recover to an earlier time or one after the next full backup", gap.LastFile, gap.LastPosition, gap.LastEventTime.Local().Format(time.RFC1123), gap.Reason)
+		}
+		log.Printf("binlog chain of backup set %s breaks after %s:%d, replay stops there", base.ID, gap.LastFile, gap.LastPosition)
+		chainEnd = gap.DetectedAt
+	}
+
+	// Chunks are selected by the binlog coordinates of the backup, the time of the chunks only bounds the chain.
+	var replay []binlogChunk
+	for _, chunk := range chunksAfter(chunks, &start, base.StartTime) {
+		if chainEnd.IsZero() || chunk.Started.Before(chainEnd) {
+			replay = append(replay, chunk)
+		}
+	}
+	if len(replay) > 0 {
+		if err := checkChainStart(ctx, db, db.Storage, replay[0], start); err != nil {
+			return err
+		}
+	}
+	log.Printf("restoring backup set %s (binlog %s:%d) and %d binlog chunks", base.ID, start.File, start.Position, len(replay))
+
+	source := db.Storage
+	if !streaming {
+		keys := []string{backupKey}
+		for _, chunk := range replay {
+			keys = append(keys, chunk.Key)
+		}
+		if err := stageObjects(ctx, db.Storage, keys, restoreDir); err != nil {
+			return fmt.Errorf("failed to download from storage: %w", err)
+		}
+		source = &fsStorage{root: restoreDir}
+	}
+
+	if err := restoreFullBackup(ctx, db, source, backupKey, database); err != nil {
+		return fmt.Errorf("failed to restore full backup %s: %w", backupKey, err)
+	}
+	if err := applyBinlogChunks(ctx, db, source, replay, start, target, database); err != nil {
+		return fmt.Errorf("failed to replay binlogs: %w", err)
+	}
+	log.Printf("point-in-time recovery to %s finished..!", target)
+	return nil
+}
+
+// checkChainStart verifies that the first chunk replayed holds the binlog events following the coordinates of the
+// restored backup, so no transaction between the snapshot and the archived chunks is silently skipped.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - db: The database configuration object holding the encryption settings.
+// - st: The storage holding the chunk.
+// - first: The first chunk replayed.
+// - start: The binlog coordinates of the restored backup.
+//
+// Returns:
+// - error: An error if the chunk starts after the coordinates or cannot be read, otherwise nil.
+func checkChainStart(ctx context.Context, db *DB, st Storage, first binlogChunk, start binlogCoordinates) error {
+	if start.File == "" {
+		return nil
+	}
+	if first.BinlogFile != start.File {
+		return fmt.Errorf("binlogs after %s:%d were not archived, the first binlog chunk %s starts in %s", start.File, start.Position, first.Key, first.BinlogFile)
+	}
+	reader, err := openBackupReader(ctx, db, st, first.Key)
+	if err != nil {
+		return fmt.Errorf("failed to open binlog chunk %s: %w", first.Key, err)
+	}
+	defer reader.Close()
+	position, found, err := firstEventPosition(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read binlog chunk %s: %w", first.Key, err)
+	}
+	if found && position > start.Position {
+		return fmt.Errorf("binlogs after %s:%d were not archived, the first binlog chunk %s starts at %s:%d", start.File, start.Position, first.Key, first.BinlogFile, position)
+	}
+	return nil
+}
+
+// firstEventPosition reads the binlog position of the first event of a chunk following its header events.
+//
+// Parameters:
+// - r: The reader over the decoded chunk.
+//
+// Returns:
+// - uint32: The position the first event starts at.
+// - bool: True if the chunk holds an event, otherwise false.
+// - error: An error if the chunk is malformed.
+func firstEventPosition(r io.Reader) (uint32, bool, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(len(replication.BinLogFileHeader)); err == nil && bytes.Equal(magic, replication.BinLogFileHeader) {
+		reader.Discard(len(magic))
+	}
+
+	header := &replication.EventHeader{}
+	raw := make([]byte, replication.EventHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			if err == io.EOF {
+				return 0, false, nil
+			}
+			return 0, false, fmt.Errorf("truncated event header: %w", err)
+		}
+		if err := header.Decode(raw); err != nil {
+			return 0, false, err
+		}
+		switch header.EventType {
+		case replication.FORMAT_DESCRIPTION_EVENT, replication.ROTATE_EVENT, replication.HEARTBEAT_EVENT, replication.PREVIOUS_GTIDS_EVENT, replication.MARIADB_GTID_LIST_EVENT:
+		default:
+			if header.LogPos > 0 {
+				return header.LogPos - header.EventSize, true, nil
+			}
+		}
+		if _, err := reader.Discard(int(header.EventSize) - replication.EventHeaderSize); err != nil {
+			return 0, false, fmt.Errorf("truncated event: %w", err)
+		}
+	}
+}
+
+// describeDatabase names the database being recovered in messages.
+//
+// Parameters:
+// - database: The database name, empty for all databases.
+//
+// Returns:
+// - string: A description of the database.
+func describeDatabase(database string) string {
+	if database == "" {
+		return "all databases"
+	}
+	return "database " + database
+}
+
+// stageObjects downloads objects to a local directory, keeping their storage keys as relative paths.
+// The metadata stored next to encrypted files is downloaded along with them.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - st: The storage backend holding the objects.
+// - keys: The storage keys of the objects to download.
+// - dir: The local directory receiving the objects.
+//
+// Returns:
+// - error: An error if an object cannot be downloaded, otherwise nil.
+func stageObjects(ctx context.Context, st Storage, keys []string, dir string) error {
+	for _, key := range keys {
+		if isEncryptedName(key) {
+			keys = append(keys, key+artifactMetaSuffix)
+		}
+	}
+	for _, key := range keys {
+		if !filepath.IsLocal(filepath.FromSlash(key)) {
+			return fmt.Errorf("storage key %s does not name a file below the restore directory", key)
+		}
+		destFile := filepath.Join(dir, filepath.FromSlash(key))
+		log.Printf("Downloading %s to %s", key, destFile)
+		if err := downloadFile(ctx, st, key, destFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBinlogChunks replays binlog chunks through mysqlbinlog and the mysql client, up to the recovery target.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - db: The database configuration object.
+// - st: The storage holding the chunks.
+// - chunks: The chunks to replay, in order.
+// - start: The binlog coordinates already contained in the restored full backup.
+// - target: The recovery target, nil to replay every chunk.
+// - database: The database to recover, empty for all databases.
+//
+// Returns:
+// - error: An error if a chunk cannot be read or replaying fails, otherwise nil.
+func applyBinlogChunks(ctx context.Context, db *DB, st Storage, chunks []binlogChunk, start binlogCoordinates, target *recoveryTarget, database string) error {
+	cutter, err := newBinlogCutter(nil, start, target)
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	cutter.out = writer
+
+	errc := make(chan error, 1)
+	go func() {
+		err := cutter.feedChunks(ctx, db, st, chunks)
+		errc <- err
+		writer.CloseWithError(err)
+	}()
+
+	buffered := bufio.NewReader(reader)
+	if _, err := buffered.Peek(1); err != nil {
+		if err != io.EOF {
+			return err
+		}
+		if err := <-errc; err != nil {
+			return err
+		}
+		log.Printf("no binlog events to replay after %s:%d", start.File, start.Position)
+		return nil
+	}
+
+	applyErr := restoreFromRawBinlog(ctx, db, buffered, database)
+	// A read error is only the cause of the failure when the chunks could not be read before the replay ended,
+	// otherwise it is the closed pipe left behind by a failing mysql client.
+	var readErr error
+	select {
+	case readErr = <-errc:
+		if readErr != nil {
+			return readErr
+		}
+	default:
+		reader.CloseWithError(io.ErrClosedPipe)
+		readErr = <-errc
+	}
+	if applyErr != nil {
+		return applyErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	if target == nil {
+		log.Printf("replayed %d binlog events", cutter.events)
+	} else if cutter.reached {
+		log.Printf("replayed %d binlog events, stopped before %s", cutter.events, target)
+	} else {
+		log.Printf("replayed %d binlog events, the archived binlogs end before %s", cutter.events, target)
+	}
+	return nil
+}
+
+// binlogCutter writes the binlog events of consecutive chunks as a single binary log stream, skipping the
+// events already contained in the full backup and stopping at the transaction reaching the recovery target.
+//
+// Fields:
+// - out: The writer receiving the binary log stream.
+// - applied: The position of the last event written (or contained in the full backup).
+// - executed: The GTIDs contained in the full backup or written, nil to skip events by position instead.
+// - skipping: A boolean indicating whether the events of the current transaction are skipped.
+// - target: The recovery target, nil when every event is written.
+// - fde: The format description event of the binary log the events belong to.
+// - started: A boolean indicating whether the binary log header has been written.
+// - reached: A boolean indicating whether the target was reached.
+// - events: The number of events written.
+type binlogCutter struct {
+	out      io.Writer
+	applied  binlogCoordinates
+	executed mysql.GTIDSet
+	skipping bool
+	target   *recoveryTarget
+	fde      []byte
+	started  bool
+	reached  bool
+	events   int
+}
+
+// newBinlogCutter creates a binlogCutter.
+// When the full backup recorded an executed GTID set, transactions are skipped by GTID rather than by position.
+//
+// Parameters:
+// - out: The writer receiving the binary log stream.
+// - start: The binlog coordinates already contained in the restored full backup.
+// - target: The recovery target, nil to write every event.
+//
+// Returns:
+// - *binlogCutter: The binlog cutter.
+// - error: An error if the executed GTID set of the full backup cannot be parsed.
+func newBinlogCutter(out io.Writer, start binlogCoordinates, target *recoveryTarget) (*binlogCutter, error) {
+	cutter := &binlogCutter{out: out, applied: start, target: target}
+	if start.GTIDSet != "" {
+		executed, err := mysql.ParseGTIDSet(gtidFlavor(start.GTIDSet), start.GTIDSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse executed GTID set %q: %w", start.GTIDSet, err)
+		}
+		cutter.executed = executed
+		// Events preceding the first transaction of the archive belong to the full backup.
+		cutter.skipping = true
+	}
+	return cutter, nil
+}
+
+// feed writes the events of a chunk, read from r, that follow the events already written.
+//
+// Parameters:
+// - file: The binary log file the events of the chunk belong to.
+// - r: The reader over the decoded chunk.
+//
+// Returns:
+// - bool: True if the target was reached and no further chunk is needed.
+// - error: An error if the chunk is malformed or writing fails.
+func (c *binlogCutter) feed(file string, r io.Reader) (bool, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(len(replication.BinLogFileHeader)); err == nil && bytes.Equal(magic, replication.BinLogFileHeader) {
+		reader.Discard(len(magic))
+	}
+
+	header := &replication.EventHeader{}
+	raw := make([]byte, replication.EventHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, raw[:replication.EventHeaderSize]); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, fmt.Errorf("truncated event header: %w", err)
+		}
+		if err := header.Decode(raw); err != nil {
+			return false, err
+		}
+		event := make([]byte, header.EventSize)
+		copy(event, raw)
+		if _, err := io.ReadFull(reader, event[replication.EventHeaderSize:]); err != nil {
+			return false, fmt.Errorf("truncated event at %s:%d: %w", file, header.LogPos, err)
+		}
+
+		switch header.EventType {
+		case replication.FORMAT_DESCRIPTION_EVENT:
+			c.fde = event
+			if c.started {
+				if err := c.write(event); err != nil {
+					return false, err
+				}
+			}
+			continue
+		case replication.ROTATE_EVENT, replication.HEARTBEAT_EVENT, replication.PREVIOUS_GTIDS_EVENT, replication.MARIADB_GTID_LIST_EVENT:
+			continue
+		}
+
+		// Skip events already contained in the full backup or written from an overlapping chunk.
+		// With GTIDs a whole transaction is skipped or kept, based on the GTID event opening it.
+		gtid := ""
+		if isTransactionStart(header.EventType) {
+			gtid = eventGTID(header, event)
+		}
+		if c.executed != nil && gtid != "" {
+			set, err := mysql.ParseGTIDSet(gtidFlavor(gtid), gtid)
+			if err != nil {
+				return false, fmt.Errorf("invalid GTID %s at %s:%d: %w", gtid, file, header.LogPos, err)
+			}
+			c.skipping = c.executed.Contain(set)
+		} else if c.executed == nil {
+			c.skipping = header.LogPos == 0 || compareBinlogPosition(file, header.LogPos, c.applied.File, c.applied.Position) <= 0
+		}
+		if c.skipping {
+			continue
+		}
+
+		if isTransactionStart(header.EventType) && c.reachedBy(file, header, event) {
+			c.reached = true
+			return true, nil
+		}
+
+		if !c.started {
+			if c.fde == nil {
+				return false, fmt.Errorf("no format description event before %s:%d", file, header.LogPos)
+			}
+			if err := c.write(replication.BinLogFileHeader); err != nil {
+				return false, err
+			}
+			if err := c.write(c.fde); err != nil {
+				return false, err
+			}
+			c.started = true
+		}
+		if err := c.write(event); err != nil {
+			return false, err
+		}
+		c.applied = binlogCoordinates{File: file, Position: header.LogPos}
+		if c.executed != nil && gtid != "" {
+			if err := c.executed.Update(gtid); err != nil {
+				return false, fmt.Errorf("invalid GTID %s at %s:%d: %w", gtid, file, header.LogPos, err)
+			}
+		}
+		c.events++
+	}
+}
+
+// feedChunks writes the events of consecutive chunks until the target is reached.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - db: The database configuration object holding the encryption settings.
+// - st: The storage holding the chunks.
+// - chunks: The chunks to read, in order.
+//
+// Returns:
+// - error: An error if a chunk cannot be read or writing fails, otherwise nil.
+func (c *binlogCutter) feedChunks(ctx context.Context, db *DB, st Storage, chunks []binlogChunk) error {
+	for _, chunk := range chunks {
+		reader, err := openBackupReader(ctx, db, st, chunk.Key)
+		if err != nil {
+			return fmt.Errorf("failed to open binlog chunk %s: %w", chunk.Key, err)
+		}
+		done, err := c.feed(chunk.BinlogFile, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read binlog chunk %s: %w", chunk.Key, err)
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// write writes data to the output stream.
+func (c *binlogCutter) write(data []byte) error {
+	_, err := c.out.Write(data)
+	return err
+}
+
+// reachedBy reports whether the transaction starting with the given event is at or past the recovery target.
+//
+// Parameters:
+// - file: The binary log file of the event.
+// - header: The header of the event.
+// - event: The raw event, including its header.
+//
+// Returns:
+// - bool: True if the transaction must not be applied, otherwise false.
+func (c *binlogCutter) reachedBy(file string, header *replication.EventHeader, event []byte) bool {
+	switch {
+	case c.target == nil:
+		return false
+	case !c.target.Time.IsZero():
+		return int64(header.Timestamp) >= c.target.Time.Unix()
+	case c.target.File != "":
+		return compareBinlogPosition(file, header.LogPos-header.EventSize, c.target.File, c.target.Position) >= 0
+	default:
+		return eventGTID(header, event) == c.target.GTID
+	}
+}
+
+// isTransactionStart reports whether an event opens a transaction.
+// Every transaction is preceded by a GTID event, or an anonymous GTID event when GTIDs are disabled.
+//
+// Parameters:
+// - eventType: The type of the event.
+//
+// Returns:
+// - bool: True if the event starts a transaction, otherwise false.
+func isTransactionStart(eventType replication.EventType) bool {
+	switch eventType {
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT, replication.MARIADB_GTID_EVENT:
+		return true
+	default:
+		return false
+	}
+}
+
+// eventGTID returns the GTID carried by a GTID event, in the format of the server flavor.
+//
+// Parameters:
+// - header: The header of the event.
+// - event: The raw event, including its header.
+//
+// Returns:
+// - string: The GTID (e.g., "3e11fa47-71ca-11e1-9e33-c80aa9429562:23" or "0-1-100"), empty for other events.
+func eventGTID(header *replication.EventHeader, event []byte) string {
+	body := event[replication.EventHeaderSize:]
+	switch header.EventType {
+	case replication.GTID_EVENT:
+		if len(body) < 25 {
+			return ""
+		}
+		sid := body[1:17]
+		gno := binary.LittleEndian.Uint64(body[17:25])
+		return fmt.Sprintf("%x-%x-%x-%x-%x:%d", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], gno)
+	case replication.MARIADB_GTID_EVENT:
+		if len(body) < 12 {
+			return ""
+		}
+		seq := binary.LittleEndian.Uint64(body[0:8])
+		domain := binary.LittleEndian.Uint32(body[8:12])
+		return fmt.Sprintf("%d-%d-%d", domain, header.ServerID, seq)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// testServerUUID is the server UUID of the GTIDs in the test binlogs.
+const testServerUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+// testBinlog builds the events of a binlog chunk, with positions following each other as in a binlog file.
+//
+// Fields:
+// - data: The chunk, starting with the binlog magic bytes and a format description event.
+// - position: The position following the last event.
+// - starts: The position each transaction starts at, by GTID number.
+type testBinlog struct {
+	data     bytes.Buffer
+	position uint32
+	starts   map[uint64]uint32
+}
+
+// newTestBinlog starts a chunk whose first event follows the format description event of the binlog at position.
+func newTestBinlog(position uint32) *testBinlog {
+	b := &testBinlog{position: position, starts: map[uint64]uint32{}}
+	b.data.Write(replication.BinLogFileHeader)
+	b.data.Write(testEvent(replication.FORMAT_DESCRIPTION_EVENT, testTime(0), 0, make([]byte, 95)))
+	return b
+}
+
+// testTime returns the time of the transaction with the given GTID number, a minute apart from each other.
+func testTime(gno uint64) time.Time {
+	return time.Date(2024, 5, 6, 12, int(gno), 0, 0, time.UTC)
+}
+
+// testEvent encodes a binlog event with a checksum placeholder.
+func testEvent(eventType replication.EventType, timestamp time.Time, logPos uint32, body []byte) []byte {
+	event := make([]byte, replication.EventHeaderSize, replication.EventHeaderSize+len(body)+replication.BinlogChecksumLength)
+	binary.LittleEndian.PutUint32(event[0:], uint32(timestamp.Unix()))
+	event[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(event[5:], 1)
+	binary.LittleEndian.PutUint32(event[9:], uint32(cap(event)))
+	binary.LittleEndian.PutUint32(event[13:], logPos)
+	event = append(event, body...)
+	return append(event, make([]byte, replication.BinlogChecksumLength)...)
+}
+
+// add appends an event at the current position.
+func (b *testBinlog) add(eventType replication.EventType, timestamp time.Time, body []byte) {
+	b.position += uint32(replication.EventHeaderSize + len(body) + replication.BinlogChecksumLength)
+	b.data.Write(testEvent(eventType, timestamp, b.position, body))
+}
+
+// transaction appends the GTID, BEGIN, row and XID events of a transaction.
+func (b *testBinlog) transaction(gno uint64) *testBinlog {
+	b.starts[gno] = b.position
+	gtid := make([]byte, 42)
+	gtid[0] = 1
+	copy(gtid[1:17], []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62})
+	binary.LittleEndian.PutUint64(gtid[17:], gno)
+	b.add(replication.GTID_EVENT, testTime(gno), gtid)
+	b.add(replication.QUERY_EVENT, testTime(gno), []byte("BEGIN"))
+	b.add(replication.WRITE_ROWS_EVENTv2, testTime(gno), make([]byte, 32))
+	b.add(replication.XID_EVENT, testTime(gno), make([]byte, 8))
+	return b
+}
+
+// writtenGTIDs returns the GTIDs of the transactions in a binlog stream written by a binlogCutter.
+func writtenGTIDs(t *testing.T, stream []byte) []string {
+	if len(stream) == 0 {
+		return nil
+	}
+	if !bytes.HasPrefix(stream, replication.BinLogFileHeader) {
+		t.Fatalf("stream does not start with the binlog magic bytes")
+	}
+	stream = stream[len(replication.BinLogFileHeader):]
+	var gtids []string
+	header := &replication.EventHeader{}
+	for first := true; len(stream) > 0; first = false {
+		if err := header.Decode(stream); err != nil {
+			t.Fatal(err)
+		}
+		if first && header.EventType != replication.FORMAT_DESCRIPTION_EVENT {
+			t.Fatalf("stream starts with a %s", header.EventType)
+		}
+		if gtid := eventGTID(header, stream[:header.EventSize]); gtid != "" {
+			gtids = append(gtids, gtid)
+		}
+		stream = stream[header.EventSize:]
+	}
+	return gtids
+}
+
+// TestBinlogCutter replays chunks from the coordinates of a full backup up to a recovery target.
+func TestBinlogCutter(t *testing.T) {
+	chunk := newTestBinlog(157).transaction(1).transaction(2).transaction(3).transaction(4)
+	starts := chunk.starts
+	gtid := func(gnos ...int) []string {
+		var gtids []string
+		for _, gno := range gnos {
+			gtids = append(gtids, fmt.Sprintf("%s:%d", testServerUUID, gno))
+		}
+		return gtids
+	}
+
+	tests := []struct {
+		name    string
+		start   binlogCoordinates
+		target  *recoveryTarget
+		want    []string
+		reached bool
+	}{
+		{"every event", binlogCoordinates{}, nil, gtid(1, 2, 3, 4), false},
+		{"skip by position", binlogCoordinates{File: "binlog.000042", Position: starts[3]}, nil, gtid(3, 4), false},
+		{"skip by GTID", binlogCoordinates{File: "binlog.000042", Position: 157, GTIDSet: testServerUUID + ":1-2"}, nil, gtid(3, 4), false},
+		{"GTID set wins over position", binlogCoordinates{File: "binlog.000042", Position: starts[4], GTIDSet: testServerUUID + ":1"}, nil, gtid(2, 3, 4), false},
+		{"stop at position", binlogCoordinates{}, &recoveryTarget{File: "binlog.000042", Position: starts[3]}, gtid(1, 2), true},
+		{"stop inside a transaction", binlogCoordinates{}, &recoveryTarget{File: "binlog.000042", Position: starts[3] + 70}, gtid(1, 2, 3), true},
+		{"stop at a later binlog", binlogCoordinates{}, &recoveryTarget{File: "binlog.000043", Position: 4}, gtid(1, 2, 3, 4), false},
+		{"stop at time", binlogCoordinates{}, &recoveryTarget{Time: testTime(3)}, gtid(1, 2), true},
+		{"stop between transactions", binlogCoordinates{}, &recoveryTarget{Time: testTime(3).Add(-30 * time.Second)}, gtid(1, 2), true},
+		{"stop at GTID", binlogCoordinates{}, &recoveryTarget{GTID: testServerUUID + ":3"}, gtid(1, 2), true},
+		{"skip and stop", binlogCoordinates{File: "binlog.000042", Position: starts[2]}, &recoveryTarget{GTID: testServerUUID + ":4"}, gtid(2, 3), true},
+		{"target before the first transaction replayed", binlogCoordinates{File: "binlog.000042", Position: starts[4]}, &recoveryTarget{Time: testTime(2)}, nil, true},
+		{"nothing to replay", binlogCoordinates{GTIDSet: testServerUUID + ":1-4"}, nil, nil, false},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		cutter, err := newBinlogCutter(&out, tc.start, tc.target)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		done, err := cutter.feed("binlog.000042", bytes.NewReader(chunk.data.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := writtenGTIDs(t, out.Bytes()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: replayed %v, want %v", tc.name, got, tc.want)
+		}
+		if done != tc.reached || cutter.reached != tc.reached {
+			t.Errorf("%s: reached = %v, %v, want %v", tc.name, done, cutter.reached, tc.reached)
+		}
+	}
+}
+
+// TestBinlogCutterOverlappingChunks skips the events of a chunk already written from the previous one and joins
+// chunks of consecutive binlogs.
+func TestBinlogCutterOverlappingChunks(t *testing.T) {
+	first := newTestBinlog(157).transaction(1).transaction(2)
+	overlapping := newTestBinlog(157).transaction(1).transaction(2).transaction(3)
+	next := newTestBinlog(157).transaction(4)
+
+	for _, start := range []binlogCoordinates{{}, {GTIDSet: testServerUUID + ":1"}} {
+		var out bytes.Buffer
+		cutter, err := newBinlogCutter(&out, start, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range []struct {
+			file   string
+			binlog *testBinlog
+		}{
+			{"binlog.000042", first},
+			{"binlog.000042", overlapping},
+			{"binlog.000043", next},
+		} {
+			if _, err := cutter.feed(chunk.file, bytes.NewReader(chunk.binlog.data.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := []string{testServerUUID + ":1", testServerUUID + ":2", testServerUUID + ":3", testServerUUID + ":4"}
+		if start.GTIDSet != "" {
+			want = want[1:]
+		}
+		if got := writtenGTIDs(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("start %+v: replayed %v, want %v", start, got, want)
+		}
+	}
+}
+
+// TestBinlogCutterTruncatedChunk rejects a chunk ending inside an event.
+func TestBinlogCutterTruncatedChunk(t *testing.T) {
+	chunk := newTestBinlog(157).transaction(1).data.Bytes()
+	cutter, err := newBinlogCutter(&bytes.Buffer{}, binlogCoordinates{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cutter.feed("binlog.000042", bytes.NewReader(chunk[:len(chunk)-3])); err == nil {
+		t.Error("truncated chunk accepted")
+	}
+}
+
+// TestParseRecoveryTarget parses the until-time, until-position and until-gtid restore arguments.
+func TestParseRecoveryTarget(t *testing.T) {
+	tests := []struct {
+		untilTime, untilPosition, untilGTID string
+		want                                *recoveryTarget
+		wantErr                             bool
+	}{
+		{"", "", "", nil, false},
+		{"2024-05-06 12:03:00", "", "", &recoveryTarget{Time: time.Date(2024, 5, 6, 12, 3, 0, 0, time.Local)}, false},
+		{"2024-05-06T12:03:00Z", "", "", &recoveryTarget{Time: time.Date(2024, 5, 6, 12, 3, 0, 0, time.UTC)}, false},
+		{"2024-05-06", "", "", &recoveryTarget{Time: time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local)}, false},
+		{"yesterday", "", "", nil, true},
+		{"", "binlog.000042:1337", "", &recoveryTarget{File: "binlog.000042", Position: 1337}, false},
+		{"", "binlog.000042", "", nil, true},
+		{"", ":1337", "", nil, true},
+		{"", "binlog.000042:-1", "", nil, true},
+		{"", "binlog.000042:4294967296", "", nil, true},
+		{"", "", " 3E11FA47-71CA-11E1-9E33-C80AA9429562:23 ", &recoveryTarget{GTID: testServerUUID + ":23"}, false},
+		{"", "", "0-1-100", &recoveryTarget{GTID: "0-1-100"}, false},
+		{"", "", testServerUUID + ":1," + testServerUUID + ":2", nil, true},
+		{"", "", "not-a-gtid", nil, true},
+		{"2024-05-06", "binlog.000042:1337", "", nil, true},
+		{"", "binlog.000042:1337", "0-1-100", nil, true},
+	}
+	for _, tc := range tests {
+		got, err := parseRecoveryTarget(tc.untilTime, tc.untilPosition, tc.untilGTID)
+		if (err != nil) != tc.wantErr || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseRecoveryTarget(%q, %q, %q) = %+v, %v, want %+v, error %v", tc.untilTime, tc.untilPosition, tc.untilGTID, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// TestFirstEventPosition reads the position of the first event of a chunk, which checkChainStart compares with the
+// coordinates of the restored backup.
+func TestFirstEventPosition(t *testing.T) {
+	chunk := newTestBinlog(4711).transaction(1)
+	position, found, err := firstEventPosition(bytes.NewReader(chunk.data.Bytes()))
+	if err != nil || !found || position != 4711 {
+		t.Errorf("firstEventPosition = %d, %v, %v, want 4711, true", position, found, err)
+	}
+	if _, found, err := firstEventPosition(bytes.NewReader(newTestBinlog(4711).data.Bytes())); err != nil || found {
+		t.Errorf("firstEventPosition of a chunk without events = %v, %v, want false", found, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// minSecretLength is the length below which a secret is not redacted by value, as replacing every occurrence of a
+// one or two character string would garble the logs without hiding anything.
+const minSecretLength = 4
+
+// secretEnvVars lists the environment variables holding secrets, redacted from logs and errors once loaded.
+var secretEnvVars = []string{
+	"MYSQL_PASSWORD",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"BACKUP_ENCRYPTION_KEY",
+	"VAULT_TOKEN",
+	"MYSQL_SSH_KEY_PASSPHRASE",
+}
+
+// passwordOption matches password options written out by hand or echoed by a tool, e.g. "--password=secret"
+// or "password: secret", in case a secret was never registered.
+var passwordOption = regexp.MustCompile(`(?i)(password\s*[=:]\s*)("[^"]*"|'[^']*'|\S+)`)
+
+// secretRegistry holds the secrets redacted from every log line and returned error.
+//
+// Fields:
+// - mu: Guards values, as secrets can be registered while other goroutines log.
+// - values: The registered secrets.
+type secretRegistry struct {
+	mu     sync.RWMutex
+	values map[string]bool
+}
+
+// secrets is the registry of the process.
+var secrets = &secretRegistry{values: map[string]bool{}}
+
+// registerSecret adds a value to the secrets redacted from logs and errors.
+//
+// Parameters:
+// - value: The secret, ignored when shorter than minSecretLength.
+func registerSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.values[value] = true
+}
+
+// registerSecretsFromEnv registers the values of the environment variables listed in secretEnvVars.
+func registerSecretsFromEnv() {
+	for _, name := range secretEnvVars {
+		registerSecret(os.Getenv(name))
+	}
+}
+
+// redact replaces the registered secrets and password options in a string with "***".
+//
+// Parameters:
+// - s: The string to redact.
+//
+// Returns:
+// - string: The string without secrets.
+func redact(s string) string {
+	secrets.mu.RLock()
+	for value := range secrets.values {
+		s = strings.ReplaceAll(s, value, "***")
+	}
+	secrets.mu.RUnlock()
+	return passwordOption.ReplaceAllString(s, "${1}***")
+}
+
+// redactedError is an error whose message is redacted, wrapping the original error for errors.Is and errors.As.
+//
+// Fields:
+// - err: The original error.
+type redactedError struct {
+	err error
+}
+
+// Error returns the message of the original error, without secrets.
+func (e redactedError) Error() string {
+	return redact(e.err.Error())
+}
+
+// Unwrap returns the original error.
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError wraps an error so that its message carries no secret.
+//
+// Parameters:
+// - err: The error to wrap, may be nil.
+//
+// Returns:
+// - error: The redacted error, nil if err is nil.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err: err}
+}
+
+// redactingWriter is an io.Writer redacting secrets from every write, used as the output of the loggers.
+//
+// Fields:
+// - out: The writer receiving the redacted output.
+type redactingWriter struct {
+	out io.Writer
+}
+
+// Write redacts p and writes it to the underlying writer.
+// The logger writes one complete line per call, so a secret is never split between two writes.
+//
+// Parameters:
+// - p: The data to write.
+//
+// Returns:
+// - int: len(p) when the redacted data was written.
+// - error: An error if the underlying writer fails.
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	golog "github.com/siddontang/go-log/log"
+)
+
+const defaultServerID = 100 // Default server ID the incremental backup registers with as a replica.
+
+// errServerIDConflict marks a binlog stream whose server ID is used by another replica of the server.
+// The server keeps one connection per server ID, so two replicas with the same ID keep disconnecting each other.
+var errServerIDConflict = errors.New("replication server ID conflict")
+
+// replicaHost is a replica registered with the server, as listed by SHOW REPLICAS.
+//
+// Fields:
+// - ServerID: The server ID the replica registered with.
+// - Host: The host name the replica reported, empty if none.
+type replicaHost struct {
+	ServerID uint32
+	Host     string
+}
+
+// flavor returns the binlog flavor of the server.
+//
+// Returns:
+// - string: mysql or mariadb.
+func (db *DB) flavor() string {
+	if db.Flavor == "" {
+		return mysql.MySQLFlavor
+	}
+	return db.Flavor
+}
+
+// serverID returns the server ID the incremental backup registers with as a replica.
+//
+// Returns:
+// - uint32: The configured server ID, or the default.
+func (db *DB) serverID() uint32 {
+	if db.ServerID > 0 {
+		return db.ServerID
+	}
+	return defaultServerID
+}
+
+// binlogSyncerConfig builds the settings of the binlog connection: the replication identity, TLS, charset,
+// heartbeat and read timeout.
+//
+// Returns:
+// - replication.BinlogSyncerConfig: The settings of the binlog connection.
+// - error: An error if the TLS settings cannot be loaded or the read timeout is shorter than the heartbeat period.
+func (db *DB) binlogSyncerConfig() (replication.BinlogSyncerConfig, error) {
+	heartbeat := db.HeartbeatPeriod
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeatPeriod
+	}
+	// Without an event or heartbeat for several periods, the connection is considered dead.
+	readTimeout := 3 * heartbeat
+	if db.ReadTimeout > 0 {
+		readTimeout = db.ReadTimeout
+	}
+	if readTimeout <= heartbeat {
+		return replication.BinlogSyncerConfig{}, fmt.Errorf("binlog read timeout %s must be longer than the heartbeat period %s", readTimeout, heartbeat)
+	}
+
+	tlsConfig, err := db.TLS.Config(db.Host)
+	if err != nil {
+		return replication.BinlogSyncerConfig{}, err
+	}
+	// Read on every connect, so a reconnect logs in with rotated credentials.
+	user, password := db.credentials()
+	return replication.BinlogSyncerConfig{
+		ServerID:        db.serverID(),
+		Flavor:          db.flavor(),
+		Host:            db.Host,
+		Port:            uint16(db.Port),
+		User:            user,
+		Password:        password,
+		Localhost:       reportHost(),
+		Dialer:          db.dialServer,
+		Charset:         db.Charset,
+		TLSConfig:       tlsConfig,
+		HeartbeatPeriod: heartbeat,
+		ReadTimeout:     readTimeout,
+		// Reconnects are handled by the archiver, so they resume after the last rotated backup file.
+		DisableRetrySync: true,
+		Logger:           newBinlogLogger(),
+	}, nil
+}
+
+// newBinlogLogger creates the logger of the binlog connection, writing to standard output as the default logger
+// of go-mysql does, with secrets redacted.
+//
+// Returns:
+// - *golog.Logger: The logger of the binlog connection.
+func newBinlogLogger() *golog.Logger {
+	handler, _ := golog.NewStreamHandler(redactingWriter{out: os.Stdout})
+	return golog.NewDefault(handler)
+}
+
+// reportHost returns the host name the incremental backup reports when registering as a replica.
+//
+// Returns:
+// - string: The host name of this machine, or "mbrgo" if it is unknown.
+func reportHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "mbrgo"
+	}
+	return host
+}
+
+// checkServerID verifies that no other replica of the server uses the server ID of the incremental backup.
+// A replica registered with the same ID from this host is taken to be an earlier connection of the incremental
+// backup not yet noticed as closed by the server, which the server replaces.
+//
+// Parameters:
+// - dbConn: The database connection object.
+// - serverID: The server ID the incremental backup registers with.
+// - flavor: The binlog flavor of the server.
+//
+// Returns:
+// - error: An error wrapping errServerIDConflict if the ID is taken, otherwise nil.
+func checkServerID(dbConn *sql.DB, serverID uint32, flavor string) error {
+	var ownID uint32
+	if err := dbConn.QueryRow("SELECT @@GLOBAL.server_id").Scan(&ownID); err != nil {
+		log.Printf("error fetching server ID: %v", err)
+	} else if ownID == serverID {
+		return fmt.Errorf("%w: server ID %d is the ID of the server itself, set MYSQL_SERVER_ID to an unused value", errServerIDConflict, serverID)
+	}
+
+	replicas, err := queryReplicaHosts(dbConn, flavor)
+	if err != nil {
+		// The check is a safeguard, the stream does not depend on it.
+		log.Printf("error listing replicas, server ID %d not checked: %v", serverID, err)
+		return nil
+	}
+	host := reportHost()
+	for _, replica := range replicas {
+		if replica.ServerID != serverID {
+			continue
+		}
+		if replica.Host == host {
+			log.Printf("server ID %d still registered from %s, replacing the earlier connection", serverID, host)
+			continue
+		}
+		return fmt.Errorf("%w: server ID %d is used by the replica on %q, set MYSQL_SERVER_ID to an unused value", errServerIDConflict, serverID, replica.Host)
+	}
+	return nil
+}
+
+// queryReplicaHosts lists the replicas registered with the server.
+// Columns are matched by name, as their names and number differ between servers and versions.
+//
+// Parameters:
+// - dbConn: The database connection object.
+// - flavor: The binlog flavor of the server.
+//
+// Returns:
+// - []replicaHost: The registered replicas.
+// - error: An error if the replicas cannot be listed.
+func queryReplicaHosts(dbConn *sql.DB, flavor string) ([]replicaHost, error) {
+	// SHOW REPLICAS replaces SHOW SLAVE HOSTS from MySQL 8.0.22 and is the only statement left in 8.4.
+	queries := []string{"SHOW REPLICAS", "SHOW SLAVE HOSTS"}
+	if flavor == mysql.MariaDBFlavor {
+		queries = []string{"SHOW SLAVE HOSTS"}
+	}
+
+	var rows []map[string]string
+	var err error
+	for _, query := range queries {
+		if rows, err = queryColumns(dbConn, query); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make([]replicaHost, 0, len(rows))
+	for _, row := range rows {
+		id, err := strconv.ParseUint(row["server_id"], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replica server ID %q: %w", row["server_id"], err)
+		}
+		replicas = append(replicas, replicaHost{ServerID: uint32(id), Host: row["host"]})
+	}
+	return replicas, nil
+}
+
+// queryColumns runs a SHOW statement and returns its rows keyed by lower-case column name.
+//
+// Parameters:
+// - dbConn: The database connection object.
+// - query: The statement to run.
+//
+// Returns:
+// - []map[string]string: The rows returned, NULL values as empty strings.
+// - error: An error if the query fails.
+func queryColumns(dbConn *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := dbConn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			row[strings.ToLower(column)] = values[i].String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// isServerIDConflict reports whether the server closed the binlog stream because another replica connected
+// with the same server ID.
+//
+// Parameters:
+// - myErr: The error sent by the server.
+//
+// Returns:
+// - bool: True if the stream was replaced by a replica with the same server ID, otherwise false.
+func isServerIDConflict(myErr *mysql.MyError) bool {
+	// "A slave with the same server_uuid/server_id as this slave has connected to the master", or
+	// "A replica with the same server_uuid/server_id as this replica has connected to the source".
+	return strings.Contains(myErr.Message, "same server_uuid/server_id")
+}
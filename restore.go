@@ -1,43 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"path"
+	"sort"
 	"strings"
 )
 
-// MysqlRestore restores MySQL databases from backups stored in an S3 bucket.
+// MysqlRestore restores MySQL databases from backups held by the storage backend.
+// By default every backup file is first downloaded to restoreDir. In streaming mode the backups are
+// read straight from the storage backend and piped into the mysql client without a local copy.
 //
 // Parameters:
-// - backupS3Dir: The S3 directory (prefix) containing the backup files.
-// - restoreDir: The local directory where the backups will be downloaded and restored from.
+// - ctx: The context for the restore, the running mysql and mysqlbinlog processes are killed once it is cancelled.
+// - backupS3Dir: The storage directory (prefix) containing the backup files.
+// - restoreDir: The local directory where the backups will be downloaded and restored from (unused when streaming).
+// - streaming: A boolean indicating whether to restore directly from the storage backend.
 // - allDBFull: A boolean indicating whether to restore all databases.
 // - database: The name of a single database to restore (if specified).
 // - databases: A list of database names to restore (if specified).
+// - target: The point to recover to; when set, the newest full backup before it is restored and the archived binlogs are replayed up to it.
 //
 // Returns:
 // - error: An error if the restore process fails, otherwise nil.
-func (db *DB) MysqlRestore(backupS3Dir string, restoreDir string, allDBFull bool, database string, databases []string) error {
+func (db *DB) MysqlRestore(ctx context.Context, backupS3Dir string, restoreDir string, streaming bool, allDBFull bool, database string, databases []string, target *recoveryTarget) error {
 	log.Print("mysql restore function started..!")
 
-	// Download backup files from S3 to the local restore directory.
-	if err := s3Download(backupS3Dir, restoreDir); err != nil {
-		return fmt.Errorf("failed to download from S3: %w", err)
+	if database != "" {
+		if err := validateDatabaseName(database); err != nil {
+			return err
+		}
+	}
+	if err := validateDatabaseNames(databases); err != nil {
+		return err
+	}
+
+	if target != nil {
+		if !allDBFull && (databases != nil || database == "") {
+			return fmt.Errorf("point-in-time recovery supports all databases or a single database")
+		}
+		return db.restoreToPoint(ctx, backupS3Dir, restoreDir, streaming, database, target)
+	}
+	source, prefix := db.Storage, backupS3Dir
+	if !streaming {
+		// Download backup files from storage to the local restore directory.
+		if err := storageDownload(db.Storage, backupS3Dir, restoreDir); err != nil {
+			return fmt.Errorf("failed to download from storage: %w", err)
+		}
+		source, prefix = &fsStorage{root: restoreDir}, ""
 	}
 
 	if allDBFull {
 		log.Print("restoring all databases..!")
-		backupFile, err := findFullBackupFile(restoreDir, "")
+		backupFile, err := findFullBackupFile(ctx, source, prefix, "")
 		if err != nil {
 			return fmt.Errorf("error finding full backup for all databases: %w", err)
 		}
-		if err := restoreFullBackup(db, backupFile, ""); err != nil {
+		if err := restoreFullBackup(ctx, db, source, backupFile, ""); err != nil {
 			return fmt.Errorf("failed to restore full backup for all databases: %w", err)
 		}
-		if err := restoreIncrementalBackup(db, restoreDir); err != nil {
+		if err := restoreIncrementalBackup(ctx, db, source, prefix, backupFile); err != nil {
 			return fmt.Errorf("failed to restore incremental backup: %w", err)
 		}
 		log.Print("Restore all databases completed..!")
@@ -45,28 +73,28 @@ func (db *DB) MysqlRestore(backupS3Dir string, restoreDir string, allDBFull bool
 		if databases != nil {
 			for _, database := range databases {
 				log.Printf("Restoring database: %s", database)
-				backupFile, err := findFullBackupFile(restoreDir, database)
+				backupFile, err := findFullBackupFile(ctx, source, prefix, database)
 				if err != nil {
 					log.Printf("Error finding full backup for database %s: %v", database, err)
 					continue
 				}
-				if err := restoreFullBackup(db, backupFile, database); err != nil {
+				if err := restoreFullBackup(ctx, db, source, backupFile, database); err != nil {
 					log.Printf("failed to restore full backup for database %s: %v", database, err)
 				}
 			}
 		}
 		if database != "" {
 			log.Printf("Restoring database: %s", database)
-			backupFile, err := findFullBackupFile(restoreDir, database)
+			backupFile, err := findFullBackupFile(ctx, source, prefix, database)
 			if err != nil {
 				log.Printf("Error finding full backup for database %s: %v", database, err)
 			} else {
-				if err := restoreFullBackup(db, backupFile, database); err != nil {
+				if err := restoreFullBackup(ctx, db, source, backupFile, database); err != nil {
 					log.Printf("failed to restore full backup for database %s: %v", database, err)
 				}
 			}
 		}
-		if err := restoreIncrementalBackup(db, restoreDir); err != nil {
+		if err := restoreIncrementalBackup(ctx, db, source, prefix, ""); err != nil {
 			return fmt.Errorf("failed to restore incremental backup: %w", err)
 		}
 	}
@@ -74,57 +102,165 @@ func (db *DB) MysqlRestore(backupS3Dir string, restoreDir string, allDBFull bool
 	return nil
 }
 
-// findFullBackupFile locates the full backup file for a specific database or all databases.
+// findFullBackupFile locates the newest full backup file for a specific database or all databases.
+// The file is resolved from the newest manifest holding a stored dump of the database (of a completed set for all
+// databases), so a week with several full backups restores the latest one. Files without a manifest are matched
+// by name, newest first.
 //
 // Parameters:
-// - restorePath: The local directory where the backup files are stored.
+// - ctx: The context for managing cancellations.
+// - st: The storage holding the backup files.
+// - prefix: The storage directory (prefix) containing the backup files.
 // - database: The name of the database to find the backup for (empty for all databases).
 //
 // Returns:
-// - string: The path to the full backup file.
-// - error: An error if the backup file is not found or the directory cannot be read.
-func findFullBackupFile(restorePath, database string) (string, error) {
-	entries, err := os.ReadDir(restorePath)
+// - string: The storage key of the full backup file.
+// - error: An error if the backup file is not found or the storage cannot be listed.
+func findFullBackupFile(ctx context.Context, st Storage, prefix, database string) (string, error) {
+	objects, err := st.List(ctx, prefix)
 	if err != nil {
 		return "", err
 	}
 
 	var pattern string
 	if database == "" {
-		pattern = "all_databases_full_backup.sql"
+		pattern = "_all_databases_full_backup.sql"
 	} else {
 		// For individual database backups.
-		pattern = fmt.Sprintf("%s_full_backup.sql", database)
+		pattern = fmt.Sprintf("_%s_full_backup.sql", database)
+	}
+
+	// Files are named after the start of their backup set, so the greatest name is the newest.
+	keys := map[string]string{}
+	var manifests []string
+	var newest string
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if isTempFile(name) || isArtifactMeta(name) {
+			continue
+		}
+		keys[name] = object.Key
+		if isManifestName(name) {
+			manifests = append(manifests, object.Key)
+		} else if strings.HasSuffix(trimArtifactExt(name), pattern) && (newest == "" || name > path.Base(newest)) {
+			newest = object.Key
+		}
 	}
+	sort.Slice(manifests, func(i, j int) bool { return path.Base(manifests[i]) > path.Base(manifests[j]) })
 
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), pattern) {
-			return filepath.Join(restorePath, entry.Name()), nil
+	for _, manifestKey := range manifests {
+		manifest, err := readManifest(ctx, st, manifestKey)
+		if err != nil {
+			log.Printf("skipping backup set: %v", err)
+			continue
+		}
+		if database == "" && (!manifest.AllDatabases || manifest.Status != manifestStatusCompleted) {
+			continue
+		}
+		for _, file := range manifest.Files {
+			if file.Database != database || file.Error != "" {
+				continue
+			}
+			if key, ok := keys[file.Name]; ok {
+				return key, nil
+			}
 		}
 	}
+	if newest != "" {
+		log.Printf("no manifest lists a full backup for pattern %s, using the newest file %s", pattern, newest)
+		return newest, nil
+	}
 	return "", fmt.Errorf("backup file not found for pattern: %s", pattern)
 }
 
+// openBackupReader opens a backup file held by the storage for reading.
+// Encrypted and compressed backup files are decrypted and decompressed transparently, based on their extensions.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - db: The database configuration object holding the encryption settings.
+// - st: The storage holding the backup file.
+// - key: The storage key of the backup file.
+//
+// Returns:
+// - io.ReadCloser: A reader over the content of the backup file.
+// - error: An error if the backup file cannot be opened.
+func openBackupReader(ctx context.Context, db *DB, st Storage, key string) (io.ReadCloser, error) {
+	var meta *artifactMeta
+	if isEncryptedName(key) {
+		var err error
+		meta, err = readArtifactMeta(ctx, st, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stored, err := st.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := newArtifactReader(stored, key, meta, db.Encryption)
+	if err != nil {
+		stored.Close()
+		return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	return readCloser{Reader: decoded, closers: []io.Closer{decoded, stored}}, nil
+}
+
+// readCloser is an io.ReadCloser that closes a chain of underlying readers.
+//
+// Fields:
+// - Reader: The reader data is read from.
+// - closers: The closers invoked, in order, by Close.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes every underlying reader and returns the first error.
+func (r readCloser) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // restoreFullBackup restores a full backup for a specific database or all databases.
+// The backup is piped into the mysql client as it is read from the storage.
 //
 // Parameters:
+// - ctx: The context for managing cancellations.
 // - db: The database configuration object.
-// - backupFile: The path to the full backup file.
+// - st: The storage holding the backup file.
+// - backupFile: The storage key of the full backup file.
 // - targetDatabase: The name of the database to restore (empty for all databases).
 //
 // Returns:
 // - error: An error if the restore process fails, otherwise nil.
-func restoreFullBackup(db *DB, backupFile string, targetDatabase string) error {
-	var commandStr string
-	if targetDatabase == "" {
-		commandStr = fmt.Sprintf("mysql --host %s --port %d --user %s --password=%s < %s",
-			db.Host, db.Port, db.User, db.Password, backupFile)
-	} else {
-		commandStr = fmt.Sprintf("mysql --host %s --port %d --user %s --password=%s %s < %s",
-			db.Host, db.Port, db.User, db.Password, targetDatabase, backupFile)
+func restoreFullBackup(ctx context.Context, db *DB, st Storage, backupFile string, targetDatabase string) error {
+	reader, err := openBackupReader(ctx, db, st, backupFile)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file %s: %w", backupFile, err)
 	}
+	defer reader.Close()
 
-	command := exec.Command("sh", "-c", commandStr)
+	var args []string
+	if targetDatabase != "" {
+		if err := validateDatabaseName(targetDatabase); err != nil {
+			return err
+		}
+		args = append(args, "--database="+targetDatabase)
+	}
+
+	command, cleanup, err := db.mysqlCommand(ctx, "mysql", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	command.Stdin = reader
 	output, err := command.CombinedOutput()
 	if err != nil {
 		if targetDatabase == "" {
@@ -132,7 +268,7 @@ func restoreFullBackup(db *DB, backupFile string, targetDatabase string) error {
 		} else {
 			restoreError(err, targetDatabase, output)
 		}
-		return err
+		return redactError(err)
 	} else {
 		if targetDatabase == "" {
 			log.Printf("restore of all databases completed successfully")
@@ -162,46 +298,143 @@ func restoreError(err error, database string, output []byte) {
 	}
 }
 
-// restoreIncrementalBackup restores incremental backups from binary logs.
+// restoreIncrementalBackup restores incremental backups from the binlog chunks stored under prefix.
+// The chunks are replayed in order as a single binlog stream, skipping the events already contained in the
+// full backup when its manifest records binlog coordinates.
 //
 // Parameters:
+// - ctx: The context for managing cancellations.
 // - db: The database configuration object.
-// - restorePath: The local directory where the incremental backups are stored.
+// - st: The storage holding the incremental backups.
+// - prefix: The storage directory (prefix) containing the incremental backups.
+// - fullBackupKey: The storage key of the restored full backup of all databases, empty if none was restored.
 //
 // Returns:
 // - error: An error if the restore process fails, otherwise nil.
-func restoreIncrementalBackup(db *DB, restorePath string) error {
+func restoreIncrementalBackup(ctx context.Context, db *DB, st Storage, prefix string, fullBackupKey string) error {
 	log.Print("mysql restore incremental backup function started..!")
 
-	weeklyBinlogPath := filepath.Join(restorePath, "weekly-binlog.log")
-	if _, err := os.Stat(weeklyBinlogPath); err == nil {
-		log.Printf("Restoring binlog from weekly-binlog.log: %s", weeklyBinlogPath)
-		if err := restoreFromRawBinlog(db, weeklyBinlogPath); err != nil {
-			return fmt.Errorf("failed to restore from weekly binlog: %w", err)
+	objects, err := st.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list incremental backups: %w", err)
+	}
+
+	var chunks []binlogChunk
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if isTempFile(name) || isArtifactMeta(name) {
+			continue
+		}
+		if chunk, ok := parseChunkName(name); ok {
+			chunk.Key = object.Key
+			chunks = append(chunks, chunk)
 		}
-	} else {
-		log.Printf("weekly-binlog.log not found in backup directory: %s", restorePath)
 	}
-	return nil
+	if len(chunks) == 0 {
+		log.Printf("no binlog chunks found in backup directory: %s", prefix)
+		return nil
+	}
+	sortChunks(chunks)
+
+	var start binlogCoordinates
+	if fullBackupKey != "" {
+		start = fullBackupCoordinates(ctx, st, fullBackupKey)
+	}
+	log.Printf("Restoring %d binlog chunks from %s", len(chunks), prefix)
+	return applyBinlogChunks(ctx, db, st, chunks, start, nil, "")
 }
 
-// restoreFromRawBinlog restores data from a raw binary log file.
+// fullBackupCoordinates reads the binlog coordinates recorded in the manifest of a full backup.
 //
 // Parameters:
+// - ctx: The context for managing cancellations.
+// - st: The storage holding the full backup.
+// - fullBackupKey: The storage key of the full backup.
+//
+// Returns:
+// - binlogCoordinates: The coordinates of the full backup, empty if its manifest is missing.
+func fullBackupCoordinates(ctx context.Context, st Storage, fullBackupKey string) binlogCoordinates {
+	tokens := strings.SplitN(path.Base(fullBackupKey), "_", 3)
+	if len(tokens) < 3 {
+		return binlogCoordinates{}
+	}
+	manifestKey := path.Join(path.Dir(fullBackupKey), tokens[0]+"_"+tokens[1]+"_backup_manifest.json")
+	manifest, err := readManifest(ctx, st, manifestKey)
+	if err != nil || manifest.Binlog == nil {
+		log.Printf("no binlog coordinates for %s, replaying every binlog chunk: %v", fullBackupKey, err)
+		return binlogCoordinates{}
+	}
+	return *manifest.Binlog
+}
+
+// restoreFromRawBinlog restores data from a raw binary log.
+// The binary log is decoded by mysqlbinlog from its standard input and piped into the mysql client.
+// When mysql fails, mysqlbinlog is stopped and the mysql error is returned.
+//
+// Parameters:
+// - ctx: The context for the restore, mysqlbinlog and mysql are killed once it is cancelled.
 // - db: The database configuration object.
-// - backupFile: The path to the binary log file.
+// - binlog: A reader over the binary log.
+// - database: The only database whose events are replayed, empty for all databases.
 //
 // Returns:
 // - error: An error if the restore process fails, otherwise nil.
-func restoreFromRawBinlog(db *DB, backupFile string) error {
-	commandStr := fmt.Sprintf("mysqlbinlog --host=%s --port=%d --user=%s --password=%s %s | mysql --host=%s --port=%d --user=%s --password=%s",
-		db.Host, db.Port, db.User, db.Password, backupFile,
-		db.Host, db.Port, db.User, db.Password)
-	command := exec.Command("sh", "-c", commandStr)
-	output, err := command.CombinedOutput()
+func restoreFromRawBinlog(ctx context.Context, db *DB, binlog io.Reader, database string) error {
+	decodeArgs := []string{"-"}
+	if database != "" {
+		if err := validateDatabaseName(database); err != nil {
+			return err
+		}
+		decodeArgs = []string{"--database=" + database, "-"}
+	}
+	decodeCommand := exec.CommandContext(ctx, "mysqlbinlog", decodeArgs...)
+	decodeCommand.Stdin = binlog
+	var decodeOutput, applyOutput bytes.Buffer
+	decodeCommand.Stderr = &decodeOutput
+
+	applyCommand, cleanup, err := db.mysqlCommand(ctx, "mysql")
 	if err != nil {
-		log.Printf("failed to restore from binlog: %v, output: %s", err, output)
 		return err
+	}
+	defer cleanup()
+	applyCommand.Stdout = &applyOutput
+	applyCommand.Stderr = &applyOutput
+
+	// The pipe is created here so that the copies of its ends held by this process can be closed once both
+	// commands have started: mysqlbinlog then fails on a closed pipe instead of blocking when mysql exits early.
+	decoded, decodedWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to open mysqlbinlog output: %w", err)
+	}
+	decodeCommand.Stdout = decodedWriter
+	applyCommand.Stdin = decoded
+
+	if err := applyCommand.Start(); err != nil {
+		decoded.Close()
+		decodedWriter.Close()
+		return fmt.Errorf("failed to start mysql: %w", err)
+	}
+	if err := decodeCommand.Start(); err != nil {
+		decoded.Close()
+		decodedWriter.Close()
+		applyCommand.Process.Kill()
+		applyCommand.Wait()
+		return fmt.Errorf("failed to start mysqlbinlog: %w", err)
+	}
+	decoded.Close()
+	decodedWriter.Close()
+
+	applyErr := applyCommand.Wait()
+	if applyErr != nil {
+		decodeCommand.Process.Kill()
+	}
+	decodeErr := decodeCommand.Wait()
+	if decodeErr != nil || applyErr != nil {
+		log.Printf("failed to restore from binlog: mysqlbinlog: %v, output: %s, mysql: %v, output: %s", decodeErr, decodeOutput.Bytes(), applyErr, applyOutput.Bytes())
+		if applyErr != nil {
+			return redactError(applyErr)
+		}
+		return redactError(decodeErr)
 	} else {
 		log.Print("restore from binlog completed successfully")
 	}
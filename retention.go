@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention is the policy deciding which backups are removed from the storage.
+// Backups are removed in whole chains: a full backup of all databases together with the binlog chunks and gap
+// markers following it, and every other backup set taken before the next full backup of all databases.
+//
+// Fields:
+// - KeepFullBackups: The number of most recent completed full backups of all databases always kept, 0 for no minimum.
+// - MaxAgeDays: The number of days point-in-time recovery must be able to reach back, 0 to keep backups regardless of age.
+type Retention struct {
+	KeepFullBackups int
+	MaxAgeDays      int
+}
+
+// retentionFromEnv reads the retention policy from BACKUP_RETENTION_KEEP_FULL_BACKUPS and BACKUP_RETENTION_MAX_AGE_DAYS.
+//
+// Returns:
+// - Retention: The retention policy, disabled when neither is set.
+// - error: An error if a value is not a non-negative integer.
+func retentionFromEnv() (Retention, error) {
+	var r Retention
+	if v := os.Getenv("BACKUP_RETENTION_KEEP_FULL_BACKUPS"); v != "" {
+		keep, err := strconv.Atoi(v)
+		if err != nil || keep < 0 {
+			return r, fmt.Errorf("BACKUP_RETENTION_KEEP_FULL_BACKUPS must be a non-negative integer, got %q", v)
+		}
+		r.KeepFullBackups = keep
+	}
+	if v := os.Getenv("BACKUP_RETENTION_MAX_AGE_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return r, fmt.Errorf("BACKUP_RETENTION_MAX_AGE_DAYS must be a non-negative integer, got %q", v)
+		}
+		r.MaxAgeDays = days
+	}
+	return r, nil
+}
+
+// Enabled reports whether the policy removes any backup.
+//
+// Returns:
+// - bool: True if a minimum number of full backups or a maximum age is set, otherwise false.
+func (r Retention) Enabled() bool {
+	return r.KeepFullBackups > 0 || r.MaxAgeDays > 0
+}
+
+// cutoff returns the start time of the oldest full backup of all databases the policy keeps.
+// Everything stored before it can be removed.
+// With a maximum age, the newest full backup taken before that age is kept, so the whole window can be recovered.
+//
+// Parameters:
+// - sets: The backup sets of the catalog, oldest first.
+// - now: The current time.
+//
+// Returns:
+// - time.Time: The start of the oldest chain kept, zero if nothing can be removed.
+func (r Retention) cutoff(sets []BackupSet, now time.Time) time.Time {
+	var fulls []time.Time
+	for _, set := range sets {
+		if set.Type == backupTypeAll && set.Status == manifestStatusCompleted {
+			fulls = append(fulls, set.StartTime)
+		}
+	}
+	if !r.Enabled() || len(fulls) == 0 {
+		return time.Time{}
+	}
+
+	cutoff := fulls[len(fulls)-1]
+	if r.KeepFullBackups > 0 {
+		if len(fulls) <= r.KeepFullBackups {
+			return time.Time{}
+		}
+		cutoff = fulls[len(fulls)-r.KeepFullBackups]
+	}
+	if r.MaxAgeDays > 0 {
+		bound := now.AddDate(0, 0, -r.MaxAgeDays)
+		var byAge time.Time
+		for _, start := range fulls {
+			if !start.After(bound) {
+				byAge = start
+			}
+		}
+		if byAge.IsZero() {
+			return time.Time{}
+		}
+		if byAge.Before(cutoff) {
+			cutoff = byAge
+		}
+	}
+	return cutoff
+}
+
+// pruneBackups removes the backups the retention policy no longer keeps: the files, metadata and manifests of the
+// backup sets, the binlog chunks and the gap markers stored before the oldest chain kept.
+// The chunk spanning the binlog coordinates of a kept backup set is kept, so the set can still be recovered to a point.
+//
+// Parameters:
+// - ctx: The context for managing cancellations.
+// - st: The storage holding the backups.
+// - r: The retention policy.
+// - dryRun: True to only log what would be removed.
+//
+// Returns:
+// - int: The number of objects removed, or that would be removed in a dry run.
+// - error: An error if the catalog cannot be loaded or an object cannot be removed.
+func pruneBackups(ctx context.Context, st Storage, r Retention, dryRun bool) (int, error) {
+	if !r.Enabled() {
+		return 0, nil
+	}
+	sets, chunks, err := scanCatalog(ctx, st, "")
+	if err != nil {
+		return 0, err
+	}
+	cutoff := r.cutoff(sets, time.Now())
+	if cutoff.IsZero() {
+		log.Print("retention: no backup to remove")
+		return 0, nil
+	}
+
+	// The chunk spanning the snapshot of a kept set is stored before it, but its events are replayed from there.
+	expired, kept := map[string]bool{}, map[string]bool{}
+	for _, set := range sets {
+		if set.StartTime.Before(cutoff) {
+			expired[set.Dir+"/"+set.ID] = true
+			continue
+		}
+		if set.Binlog == nil {
+			continue
+		}
+		for _, chunk := range chunksAfter(chunks, set.Binlog, set.StartTime) {
+			if chunk.Started.Before(cutoff) {
+				kept[chunk.Key] = true
+			}
+		}
+	}
+	objects, err := st.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	removed := 0
+	for _, object := range objects {
+		if !isExpiredObject(object.Key, expired, kept, cutoff) {
+			continue
+		}
+		if dryRun {
+			log.Printf("retention: would remove %s", object.Key)
+		} else {
+			if err := st.Delete(ctx, object.Key); err != nil {
+				return removed, fmt.Errorf("failed to remove %s: %w", object.Key, err)
+			}
+			log.Printf("retention: removed %s", object.Key)
+		}
+		removed++
+	}
+	if dryRun {
+		log.Printf("retention: %d objects stored before %s would be removed", removed, cutoff.Local().Format(time.RFC1123))
+	} else {
+		log.Printf("retention: %d objects stored before %s removed", removed, cutoff.Local().Format(time.RFC1123))
+	}
+	return removed, nil
+}
+
+// isExpiredObject reports whether a stored object belongs to a chain the retention policy removes.
+//
+// Parameters:
+// - key: The storage key of the object.
+// - expired: The backup sets removed, as "<dir>/<id>".
+// - kept: The keys of the chunks stored before the cutoff that a kept backup set is replayed from.
+// - cutoff: The start of the oldest chain kept.
+//
+// Returns:
+// - bool: True if the object is removed, otherwise false.
+func isExpiredObject(key string, expired, kept map[string]bool, cutoff time.Time) bool {
+	name := strings.TrimSuffix(path.Base(key), artifactMetaSuffix)
+	if isTempFile(name) {
+		return false
+	}
+	if chunk, ok := parseChunkName(name); ok {
+		return chunk.Started.Before(cutoff) && !kept[strings.TrimSuffix(key, artifactMetaSuffix)]
+	}
+	if isBinlogGapName(name) {
+		detected, err := time.ParseInLocation("20060102_150405", strings.TrimSuffix(name, binlogGapSuffix), time.Local)
+		return err == nil && detected.Before(cutoff)
+	}
+	// The files of a backup set are named after its ID, a "20060102_150405" timestamp.
+	if len(name) > len("20060102_150405") {
+		return expired[path.Dir(key)+"/"+name[:len("20060102_150405")]]
+	}
+	return false
+}
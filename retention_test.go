@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetentionCutoff finds the start of the oldest chain kept by the number of full backups and the maximum age.
+func TestRetentionCutoff(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 1, 0, 0, 0, time.UTC)
+	}
+	full := func(d int, status string) BackupSet {
+		return BackupSet{Type: backupTypeAll, Status: status, StartTime: day(d)}
+	}
+	sets := []BackupSet{
+		full(1, manifestStatusCompleted),
+		full(8, manifestStatusCompleted),
+		{Type: backupTypeSingle, Status: manifestStatusCompleted, StartTime: day(10)},
+		full(15, manifestStatusCompleted),
+		full(20, manifestStatusPartial),
+		full(22, manifestStatusCompleted),
+	}
+	now := day(25)
+
+	tests := []struct {
+		name   string
+		policy Retention
+		sets   []BackupSet
+		want   time.Time
+	}{
+		{"disabled", Retention{}, sets, time.Time{}},
+		{"keep two full backups", Retention{KeepFullBackups: 2}, sets, day(15)},
+		{"keep every full backup", Retention{KeepFullBackups: 4}, sets, time.Time{}},
+		{"keep more full backups than exist", Retention{KeepFullBackups: 5}, sets, time.Time{}},
+		{"maximum age", Retention{MaxAgeDays: 10}, sets, day(15)},
+		{"maximum age between full backups", Retention{MaxAgeDays: 12}, sets, day(8)},
+		{"maximum age before every full backup", Retention{MaxAgeDays: 30}, sets, time.Time{}},
+		{"maximum age older than kept full backups", Retention{KeepFullBackups: 1, MaxAgeDays: 10}, sets, day(15)},
+		{"kept full backups older than maximum age", Retention{KeepFullBackups: 3, MaxAgeDays: 1}, sets, day(8)},
+		{"no full backup", Retention{KeepFullBackups: 1}, sets[2:3], time.Time{}},
+	}
+	for _, tc := range tests {
+		if got := tc.policy.cutoff(tc.sets, now); !got.Equal(tc.want) {
+			t.Errorf("%s: cutoff = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestIsExpiredObject decides which stored objects belong to the chains removed before the cutoff.
+func TestIsExpiredObject(t *testing.T) {
+	cutoff := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+	expired := map[string]bool{"2024/01/Monday/20240108_000000": true}
+	kept := map[string]bool{"2024/01/Sunday/incr_backup_binlog.000042_3_20240114_230000.log.enc": true}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"2024/01/Monday/20240108_000000_all_databases_full_backup.sql.zst", true},
+		{"2024/01/Monday/20240108_000000_all_databases_full_backup.sql.zst.enc.meta.json", true},
+		{"2024/01/Monday/20240108_000000_backup_manifest.json", true},
+		{"2024/01/Monday/20240115_000000_all_databases_full_backup.sql.zst", false},
+		{"2024/01/Tuesday/20240108_000000_shop_full_backup.sql", false},
+		{"2024/01/Monday/incr_backup_binlog.000041_0_20240108_000500.log", true},
+		{"2024/01/Monday/incr_backup_binlog.000041_1_20240108_000500.log.gz.enc.meta.json", true},
+		{"2024/01/Sunday/incr_backup_binlog.000042_3_20240114_230000.log.enc", false},
+		{"2024/01/Sunday/incr_backup_binlog.000042_3_20240114_230000.log.enc.meta.json", false},
+		{"2024/01/Monday/incr_backup_binlog.000042_4_20240115_000000.log", false},
+		{"2024/01/Sunday/20240114_120000_binlog_gap.json", true},
+		{"2024/01/Monday/20240115_120000_binlog_gap.json", false},
+		{"2024/01/Monday/.20240108_000000_backup_manifest.json.tmp-123", false},
+		{"checkpoint.json", false},
+	}
+	for _, tc := range tests {
+		if got := isExpiredObject(tc.key, expired, kept, cutoff); got != tc.want {
+			t.Errorf("isExpiredObject(%s) = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+// TestPruneBackups prunes the chains before the oldest full backup kept from an in-memory storage, keeping the chunk
+// spanning the snapshot of that backup.
+func TestPruneBackups(t *testing.T) {
+	ctx := context.Background()
+	st := newMemStorage()
+	// Chunk names hold the local time they were started at.
+	manifest := func(id string, day int, binlog string) string {
+		start := time.Date(2024, 1, day, 0, 0, 0, 0, time.Local).Format(time.RFC3339)
+		return `{"version":1,"id":"` + id + `","all_databases":true,"status":"completed","start_time":"` + start +
+			`","binlog":{"file":"` + binlog + `","position":4711},"files":[{"name":"` + id + `_all_databases_full_backup.sql"}]}`
+	}
+	objects := map[string]string{
+		"2024/01/Monday/20240101_000000_all_databases_full_backup.sql":   "dump",
+		"2024/01/Monday/20240101_000000_backup_manifest.json":            manifest("20240101_000000", 1, "binlog.000041"),
+		"2024/01/Monday/20240108_000000_all_databases_full_backup.sql":   "dump",
+		"2024/01/Monday/20240108_000000_backup_manifest.json":            manifest("20240108_000000", 8, "binlog.000042"),
+		"2024/01/Monday/20240115_000000_all_databases_full_backup.sql":   "dump",
+		"2024/01/Monday/20240115_000000_backup_manifest.json":            manifest("20240115_000000", 15, "binlog.000043"),
+		"2024/01/Monday/incr_backup_binlog.000041_0_20240101_000500.log": "chunk",
+		"2024/01/Sunday/incr_backup_binlog.000042_0_20240107_120000.log": "chunk spanning the second backup",
+		"2024/01/Monday/incr_backup_binlog.000042_1_20240108_120000.log": "chunk",
+		"2024/01/Monday/incr_backup_binlog.000043_2_20240115_120000.log": "chunk",
+	}
+	for key, content := range objects {
+		if err := st.Put(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := pruneBackups(ctx, st, Retention{KeepFullBackups: 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("pruneBackups removed %d objects, want 3", removed)
+	}
+	for key := range objects {
+		_, err := st.Stat(ctx, key)
+		wantRemoved := strings.Contains(key, "20240101_")
+		if (err != nil) != wantRemoved {
+			t.Errorf("%s: removed = %v, want %v", key, err != nil, wantRemoved)
+		}
+	}
+}
@@ -4,113 +4,244 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 )
 
 // EnableAllBackupScheduler enables a backup scheduler for MySQL databases.
-// It schedules full and incremental backups to run at a specified weekday and time.
+// It schedules full and incremental backups to run at a specified weekday and time, until ctx is cancelled.
+// On shutdown, a running full backup is given the shutdown timeout to finish and the incremental backup
+// stores its last chunk and checkpoint before it returns.
 //
 // Parameters:
+// - ctx: The context cancelled when a shutdown is requested.
 // - dbConn: The database connection object.
 // - weekday: The day of the week when the backup should run (e.g., "Monday").
 // - hour: The time of day when the backup should run (in "HH:MM" format).
 // - backupLocalDir: The local directory where backups will be stored.
 //
 // Returns:
-// - error: An error if the scheduler setup fails, otherwise nil.
-func (db *DB) EnableAllBackupScheduler(dbConn *sql.DB, weekday string, hour string, backupLocalDir string) error {
+// - error: An error if the scheduler setup fails, otherwise nil once ctx is cancelled.
+func (db *DB) EnableAllBackupScheduler(ctx context.Context, dbConn *sql.DB, weekday string, hour string, backupLocalDir string) error {
+	scheduler, err := NewBackupScheduler(db, dbConn, weekday, hour, backupLocalDir)
+	if err != nil {
+		return err
+	}
+	scheduler.Run(ctx)
+	return nil
+}
+
+// SchedulerStatus reports the state of a BackupScheduler.
+//
+// Fields:
+// - NextFullBackup: The time the next full backup is scheduled at, zero once the scheduler stopped.
+// - LastFullBackup: The time the last scheduled full backup finished, zero before the first.
+// - LastFullBackupError: The error of the last scheduled full backup, empty if it succeeded.
+// - Incremental: The state of the incremental backup, not running before the first full backup.
+type SchedulerStatus struct {
+	NextFullBackup      time.Time      `json:"next_full_backup"`
+	LastFullBackup      time.Time      `json:"last_full_backup"`
+	LastFullBackupError string         `json:"last_full_backup_error,omitempty"`
+	Incremental         ArchiverStatus `json:"incremental"`
+}
+
+// BackupScheduler takes a full backup of all databases of a server every week and keeps an incremental backup
+// running from each full backup to the next. All state of the schedule is held by the scheduler, so several servers
+// can be scheduled from one process.
+//
+// Fields:
+// - db: The database configuration object.
+// - dbConn: The database connection object.
+// - weekday: The day of the week when the backup runs.
+// - hour: The time of day when the backup runs.
+// - backupDir: The local directory where backups are stored.
+// - mu: Guards archiver and status.
+// - archiver: The binlog archiver running the incremental backup, nil before the first backup.
+// - status: The state of the schedule reported by Status, without the incremental backup.
+type BackupScheduler struct {
+	db        *DB
+	dbConn    *sql.DB
+	weekday   time.Weekday
+	hour      time.Time
+	backupDir string
+
+	mu       sync.Mutex
+	archiver *BinlogArchiver
+	status   SchedulerStatus
+}
+
+// NewBackupScheduler creates a scheduler of weekly full backups and the incremental backups between them.
+//
+// Parameters:
+// - db: The database configuration object.
+// - dbConn: The database connection object.
+// - weekday: The day of the week when the backup should run (e.g., "Monday").
+// - hour: The time of day when the backup should run (in "HH:MM" format).
+// - backupDir: The local directory where backups will be stored.
+//
+// Returns:
+// - *BackupScheduler: The scheduler, not running yet.
+// - error: An error if the weekday or hour is invalid.
+func NewBackupScheduler(db *DB, dbConn *sql.DB, weekday string, hour string, backupDir string) (*BackupScheduler, error) {
 	weekdayTime, err := parseWeekday(weekday)
 	if err != nil {
-		return fmt.Errorf("invalid weekday: %v", err)
+		return nil, fmt.Errorf("invalid weekday: %v", err)
 	}
 
 	hourTime, err := time.Parse("15:04", hour)
 	if err != nil {
-		return fmt.Errorf("invalid hour: %v", err)
+		return nil, fmt.Errorf("invalid hour: %v", err)
 	}
 
-	rootCtx, rootCancel := context.WithCancel(context.Background())
-	defer rootCancel()
-
-	var incCancel context.CancelFunc
-
-	go scheduleBackup(db, rootCtx, dbConn, weekdayTime, hourTime, &incCancel, backupLocalDir)
-	select {}
+	return &BackupScheduler{db: db, dbConn: dbConn, weekday: weekdayTime, hour: hourTime, backupDir: backupDir}, nil
 }
 
-// scheduleBackup schedules full and incremental backups to run periodically.
+// Run schedules full and incremental backups to run periodically.
+// Once rootCtx is cancelled, it stops the incremental backup and returns.
 //
 // Parameters:
-// - db: The database configuration object.
 // - rootCtx: The root context for managing cancellations.
-// - dbConn: The database connection object.
-// - weekday: The day of the week when the backup should run.
-// - hour: The time of day when the backup should run.
-// - incCancel: A pointer to a context cancel function for incremental backups.
-// - backupLocalDir: The local directory where backups will be stored.
-func scheduleBackup(db *DB, rootCtx context.Context, dbConn *sql.DB, weekday time.Weekday, hour time.Time, incCancel *context.CancelFunc, backupLocalDir string) {
+func (s *BackupScheduler) Run(rootCtx context.Context) {
 	now := time.Now()
-	nextBackup := time.Date(now.Year(), now.Month(), now.Day(), hour.Hour(), hour.Minute(), 0, 0, now.Location())
-	if now.After(nextBackup) || now.Weekday() != weekday {
-		daysToAdd := (int(weekday) - int(now.Weekday()) + 7) % 7
+	nextBackup := time.Date(now.Year(), now.Month(), now.Day(), s.hour.Hour(), s.hour.Minute(), 0, 0, now.Location())
+	if now.After(nextBackup) || now.Weekday() != s.weekday {
+		daysToAdd := (int(s.weekday) - int(now.Weekday()) + 7) % 7
 		if daysToAdd == 0 || now.After(nextBackup) {
 			daysToAdd = 7
 		}
 		nextBackup = nextBackup.AddDate(0, 0, daysToAdd)
-		log.Printf("first backup scheduled at %s", nextBackup.Format(time.RFC1123))
+		s.db.logf("first backup scheduled at %s", nextBackup.Format(time.RFC1123))
 	}
+	s.setNextBackup(nextBackup)
 	duration := time.Until(nextBackup)
 	timer := time.NewTimer(duration)
 	defer timer.Stop()
+	defer s.stopArchiver(s.db.shutdownTimeout())
+	defer s.setNextBackup(time.Time{})
 	select {
 	case <-timer.C:
-		log.Println("timer expired, scheduling backup...")
-		backup(db, rootCtx, dbConn, incCancel, backupLocalDir)
+		s.db.logf("timer expired, scheduling backup...")
+		s.backup(rootCtx)
 		ticker := time.NewTicker(7 * 24 * time.Hour)
 		defer ticker.Stop()
+		s.setNextBackup(time.Now().Add(7 * 24 * time.Hour))
 		for {
 			select {
 			case <-ticker.C:
-				backup(db, rootCtx, dbConn, incCancel, backupLocalDir)
+				s.setNextBackup(time.Now().Add(7 * 24 * time.Hour))
+				s.backup(rootCtx)
 			case <-rootCtx.Done():
-				log.Println("root context cancelled, stopping backup scheduler")
+				s.db.logf("root context cancelled, stopping backup scheduler")
 				return
 			}
 		}
 	case <-rootCtx.Done():
-		log.Println("root context cancelled, stopping backup scheduler")
+		s.db.logf("root context cancelled, stopping backup scheduler")
 		timer.Stop()
 	}
 }
 
-// backup performs a full backup and schedules an incremental backup.
+// setNextBackup records the time of the next full backup.
+//
+// Parameters:
+// - next: The time of the next full backup, zero once the scheduler stops.
+func (s *BackupScheduler) setNextBackup(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.NextFullBackup = next
+}
+
+// backup performs a full backup and restarts the incremental backup.
+// The running binlog archiver is stopped, and its last backup files stored, before the next one starts,
+// so two streams never write to the backup directory at the same time.
+// Once a full backup succeeded, the backups the retention policy no longer keeps are removed.
 //
 // Parameters:
-// - db: The database configuration object.
 // - rootCtx: The root context for managing cancellations.
-// - dbConn: The database connection object.
-// - incCancel: A pointer to a context cancel function for incremental backups.
-// - backupLocalDir: The local directory where backups will be stored.
-func backup(db *DB, rootCtx context.Context, dbConn *sql.DB, incCancel *context.CancelFunc, backupLocalDir string) {
-	log.Printf("backup taken at %s", time.Now().Format(time.RFC1123))
-	if err := db.MysqlBackup(dbConn, true, "", nil, backupLocalDir); err != nil {
-		log.Printf("Error during full backup: %v", err)
+func (s *BackupScheduler) backup(rootCtx context.Context) {
+	db := s.db
+	db.logf("backup taken at %s", time.Now().Format(time.RFC1123))
+	backupErr := db.MysqlBackup(rootCtx, s.dbConn, true, "", nil, s.backupDir)
+	s.mu.Lock()
+	s.status.LastFullBackup = time.Now()
+	s.status.LastFullBackupError = ""
+	if backupErr != nil {
+		s.status.LastFullBackupError = redact(backupErr.Error())
+	}
+	s.mu.Unlock()
+	if backupErr != nil {
+		db.logf("Error during full backup: %v", backupErr)
+	}
+	if rootCtx.Err() != nil {
+		return
 	}
 
-	if *incCancel != nil {
-		(*incCancel)()
+	s.mu.Lock()
+	previous := s.archiver
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Stop()
 	}
-	incCtx, cancelFunc := context.WithCancel(rootCtx)
-	*incCancel = cancelFunc
+	archiver := NewBinlogArchiver(db, s.dbConn, s.backupDir)
+	s.mu.Lock()
+	s.archiver = archiver
+	s.mu.Unlock()
+
+	go func(a *BinlogArchiver) {
+		db.logf("Incremental backup taken at %s", time.Now().Format(time.RFC1123))
+		if err := a.Run(rootCtx); err != nil {
+			db.logf("Error during incremental backup at %s: %v", time.Now().Format(time.RFC1123), err)
+		}
+	}(archiver)
 
-	go func(ctx context.Context) {
-		log.Printf("Incremental backup taken at %s", time.Now().Format(time.RFC1123))
-		if err := db.MysqlIncrementalBackup(ctx, backupLocalDir); err != nil {
-			log.Printf("Error during incremental backup at %s: %v", time.Now().Format(time.RFC1123), err)
+	// Pruning waits for the previous archiver to store its last chunks, so none is left behind.
+	if backupErr == nil && db.Retention.Enabled() {
+		if _, err := pruneBackups(rootCtx, db.Storage, db.Retention, false); err != nil {
+			db.logf("Error applying retention policy: %v", err)
 		}
-	}(incCtx)
+	}
+}
 
+// stopArchiver stops the binlog archiver run by the scheduler, waiting at most timeout for it to store its
+// last chunk and checkpoint.
+//
+// Parameters:
+// - timeout: The longest time to wait for the archiver.
+func (s *BackupScheduler) stopArchiver(timeout time.Duration) {
+	s.mu.Lock()
+	archiver := s.archiver
+	s.mu.Unlock()
+	if archiver == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		archiver.Stop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		s.db.logf("incremental backup stopped")
+	case <-timer.C:
+		s.db.logf("incremental backup did not stop within the shutdown timeout of %s", timeout)
+	}
+}
+
+// Status returns the state of the schedule and of the incremental backup.
+//
+// Returns:
+// - SchedulerStatus: A snapshot of the state.
+func (s *BackupScheduler) Status() SchedulerStatus {
+	s.mu.Lock()
+	status := s.status
+	archiver := s.archiver
+	s.mu.Unlock()
+	if archiver != nil {
+		status.Incremental = archiver.Status()
+	}
+	return status
 }
 
 // parseWeekday parses a string representation of a weekday into a time.Weekday value.
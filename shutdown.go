@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = time.Minute // Default time given to in-flight work to finish once a shutdown is requested.
+
+// shutdownTimeout returns the time given to in-flight work to finish once a shutdown is requested.
+//
+// Returns:
+// - time.Duration: The configured shutdown timeout, or the default.
+func (db *DB) shutdownTimeout() time.Duration {
+	if db.ShutdownTimeout > 0 {
+		return db.ShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// shutdownContext returns the root context of a command, cancelled on SIGINT or SIGTERM so running backups can
+// finish or be marked aborted. A second signal terminates the process right away.
+//
+// Parameters:
+// - timeout: The time running backups are given to finish, logged when the shutdown is requested.
+//
+// Returns:
+// - context.Context: The root context.
+// - context.CancelFunc: Stops listening for the signals.
+func shutdownContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Printf("shutdown requested, finishing running backups within %s (signal again to exit now)", timeout)
+	}()
+	return ctx, stop
+}
+
+// graceContext derives a context that outlives ctx by a grace period: it is cancelled grace after ctx is done,
+// so work already started can finish while no new work is begun.
+//
+// Parameters:
+// - ctx: The context signalling the shutdown.
+// - grace: The time given to in-flight work once ctx is done.
+//
+// Returns:
+// - context.Context: The context for the in-flight work.
+// - context.CancelFunc: Releases the context once the work is done.
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+	return graceCtx, cancel
+}
+
+// runUntilShutdown runs a task that returns once ctx is done, and waits for it at most timeout after ctx is done.
+//
+// Parameters:
+// - ctx: The context signalling the shutdown, also given to the task.
+// - timeout: The time the task is given to finish once ctx is done.
+// - what: A description of the task, used in log messages.
+// - task: The task to run.
+//
+// Returns:
+// - error: The error returned by the task, or an error if it did not finish within timeout.
+func runUntilShutdown(ctx context.Context, timeout time.Duration, what string, task func(ctx context.Context) error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- task(ctx)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down, waiting up to %s for the %s to finish", timeout, what)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%s did not finish within the shutdown timeout of %s", what, timeout)
+	}
+}
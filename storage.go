@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// errObjectNotFound is returned by Storage implementations when the requested key does not exist.
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes a single object held by a storage backend.
+//
+// Fields:
+// - Key: The key of the object relative to the root of the backend (e.g., "2024/05/file.sql").
+// - Size: The size of the object in bytes.
+// - LastModified: The time the object was last written.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Storage is the destination where backup artifacts are written to and read from.
+// Keys are slash separated paths relative to the root of the backend, using the layout produced by getS3Key.
+type Storage interface {
+	// Put stores everything read from r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the object stored under key for reading. The caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+	// Stat returns information about the object stored under key.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// newStorage creates the storage backend selected by the STORAGE_BACKEND environment variable, keeping every
+// object below STORAGE_PREFIX when it is set.
+//
+// Parameters:
+// - ctx: The context used while initializing the backend.
+//
+// Returns:
+// - Storage: The initialized storage backend.
+// - error: An error if the backend is unknown or cannot be initialized.
+func newStorage(ctx context.Context) (Storage, error) {
+	var st Storage
+	backend := os.Getenv("STORAGE_BACKEND")
+	switch backend {
+	case "", "s3":
+		s3Cfg, err := s3ConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if st, err = newS3Storage(ctx, s3Cfg); err != nil {
+			return nil, err
+		}
+	case "fs":
+		fsSt, err := newFSStorage()
+		if err != nil {
+			return nil, err
+		}
+		st = fsSt
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s, should be one of s3, fs", backend)
+	}
+	return newPrefixStorage(st, os.Getenv("STORAGE_PREFIX")), nil
+}
+
+// storageWriter is an io.WriteCloser that streams everything written to it into a Storage object.
+//
+// Fields:
+// - pw: The write side of the pipe consumed by Storage.Put.
+// - done: Receives the result of Storage.Put once the upload finishes.
+type storageWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newStorageWriter starts a streaming upload of key and returns a writer feeding it.
+// The object is complete only once Close returns without error.
+//
+// Parameters:
+// - ctx: The context for managing the upload.
+// - st: The storage backend to write to.
+// - key: The key of the object to create.
+//
+// Returns:
+// - *storageWriter: The writer feeding the upload.
+func newStorageWriter(ctx context.Context, st Storage, key string) *storageWriter {
+	pr, pw := io.Pipe()
+	w := &storageWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := st.Put(ctx, key, pr)
+		// Unblock the writer if Put gave up before consuming everything.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+// Write sends p to the underlying upload.
+func (w *storageWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close finishes the upload and waits for the storage backend to acknowledge it.
+func (w *storageWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// Abort cancels the upload so that no partial object is left behind.
+//
+// Parameters:
+// - err: The reason the upload is aborted.
+func (w *storageWriter) Abort(err error) {
+	w.pw.CloseWithError(err)
+	<-w.done
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fsStorage is a Storage backed by a local directory, such as a mounted NFS share.
+// Objects are laid out under root exactly like the keys produced by getS3Key.
+//
+// Fields:
+// - root: The directory holding every object.
+type fsStorage struct {
+	root string
+}
+
+// newFSStorage creates a filesystem storage backend rooted at the directory named by STORAGE_FS_ROOT.
+//
+// Returns:
+// - *fsStorage: The initialized filesystem storage backend.
+// - error: An error if the root is not configured or cannot be created.
+func newFSStorage() (*fsStorage, error) {
+	root := os.Getenv("STORAGE_FS_ROOT")
+	if root == "" {
+		return nil, fmt.Errorf("STORAGE_FS_ROOT environment variable is not set")
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage root %s: %w", root, err)
+	}
+	return &fsStorage{root: root}, nil
+}
+
+// path converts a storage key into a file path below the root, refusing keys that escape it.
+//
+// Parameters:
+// - key: The storage key.
+//
+// Returns:
+// - string: The file path of the object.
+func (f *fsStorage) path(key string) string {
+	return filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// Put writes everything read from r to a temporary file and renames it into place once complete,
+// so a partially written object is never visible under its final key.
+func (f *fsStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := writeFileAtomic(f.path(key), r); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens the file stored under key for reading.
+func (f *fsStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, errObjectNotFound)
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	return file, nil
+}
+
+// List walks the directory matching prefix and returns every complete file whose key starts with prefix.
+func (f *fsStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	dir := f.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = f.path(prefix[:i])
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || isTempFile(entry.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects with prefix %s: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (f *fsStorage) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(f.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// Stat returns the size and modification time of the file stored under key.
+func (f *fsStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(f.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, fmt.Errorf("%s: %w", key, errObjectNotFound)
+		}
+		return ObjectInfo{}, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// writeFileAtomic writes everything read from r to dest through a temporary file in the same directory.
+// The temporary file is synced and renamed over dest only once it is complete.
+//
+// Parameters:
+// - dest: The final path of the file.
+// - r: The reader supplying the file content.
+//
+// Returns:
+// - error: An error if the file cannot be written, otherwise nil.
+func writeFileAtomic(dest string, r io.Reader) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), dest, err)
+	}
+
+	// Persist the rename itself so the file survives a crash.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// isTempFile reports whether name is a temporary file created by writeFileAtomic.
+//
+// Parameters:
+// - name: The base name of the file.
+//
+// Returns:
+// - bool: True if the file is an in-progress write, otherwise false.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
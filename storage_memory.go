@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memObject is a single object held by memStorage.
+//
+// Fields:
+// - data: The content of the object.
+// - modified: The time the object was last written.
+type memObject struct {
+	data     []byte
+	modified time.Time
+}
+
+// memStorage is a Storage that keeps every object in memory.
+// It is meant for exercising the backup and restore flow without a real destination.
+//
+// Fields:
+// - mu: Guards objects.
+// - objects: The stored objects keyed by their storage key.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+// newMemStorage creates an empty in-memory storage backend.
+//
+// Returns:
+// - *memStorage: The initialized in-memory storage backend.
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string]memObject)}
+}
+
+// Put reads r fully and stores its content under key.
+func (m *memStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read data for %s: %w", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memObject{data: data, modified: time.Now()}
+	return nil
+}
+
+// Get returns a reader over the object stored under key.
+func (m *memStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, errObjectNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+// List returns every object whose key starts with prefix, sorted by key.
+func (m *memStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []ObjectInfo
+	for key, object := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), LastModified: object.modified})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete removes the object stored under key.
+func (m *memStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// Stat returns information about the object stored under key.
+func (m *memStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, errObjectNotFound)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(object.data)), LastModified: object.modified}, nil
+}
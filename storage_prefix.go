@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// prefixStorage is a Storage keeping every object below a key prefix of another backend, so several servers can
+// share one bucket or directory without their backups mixing.
+// Keys seen by the callers are relative to the prefix, so the layout below it is the one produced by getS3Key.
+//
+// Fields:
+// - inner: The storage backend holding the objects.
+// - prefix: The key prefix, ending with a slash.
+type prefixStorage struct {
+	inner  Storage
+	prefix string
+}
+
+// newPrefixStorage wraps a storage backend so that every key is stored below a prefix.
+//
+// Parameters:
+// - inner: The storage backend holding the objects.
+// - prefix: The key prefix, e.g. "db1" or "prod/db1"; leading and trailing slashes are ignored.
+//
+// Returns:
+// - Storage: The wrapped backend, or inner itself when the prefix is empty.
+func newPrefixStorage(inner Storage, prefix string) Storage {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return inner
+	}
+	return &prefixStorage{inner: inner, prefix: prefix + "/"}
+}
+
+// Put stores everything read from r under the prefixed key.
+func (p *prefixStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	return p.inner.Put(ctx, p.prefix+key, r)
+}
+
+// Get opens the object stored under the prefixed key for reading.
+func (p *prefixStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return p.inner.Get(ctx, p.prefix+key)
+}
+
+// List returns every object below the prefix whose key starts with prefix, with keys relative to the prefix.
+func (p *prefixStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := p.inner.List(ctx, p.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, p.prefix)
+	}
+	return objects, nil
+}
+
+// Delete removes the object stored under the prefixed key.
+func (p *prefixStorage) Delete(ctx context.Context, key string) error {
+	return p.inner.Delete(ctx, p.prefix+key)
+}
+
+// Stat returns information about the object stored under the prefixed key, with its key relative to the prefix.
+func (p *prefixStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := p.inner.Stat(ctx, p.prefix+key)
+	if err != nil {
+		return info, err
+	}
+	info.Key = strings.TrimPrefix(info.Key, p.prefix)
+	return info, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Config holds the settings used to reach AWS S3 or an S3-compatible object store.
+//
+// Fields:
+// - Bucket: The name of the bucket holding the backups.
+// - Endpoint: A custom endpoint URL (e.g., "https://minio.local:9000"), empty for AWS.
+// - Region: Overrides the region resolved from the default AWS configuration.
+// - ForcePathStyle: Addresses objects as endpoint/bucket/key instead of bucket.endpoint/key.
+// - CABundle: The path to a PEM file with additional certificate authorities to trust.
+// - InsecureSkipVerify: Disables TLS certificate verification, for lab setups only.
+// - PartSizeMB: The size of each multipart upload part in MiB.
+// - Concurrency: The number of parts uploaded in parallel. Upload memory is bounded by PartSizeMB * Concurrency.
+type S3Config struct {
+	Bucket             string
+	Endpoint           string
+	Region             string
+	ForcePathStyle     bool
+	CABundle           string
+	InsecureSkipVerify bool
+	PartSizeMB         int64
+	Concurrency        int
+}
+
+// s3ConfigFromEnv reads the S3 settings from the environment.
+//
+// Returns:
+// - S3Config: The S3 settings.
+// - error: An error if a boolean setting cannot be parsed.
+func s3ConfigFromEnv() (S3Config, error) {
+	cfg := S3Config{
+		Bucket:   os.Getenv("AWS_S3_BUCKET"),
+		Endpoint: os.Getenv("AWS_S3_ENDPOINT"),
+		Region:   os.Getenv("AWS_S3_REGION"),
+		CABundle: os.Getenv("AWS_S3_CA_BUNDLE"),
+		// 64 MiB parts keep dumps of several hundred GB within the 10,000 part limit.
+		PartSizeMB:  64,
+		Concurrency: 2,
+	}
+
+	if v := os.Getenv("AWS_S3_FORCE_PATH_STYLE"); v != "" {
+		forcePathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing AWS_S3_FORCE_PATH_STYLE: %v", err)
+		}
+		cfg.ForcePathStyle = forcePathStyle
+	}
+
+	if v := os.Getenv("AWS_S3_INSECURE_SKIP_VERIFY"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing AWS_S3_INSECURE_SKIP_VERIFY: %v", err)
+		}
+		cfg.InsecureSkipVerify = insecure
+	}
+
+	if v := os.Getenv("AWS_S3_PART_SIZE_MB"); v != "" {
+		partSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || partSize < 5 {
+			return cfg, fmt.Errorf("AWS_S3_PART_SIZE_MB must be an integer of at least 5, got %q", v)
+		}
+		cfg.PartSizeMB = partSize
+	}
+
+	if v := os.Getenv("AWS_S3_UPLOAD_CONCURRENCY"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return cfg, fmt.Errorf("AWS_S3_UPLOAD_CONCURRENCY must be a positive integer, got %q", v)
+		}
+		cfg.Concurrency = concurrency
+	}
+
+	return cfg, nil
+}
+
+// s3Storage is a Storage backed by an AWS S3 bucket or an S3-compatible object store.
+// A single client is shared by every operation.
+//
+// Fields:
+// - client: The S3 client.
+// - uploader: The multipart aware uploader built on top of client.
+// - bucket: The name of the S3 bucket holding the backups.
+type s3Storage struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+}
+
+// newS3Storage creates an S3 storage backend from the given settings.
+//
+// Parameters:
+// - ctx: The context used while loading the AWS SDK configuration.
+// - s3Cfg: The S3 settings.
+//
+// Returns:
+// - *s3Storage: The initialized S3 storage backend.
+// - error: An error if the bucket is not configured or the AWS SDK config cannot be loaded.
+func newS3Storage(ctx context.Context, s3Cfg S3Config) (*s3Storage, error) {
+	if s3Cfg.Bucket == "" {
+		return nil, fmt.Errorf("AWS_S3_BUCKET environment variable is not set")
+	}
+
+	var loadOptions []func(*config.LoadOptions) error
+	region := s3Cfg.Region
+	if region == "" && s3Cfg.Endpoint != "" && os.Getenv("AWS_REGION") == "" {
+		// S3-compatible stores ignore the region, but request signing still needs one.
+		region = "us-east-1"
+	}
+	if region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(region))
+	}
+
+	if s3Cfg.CABundle != "" || s3Cfg.InsecureSkipVerify {
+		tlsConfig, err := s3TLSConfig(s3Cfg)
+		if err != nil {
+			return nil, err
+		}
+		httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = tlsConfig
+		})
+		loadOptions = append(loadOptions, config.WithHTTPClient(httpClient))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s3Cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Cfg.Endpoint)
+			// Not every S3-compatible store understands the default integrity checksums.
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+		o.UsePathStyle = s3Cfg.ForcePathStyle
+	})
+	return &s3Storage{
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if s3Cfg.PartSizeMB > 0 {
+				u.PartSize = s3Cfg.PartSizeMB * 1024 * 1024
+			}
+			if s3Cfg.Concurrency > 0 {
+				u.Concurrency = s3Cfg.Concurrency
+			}
+		}),
+		bucket: s3Cfg.Bucket,
+	}, nil
+}
+
+// s3TLSConfig builds the TLS configuration used to reach the object store.
+//
+// Parameters:
+// - s3Cfg: The S3 settings.
+//
+// Returns:
+// - *tls.Config: The TLS configuration trusting the system roots plus the configured CA bundle.
+// - error: An error if the CA bundle cannot be read or parsed.
+func s3TLSConfig(s3Cfg S3Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: s3Cfg.InsecureSkipVerify,
+	}
+
+	if s3Cfg.CABundle != "" {
+		pem, err := os.ReadFile(s3Cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s: %w", s3Cfg.CABundle, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", s3Cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// Put uploads everything read from r to key, using multipart uploads for large bodies.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %w", key, err)
+	}
+	return nil
+}
+
+// Get opens the S3 object stored under key for reading.
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", key, errObjectNotFound)
+		}
+		return nil, fmt.Errorf("failed to get %s from S3: %w", key, err)
+	}
+	return out.Body, nil
+}
+
+// List returns every S3 object whose key starts with prefix, following pagination.
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects with prefix %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Delete removes the S3 object stored under key.
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %w", key, err)
+	}
+	return nil
+}
+
+// Stat returns the size and modification time of the S3 object stored under key.
+func (s *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, fmt.Errorf("%s: %w", key, errObjectNotFound)
+		}
+		return ObjectInfo{}, fmt.Errorf("failed to stat %s in S3: %w", key, err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestStorageRoundTrip stores, lists, reads and removes objects through every storage backend that needs no
+// external service.
+func TestStorageRoundTrip(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Storage
+	}{
+		{"memory", func(t *testing.T) Storage { return newMemStorage() }},
+		{"fs", func(t *testing.T) Storage { return &fsStorage{root: t.TempDir()} }},
+		{"prefix over memory", func(t *testing.T) Storage { return newPrefixStorage(newMemStorage(), "/prod/db1/") }},
+		{"prefix over fs", func(t *testing.T) Storage { return newPrefixStorage(&fsStorage{root: t.TempDir()}, "db1") }},
+	}
+	objects := map[string]string{
+		"2024/05/Monday/20240506_010000_all_databases_full_backup.sql":   "full dump",
+		"2024/05/Monday/incr_backup_binlog.000042_0_20240506_010500.log": "binlog chunk",
+		"2024/06/Tuesday/20240604_010000_backup_manifest.json":           "{}",
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := backend.open(t)
+			for key, content := range objects {
+				if err := st.Put(ctx, key, strings.NewReader(content)); err != nil {
+					t.Fatalf("Put(%s): %v", key, err)
+				}
+			}
+			// Put replaces an existing object.
+			replaced := "2024/06/Tuesday/20240604_010000_backup_manifest.json"
+			if err := st.Put(ctx, replaced, strings.NewReader(`{"id":"20240604_010000"}`)); err != nil {
+				t.Fatalf("Put(%s): %v", replaced, err)
+			}
+
+			for key, want := range map[string]string{
+				"2024/05/Monday/incr_backup_binlog.000042_0_20240506_010500.log": "binlog chunk",
+				replaced: `{"id":"20240604_010000"}`,
+			} {
+				r, err := st.Get(ctx, key)
+				if err != nil {
+					t.Fatalf("Get(%s): %v", key, err)
+				}
+				data, err := io.ReadAll(r)
+				r.Close()
+				if err != nil || string(data) != want {
+					t.Errorf("Get(%s) = %q, %v, want %q", key, data, err, want)
+				}
+			}
+
+			info, err := st.Stat(ctx, replaced)
+			if err != nil {
+				t.Fatalf("Stat(%s): %v", replaced, err)
+			}
+			if info.Key != replaced || info.Size != int64(len(`{"id":"20240604_010000"}`)) || info.LastModified.IsZero() {
+				t.Errorf("Stat(%s) = %+v", replaced, info)
+			}
+
+			for _, tc := range []struct {
+				prefix string
+				want   []string
+			}{
+				{"", []string{
+					"2024/05/Monday/20240506_010000_all_databases_full_backup.sql",
+					"2024/05/Monday/incr_backup_binlog.000042_0_20240506_010500.log",
+					"2024/06/Tuesday/20240604_010000_backup_manifest.json",
+				}},
+				{"2024/05/", []string{
+					"2024/05/Monday/20240506_010000_all_databases_full_backup.sql",
+					"2024/05/Monday/incr_backup_binlog.000042_0_20240506_010500.log",
+				}},
+				{"2024/05/Monday/incr_", []string{"2024/05/Monday/incr_backup_binlog.000042_0_20240506_010500.log"}},
+				{"2023/", nil},
+			} {
+				listed, err := st.List(ctx, tc.prefix)
+				if err != nil {
+					t.Fatalf("List(%q): %v", tc.prefix, err)
+				}
+				var keys []string
+				for _, object := range listed {
+					keys = append(keys, object.Key)
+				}
+				if !reflect.DeepEqual(keys, tc.want) {
+					t.Errorf("List(%q) = %v, want %v", tc.prefix, keys, tc.want)
+				}
+			}
+
+			if err := st.Delete(ctx, replaced); err != nil {
+				t.Fatalf("Delete(%s): %v", replaced, err)
+			}
+			if _, err := st.Get(ctx, replaced); !errors.Is(err, errObjectNotFound) {
+				t.Errorf("Get after Delete: got %v, want errObjectNotFound", err)
+			}
+			if _, err := st.Stat(ctx, replaced); !errors.Is(err, errObjectNotFound) {
+				t.Errorf("Stat after Delete: got %v, want errObjectNotFound", err)
+			}
+			if err := st.Delete(ctx, replaced); err != nil {
+				t.Errorf("Delete of a missing object: %v", err)
+			}
+		})
+	}
+}
+
+// TestPrefixStorageKeepsObjectsBelowPrefix checks that the prefix is added on the inner backend only.
+func TestPrefixStorageKeepsObjectsBelowPrefix(t *testing.T) {
+	ctx := context.Background()
+	inner := newMemStorage()
+	st := newPrefixStorage(inner, "prod/db1")
+	if err := st.Put(ctx, "2024/05/file.sql", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.Stat(ctx, "prod/db1/2024/05/file.sql"); err != nil {
+		t.Errorf("object not stored below the prefix: %v", err)
+	}
+	if listed, err := newPrefixStorage(inner, "prod/db2").List(ctx, ""); err != nil || len(listed) != 0 {
+		t.Errorf("objects of another prefix listed: %v, %v", listed, err)
+	}
+	if st := newPrefixStorage(inner, "/"); st != Storage(inner) {
+		t.Errorf("an empty prefix should return the inner backend")
+	}
+}
+
+// TestWriteFileAtomic checks that writeFileAtomic creates missing directories, replaces existing files and leaves
+// the previous content and no temporary file behind when the source fails.
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "nested", "checkpoint.json")
+
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(dest, strings.NewReader(content)); err != nil {
+			t.Fatalf("writeFileAtomic(%q): %v", content, err)
+		}
+		data, err := os.ReadFile(dest)
+		if err != nil || string(data) != content {
+			t.Fatalf("content = %q, %v, want %q", data, err, content)
+		}
+	}
+
+	failing := io.MultiReader(strings.NewReader("partial"), errReader{errors.New("read failed")})
+	if err := writeFileAtomic(dest, failing); err == nil {
+		t.Fatal("writeFileAtomic succeeded with a failing reader")
+	}
+	data, err := os.ReadFile(dest)
+	if err != nil || string(data) != "second" {
+		t.Errorf("content after a failed write = %q, %v, want %q", data, err, "second")
+	}
+	entries, err := os.ReadDir(filepath.Dir(dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+// errReader is an io.Reader failing with err.
+type errReader struct {
+	err error
+}
+
+// Read returns the error of the reader.
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSSHPort       = 22               // Port of the SSH server when MYSQL_SSH_HOST has none.
+	sshDialTimeout       = 15 * time.Second // Longest time connecting to the SSH server may take.
+	sshKeepAliveInterval = 30 * time.Second // Interval of the keepalive requests detecting a dead SSH connection.
+)
+
+// SSHOptions holds the settings of the SSH tunnel to the server, for servers only reachable through a bastion host.
+//
+// Fields:
+// - Host: The SSH server, as host or host:port (empty when no tunnel is used).
+// - User: The SSH user.
+// - KeyFile: The path to the private key authenticating the SSH user.
+// - KeyPassphrase: The passphrase of the private key, empty if it is not encrypted.
+// - KnownHosts: The known_hosts file verifying the host key of the SSH server (~/.ssh/known_hosts when empty).
+// - InsecureIgnoreHostKey: A boolean indicating whether the host key is accepted without verification (labs only).
+type SSHOptions struct {
+	Host                  string
+	User                  string
+	KeyFile               string
+	KeyPassphrase         string
+	KnownHosts            string
+	InsecureIgnoreHostKey bool
+}
+
+// sshFromEnv reads the SSH tunnel settings from MYSQL_SSH_HOST, MYSQL_SSH_USER, MYSQL_SSH_KEY_FILE,
+// MYSQL_SSH_KEY_PASSPHRASE, MYSQL_SSH_KNOWN_HOSTS and MYSQL_SSH_INSECURE_IGNORE_HOST_KEY.
+//
+// Returns:
+// - SSHOptions: The SSH tunnel settings.
+// - error: An error if a value is malformed or the settings are incomplete.
+func sshFromEnv() (SSHOptions, error) {
+	opts := SSHOptions{
+		Host:          os.Getenv("MYSQL_SSH_HOST"),
+		User:          os.Getenv("MYSQL_SSH_USER"),
+		KeyFile:       os.Getenv("MYSQL_SSH_KEY_FILE"),
+		KeyPassphrase: os.Getenv("MYSQL_SSH_KEY_PASSPHRASE"),
+		KnownHosts:    os.Getenv("MYSQL_SSH_KNOWN_HOSTS"),
+	}
+	if v := os.Getenv("MYSQL_SSH_INSECURE_IGNORE_HOST_KEY"); v != "" {
+		ignore, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("error parsing MYSQL_SSH_INSECURE_IGNORE_HOST_KEY: %v", err)
+		}
+		opts.InsecureIgnoreHostKey = ignore
+	}
+	return opts, opts.Validate()
+}
+
+// Enabled reports whether connections to the server go through an SSH tunnel.
+func (o SSHOptions) Enabled() bool {
+	return o.Host != ""
+}
+
+// Validate checks that the SSH user and key are set when a tunnel is used.
+//
+// Returns:
+// - error: An error if the tunnel settings are incomplete, otherwise nil.
+func (o SSHOptions) Validate() error {
+	if !o.Enabled() {
+		if o.User != "" || o.KeyFile != "" {
+			return fmt.Errorf("SSH tunnel settings are set but MYSQL_SSH_HOST is empty")
+		}
+		return nil
+	}
+	if o.User == "" {
+		return fmt.Errorf("MYSQL_SSH_USER is required for the SSH tunnel")
+	}
+	if o.KeyFile == "" {
+		return fmt.Errorf("MYSQL_SSH_KEY_FILE is required for the SSH tunnel")
+	}
+	return nil
+}
+
+// address returns the address of the SSH server, with the default port when none is given.
+func (o SSHOptions) address() string {
+	if _, _, err := net.SplitHostPort(o.Host); err == nil {
+		return o.Host
+	}
+	return net.JoinHostPort(o.Host, strconv.Itoa(defaultSSHPort))
+}
+
+// clientConfig builds the SSH client configuration: public key authentication and host key verification.
+//
+// Returns:
+// - *ssh.ClientConfig: The SSH client configuration.
+// - error: An error if the key or the known_hosts file cannot be loaded.
+func (o SSHOptions) clientConfig() (*ssh.ClientConfig, error) {
+	pem, err := os.ReadFile(o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+	var signer ssh.Signer
+	if o.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(o.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", o.KeyFile, err)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if o.InsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHostsFile := o.KnownHosts
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("no known_hosts file to verify the SSH host key: %w", err)
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known_hosts file: %w", err)
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            o.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// sshTunnel carries the connections to the server over an SSH connection to a bastion host.
+// The SSH connection is opened on first use and reopened once it is lost.
+//
+// Fields:
+// - opts: The SSH tunnel settings.
+// - mu: Guards client and forwarder.
+// - client: The SSH connection, nil until connected or once lost.
+// - forwarder: The local listener forwarding the connections of the MySQL client tools, nil until first used.
+type sshTunnel struct {
+	opts      SSHOptions
+	mu        sync.Mutex
+	client    *ssh.Client
+	forwarder net.Listener
+}
+
+// newSSHTunnel creates an SSH tunnel, without connecting yet.
+//
+// Parameters:
+// - opts: The SSH tunnel settings.
+//
+// Returns:
+// - *sshTunnel: The SSH tunnel.
+func newSSHTunnel(opts SSHOptions) *sshTunnel {
+	return &sshTunnel{opts: opts}
+}
+
+// dial opens a connection to an address as seen from the SSH server.
+// A dial failing on a lost SSH connection is retried once over a new SSH connection.
+//
+// Parameters:
+// - ctx: The context for the dial.
+// - network: "tcp" or "unix".
+// - address: The host:port or socket path of the server.
+//
+// Returns:
+// - net.Conn: The connection to the server.
+// - error: An error if the SSH server cannot be reached or refuses to open the connection.
+func (t *sshTunnel) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := t.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		// A rejected channel is an answer of a live SSH server, anything else means the connection is gone.
+		if _, rejected := err.(*ssh.OpenChannelError); rejected || attempt > 0 || ctx.Err() != nil {
+			return nil, fmt.Errorf("SSH tunnel to %s via %s failed: %w", address, t.opts.Host, err)
+		}
+		t.drop(client)
+	}
+}
+
+// connect returns the SSH connection, opening it when there is none.
+//
+// Parameters:
+// - ctx: The context for the dial.
+//
+// Returns:
+// - *ssh.Client: The SSH connection.
+// - error: An error if the SSH server cannot be reached or authentication fails.
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	config, err := t.opts.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	addr := t.opts.address()
+	var dialer net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, sshDialTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server %s: %w", addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	t.client = ssh.NewClient(sshConn, chans, reqs)
+	log.Printf("SSH tunnel connected to %s as %s", addr, t.opts.User)
+	go t.keepAlive(t.client)
+	return t.client, nil
+}
+
+// keepAlive sends keepalive requests over the SSH connection and drops it once the server stops answering,
+// so the next connection to the server opens a new one.
+//
+// Parameters:
+// - client: The SSH connection.
+func (t *sshTunnel) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			t.drop(client)
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				log.Printf("SSH tunnel to %s lost: %v", t.opts.Host, err)
+				t.drop(client)
+				return
+			}
+		}
+	}
+}
+
+// drop closes an SSH connection and forgets it, unless it was already replaced.
+//
+// Parameters:
+// - client: The SSH connection to drop.
+func (t *sshTunnel) drop(client *ssh.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == client {
+		t.client = nil
+	}
+	client.Close()
+}
+
+// forward returns a local address forwarding every connection to the server through the tunnel, for the MySQL
+// client tools, which cannot dial over SSH. The listener is started on first use and accepts local connections only.
+//
+// Parameters:
+// - network: "tcp" or "unix", the network of the server as seen from the SSH server.
+// - address: The host:port or socket path of the server.
+//
+// Returns:
+// - string: The host of the local listener.
+// - int: The port of the local listener.
+// - error: An error if the listener cannot be started.
+func (t *sshTunnel) forward(network, address string) (string, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.forwarder == nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to start SSH tunnel forwarder: %w", err)
+		}
+		t.forwarder = listener
+		go t.serveForwarder(listener, network, address)
+	}
+	local := t.forwarder.Addr().(*net.TCPAddr)
+	return local.IP.String(), local.Port, nil
+}
+
+// serveForwarder accepts local connections and pipes each one to the server through the tunnel.
+//
+// Parameters:
+// - listener: The local listener.
+// - network: The network of the server as seen from the SSH server.
+// - address: The address of the server.
+func (t *sshTunnel) serveForwarder(listener net.Listener, network, address string) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer local.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), sshDialTimeout)
+			remote, err := t.dial(ctx, network, address)
+			cancel()
+			if err != nil {
+				log.Printf("SSH tunnel forwarder: %v", err)
+				return
+			}
+			defer remote.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(remote, local)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(local, remote)
+				done <- struct{}{}
+			}()
+			// Either side closing ends the forwarded connection.
+			<-done
+		}()
+	}
+}
+
+// Close stops the forwarder and closes the SSH connection.
+func (t *sshTunnel) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.forwarder != nil {
+		t.forwarder.Close()
+		t.forwarder = nil
+	}
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vaultRequestTimeout bounds every request to the Vault server.
+const vaultRequestTimeout = 30 * time.Second
+
+// vaultClient is a minimal client of the HashiCorp Vault HTTP API, covering reading secrets and renewing leases.
+//
+// Fields:
+// - addr: The address of the Vault server (e.g., "https://vault.internal:8200").
+// - token: The source of the Vault token, re-read before each request so a token rotated by a Vault agent is picked up.
+// - namespace: The Vault Enterprise namespace, empty for none.
+// - http: The HTTP client used for the requests.
+type vaultClient struct {
+	addr      string
+	token     secretRef
+	namespace string
+	http      *http.Client
+}
+
+// vaultSecret is the response of Vault to a read or a lease renewal.
+//
+// Fields:
+// - LeaseID: The ID of the lease of a dynamic secret, empty for static secrets.
+// - LeaseDuration: The time to live of the secret, in seconds.
+// - Renewable: A boolean indicating whether the lease can be renewed.
+// - Data: The secret data.
+// - Auth: The token information returned by the token endpoints.
+// - Errors: The errors reported by Vault.
+type vaultSecret struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+	Auth          *vaultAuth     `json:"auth"`
+	Errors        []string       `json:"errors"`
+}
+
+// vaultAuth is the token information returned by Vault.
+//
+// Fields:
+// - LeaseDuration: The time to live of the token, in seconds.
+// - Renewable: A boolean indicating whether the token can be renewed.
+type vaultAuth struct {
+	LeaseDuration int  `json:"lease_duration"`
+	Renewable     bool `json:"renewable"`
+}
+
+// vaultFromEnv creates the Vault client from VAULT_ADDR, VAULT_TOKEN (or VAULT_TOKEN_FILE / VAULT_TOKEN_COMMAND),
+// VAULT_NAMESPACE, VAULT_CACERT and VAULT_SKIP_VERIFY, the variables of the Vault CLI.
+//
+// Returns:
+// - *vaultClient: The Vault client.
+// - error: An error if the address or token is missing or the TLS settings cannot be loaded.
+func vaultFromEnv() (*vaultClient, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is required to read secrets from Vault")
+	}
+	token, err := secretFromEnv("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if !token.isSet() {
+		return nil, fmt.Errorf("VAULT_TOKEN, VAULT_TOKEN_FILE or VAULT_TOKEN_COMMAND is required to read secrets from Vault")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if v := os.Getenv("VAULT_SKIP_VERIFY"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing VAULT_SKIP_VERIFY: %v", err)
+		}
+		tlsConfig.InsecureSkipVerify = skip
+	}
+	if caCert := os.Getenv("VAULT_CACERT"); caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULT_CACERT: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in VAULT_CACERT %s", caCert)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &vaultClient{
+		addr:      addr,
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		http:      &http.Client{Transport: transport, Timeout: vaultRequestTimeout},
+	}, nil
+}
+
+// read reads the secret at a path, e.g. "secret/data/mysql/backup" (KV version 2) or "database/creds/backup".
+//
+// Parameters:
+// - ctx: The context for the request.
+// - path: The path of the secret, without the "/v1/" prefix.
+//
+// Returns:
+// - *vaultSecret: The secret.
+// - error: An error if the request fails or Vault reports an error.
+func (v *vaultClient) read(ctx context.Context, path string) (*vaultSecret, error) {
+	return v.do(ctx, http.MethodGet, path, nil)
+}
+
+// renewLease extends the lease of a dynamic secret.
+//
+// Parameters:
+// - ctx: The context for the request.
+// - leaseID: The ID of the lease.
+// - increment: The time to live requested, Vault caps it at the maximum time to live of the lease.
+//
+// Returns:
+// - *vaultSecret: The renewed lease, with its new duration.
+// - error: An error if the lease cannot be renewed.
+func (v *vaultClient) renewLease(ctx context.Context, leaseID string, increment time.Duration) (*vaultSecret, error) {
+	body := map[string]any{"lease_id": leaseID, "increment": int(increment.Seconds())}
+	return v.do(ctx, http.MethodPut, "sys/leases/renew", body)
+}
+
+// renewToken extends the time to live of the Vault token.
+//
+// Parameters:
+// - ctx: The context for the request.
+//
+// Returns:
+// - *vaultSecret: The renewed token, with its new time to live in Auth.
+// - error: An error if the token cannot be renewed.
+func (v *vaultClient) renewToken(ctx context.Context) (*vaultSecret, error) {
+	return v.do(ctx, http.MethodPut, "auth/token/renew-self", map[string]any{})
+}
+
+// do sends a request to the Vault API and decodes the response.
+//
+// Parameters:
+// - ctx: The context for the request.
+// - method: The HTTP method.
+// - path: The API path, without the "/v1/" prefix.
+// - body: The JSON body of the request, nil for none.
+//
+// Returns:
+// - *vaultSecret: The decoded response.
+// - error: An error if the request fails, or Vault answers with an error status.
+func (v *vaultClient) do(ctx context.Context, method, path string, body any) (*vaultSecret, error) {
+	token, err := v.token.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Vault token: %w", err)
+	}
+	registerSecret(token)
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+strings.TrimLeft(path, "/"), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request %s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid Vault response to %s %s (status %d): %w", method, path, resp.StatusCode, err)
+	}
+	if resp.StatusCode >= 300 {
+		if len(secret.Errors) > 0 {
+			return nil, fmt.Errorf("vault request %s %s failed with status %d: %s", method, path, resp.StatusCode, strings.Join(secret.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault request %s %s failed with status %d", method, path, resp.StatusCode)
+	}
+	return &secret, nil
+}
+
+// fields returns the key/value data of a secret, unwrapping the "data" envelope of the KV version 2 engine.
+//
+// Returns:
+// - map[string]any: The secret fields.
+func (s *vaultSecret) fields() map[string]any {
+	inner, isMap := s.Data["data"].(map[string]any)
+	if _, hasMetadata := s.Data["metadata"]; isMap && hasMetadata {
+		return inner
+	}
+	return s.Data
+}
+
+// field returns a string field of a secret.
+//
+// Parameters:
+// - name: The name of the field.
+//
+// Returns:
+// - string: The value of the field.
+// - bool: False if the field is missing or not a string.
+func (s *vaultSecret) field(name string) (string, bool) {
+	value, ok := s.fields()[name].(string)
+	return value, ok
+}